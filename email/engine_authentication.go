@@ -0,0 +1,216 @@
+package email
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/emersion/go-msgauth/dmarc"
+	"github.com/emersion/go-smtp"
+)
+
+// Verify the DKIM signatures of an email, returning the raw verifications used
+// for DMARC alignment and the results recorded on the email
+func (e *Engine) verifyDKIM(body []byte, headers []string) ([]*dkim.Verification, []AuthenticationDKIM) {
+	verifications, err := dkim.VerifyWithOptions(bytes.NewReader(body), &dkim.VerifyOptions{
+		LookupTXT: e.lookupTXT,
+	})
+	signatures := dkimResults(headers, verifications)
+	if err != nil && len(verifications) == 0 {
+		signatures = append(signatures, AuthenticationDKIM{
+			Result: DKIMPermError,
+			Reason: err.Error(),
+		})
+	}
+	return verifications, signatures
+}
+
+// Convert DKIM verifications into per-signature results, the selector is not
+// exposed by the verifier so it is read from the matching signature header
+func dkimResults(signatures []string, verifications []*dkim.Verification) []AuthenticationDKIM {
+	results := make([]AuthenticationDKIM, 0, len(verifications))
+	for i, v := range verifications {
+		result := AuthenticationDKIM{
+			Result:     DKIMPass,
+			Domain:     strings.ToLower(v.Domain),
+			Identifier: v.Identifier,
+		}
+		if i < len(signatures) {
+			result.Selector = dkimTag(signatures[i], "s")
+		}
+		if v.Err != nil {
+			result.Reason = v.Err.Error()
+			switch {
+			case dkim.IsTempFail(v.Err):
+				result.Result = DKIMTempError
+			case dkim.IsPermFail(v.Err):
+				result.Result = DKIMPermError
+			default:
+				result.Result = DKIMFail
+			}
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// Returns an SMTP error if none of the signatures passed, transient failures
+// are reported as such so the sender retries instead of bouncing
+func rejectDKIM(signatures []AuthenticationDKIM) error {
+	if len(signatures) == 0 {
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 20},
+			Message:      "No DKIM signature found",
+		}
+	}
+	temporary := false
+	for _, d := range signatures {
+		switch d.Result {
+		case DKIMPass:
+			return nil
+		case DKIMTempError:
+			temporary = true
+		}
+	}
+	if temporary {
+		return &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 7, 5},
+			Message:      fmt.Sprint("DKIM signature could not be verified: ", signatures[0].Reason),
+		}
+	}
+	return &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 20},
+		Message:      fmt.Sprint("No passing DKIM signature found: ", signatures[0].Reason),
+	}
+}
+
+// Returns true if at least one DKIM signature passed verification
+func (a *Authentication) PassedDKIM() bool {
+	for _, d := range a.DKIM {
+		if d.Result == DKIMPass {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if the 'From' address of an email passed DMARC or has a passing
+// DKIM signature from an aligned domain, so it was not forged
+func (a *Authentication) AuthenticatedFrom(from string) bool {
+	if a == nil {
+		return false
+	}
+	_, domain, ok := cutAddress(from)
+	if !ok {
+		return false
+	}
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if a.DMARC != nil && a.DMARC.Result == DMARCPass && a.DMARC.Domain == domain {
+		return true
+	}
+	for _, d := range a.DKIM {
+		if d.Result == DKIMPass && isAligned(domain, d.Domain, dmarc.AlignmentRelaxed) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the value of a tag in a DKIM-Signature header value (e.g. "s" => "default")
+func dkimTag(signature, tag string) string {
+	for _, field := range strings.Split(signature, ";") {
+		k, v, ok := strings.Cut(field, "=")
+		if ok && strings.TrimSpace(k) == tag {
+			return strings.Join(strings.Fields(v), "")
+		}
+	}
+	return ""
+}
+
+// Format the results as an Authentication-Results header value (RFC 8601)
+func (a *Authentication) format(authservID, mailFrom, helo string) string {
+	results := []authres.Result{}
+	if a.SPF != nil {
+		results = append(results, &authres.SPFResult{
+			Value:  authres.ResultValue(a.SPF.Result),
+			Reason: a.SPF.Reason,
+			From:   mailFrom,
+			Helo:   helo,
+		})
+	}
+	for _, d := range a.DKIM {
+		results = append(results, &authres.GenericResult{
+			Method: "dkim",
+			Value:  authres.ResultValue(d.Result),
+			Params: map[string]string{
+				"reason":   d.Reason,
+				"header.d": d.Domain,
+				"header.i": d.Identifier,
+				"header.s": d.Selector,
+			},
+		})
+	}
+	if a.DMARC != nil {
+		results = append(results, &authres.DMARCResult{
+			Value:  authres.ResultValue(a.DMARC.Result),
+			Reason: a.DMARC.Reason,
+			From:   a.DMARC.Domain,
+		})
+	}
+	return authres.Format(authservID, results)
+}
+
+// Prepend an Authentication-Results header to a raw message, removing any
+// existing headers which claim to be from us as they can only be forgeries
+func addAuthenticationResults(body []byte, authservID, value string) []byte {
+	var out bytes.Buffer
+	out.Grow(len(body) + len(value) + 32)
+	out.WriteString("Authentication-Results: " + value + "\r\n")
+
+	// Copy Header Fields
+	// 	Folded fields continue on lines starting with whitespace, so the whole
+	// 	field is collected before deciding whether to keep it
+	reader := bufio.NewReader(bytes.NewReader(body))
+	var field []byte
+	flush := func() {
+		if len(field) == 0 {
+			return
+		}
+		name, value, _ := strings.Cut(string(field), ":")
+		if strings.EqualFold(strings.TrimSpace(name), "Authentication-Results") {
+			// The authserv-id is read without parsing the results, so a forged
+			// header with malformed results is removed as well
+			id, _, _ := strings.Cut(value, ";")
+			if fields := strings.Fields(id); len(fields) > 0 && strings.EqualFold(fields[0], authservID) {
+				field = field[:0]
+				return
+			}
+		}
+		out.Write(field)
+		field = field[:0]
+	}
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) == 0 || (line[0] != ' ' && line[0] != '\t') {
+			flush()
+		}
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			// End of Header, the body is copied as is
+			out.Write(line)
+			out.ReadFrom(reader)
+			break
+		}
+		field = append(field, line...)
+		if err != nil {
+			flush()
+			break
+		}
+	}
+	return out.Bytes()
+}
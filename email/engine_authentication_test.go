@@ -0,0 +1,73 @@
+package email
+
+import (
+	"testing"
+)
+
+func TestAddAuthenticationResults(t *testing.T) {
+	const value = "example.org; spf=pass smtp.mailfrom=example.net"
+	const added = "Authentication-Results: " + value + "\r\n"
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{
+			name: "no existing header",
+			body: "Subject: Hi\r\n\r\nHello\r\n",
+			want: added + "Subject: Hi\r\n\r\nHello\r\n",
+		},
+		{
+			name: "forged header",
+			body: "Authentication-Results: example.org; dkim=pass header.d=example.org\r\nSubject: Hi\r\n\r\nHello\r\n",
+			want: added + "Subject: Hi\r\n\r\nHello\r\n",
+		},
+		{
+			name: "forged header with version and different case",
+			body: "authentication-results: EXAMPLE.ORG 1; spf=pass smtp.mailfrom=example.org\r\nSubject: Hi\r\n\r\nHello\r\n",
+			want: added + "Subject: Hi\r\n\r\nHello\r\n",
+		},
+		{
+			name: "folded forged header",
+			body: "Subject: Hi\r\nAuthentication-Results: example.org;\r\n\tdkim=pass header.d=example.org;\r\n spf=pass smtp.mailfrom=example.org\r\nTo: a@example.org\r\n\r\nHello\r\n",
+			want: added + "Subject: Hi\r\nTo: a@example.org\r\n\r\nHello\r\n",
+		},
+		{
+			name: "forged header with malformed results",
+			body: "Authentication-Results: example.org; garbage\r\nSubject: Hi\r\n\r\nHello\r\n",
+			want: added + "Subject: Hi\r\n\r\nHello\r\n",
+		},
+		{
+			name: "header of another server",
+			body: "Authentication-Results: mx.example.net; spf=fail smtp.mailfrom=example.net\r\n\r\nHello\r\n",
+			want: added + "Authentication-Results: mx.example.net; spf=fail smtp.mailfrom=example.net\r\n\r\nHello\r\n",
+		},
+		{
+			name: "header of a lookalike server",
+			body: "Authentication-Results: example.org.example.net; spf=pass smtp.mailfrom=example.net\r\n\r\nHello\r\n",
+			want: added + "Authentication-Results: example.org.example.net; spf=pass smtp.mailfrom=example.net\r\n\r\nHello\r\n",
+		},
+		{
+			name: "header in the body",
+			body: "Subject: Hi\r\n\r\nAuthentication-Results: example.org; spf=pass\r\n",
+			want: added + "Subject: Hi\r\n\r\nAuthentication-Results: example.org; spf=pass\r\n",
+		},
+		{
+			name: "bare line feeds",
+			body: "Authentication-Results: example.org; spf=pass\nSubject: Hi\n\nHello\n",
+			want: added + "Subject: Hi\n\nHello\n",
+		},
+		{
+			name: "header without body",
+			body: "Subject: Hi\r\nAuthentication-Results: example.org; spf=pass",
+			want: added + "Subject: Hi\r\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(addAuthenticationResults([]byte(tt.body), "example.org", value)); got != tt.want {
+				t.Errorf("addAuthenticationResults() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -4,125 +4,418 @@ import (
 	"context"
 	"crypto"
 	"crypto/tls"
+	"errors"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/emersion/go-smtp"
 )
 
 type HandlerAuthorization = func(r *http.Request) bool
+
+// Middleware returns false to stop processing an email. Incoming middleware may
+// return a *Rejection to choose the SMTP reply, other errors cause a 451 tempfail.
 type HandlerMiddleware = func(e *Email) (bool, error)
+
+// Inbox handlers may return a *Rejection to choose the SMTP reply, other errors cause a 451 tempfail.
+// Every inbox of an email is run before replying, an error only decides the reply if no other
+// inbox accepted the email, otherwise it is passed to the ErrorLogger.
 type HandlerEmail = func(e *Email) error
 type HandlerError = func(e error)
 
+// DNS Resolver used for outgoing MX lookups and sender authentication checks,
+// satisfied by *net.Resolver
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupIP(ctx context.Context, network, host string) ([]net.IP, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
 type Engine struct {
-	activeClosing         sync.Once               // Prevents multiple shutdowns
-	activeWorkers         sync.WaitGroup          // Tracks open email workers
-	OutgoingWorkerCount   int                     // Thread Count for Queue Processing (Defaults to the value of runtime.NumCPUs())
-	OutgoingTimeout       time.Duration           // Outgoing Email Timeout
-	outgoingQueue         chan *Email             // Outgoing Email Queue
-	outgoingMiddleware    []HandlerMiddleware     // Outgoing Email Middleware
-	outgoingDKIMSigner    crypto.Signer           // Private Key for DKIM Signing
-	OutgoingSelectorName  string                  // DKIM selector used for signing outgoing emails (default: "default")
-	IncomingValidateDKIM  bool                    // Validate Incoming Emails with DKIM? (Defaults to true)
-	IncomingMaxRecipients int                     // Reject Incoming Email if amount of recipients is larger than given value (Defaults to 5)
-	IncomingMaxBytes      int64                   // Reject Incoming Email if payload is larger than x bytes (Defaults to 10MB)
-	IncomingTimeout       time.Duration           // Reject Incoming Email if processing takes longer than given duration
-	incomingMiddleware    []HandlerMiddleware     // Incoming Email Middleware
-	Domain                string                  // Advertising Domain for SMTP Server
-	ErrorLogger           HandlerError            // Provided Error Handler
-	NoInboxHandler        HandlerEmail            // Provided No Inbox Handler
-	AuthHandler           HandlerAuthorization    // Determines if a REST API request is authorized
-	inboxes               map[string]HandlerEmail // Incoming Email Inbox Handlers
-	smtpServer            *smtp.Server            // Email Server
-	httpServer            *http.Server            // HTTP Server
+	activeClosing             sync.Once                      // Prevents multiple shutdowns
+	activeStarting            sync.Once                      // Prevents starting workers multiple times
+	activeWorkers             sync.WaitGroup                 // Tracks open email workers
+	activeSending             atomic.Bool                    // Workers were started
+	stopWorkers               sync.Once                      // Prevents closing outgoingStop multiple times
+	OutgoingWorkerCount       int                            // Thread Count for Queue Processing, 0 disables sending for receive-only deployments (Defaults to the value of runtime.NumCPUs())
+	OutgoingTimeout           time.Duration                  // Outgoing Email Timeout
+	outgoingQueue             chan *Email                    // Outgoing Email Queue
+	outgoingLock              sync.RWMutex                   // Guards sending to outgoingQueue against it being closed, and outgoingUnsubscribe
+	outgoingClosed            bool                           // Outgoing Email Queue was closed by Shutdown
+	outgoingStop              chan struct{}                  // Closed to stop workers without draining the queue
+	outgoingMiddleware        []HandlerMiddleware            // Outgoing Email Middleware
+	outgoingDKIMSigner        crypto.Signer                  // Private Key for DKIM Signing
+	OutgoingSelectorName      string                         // DKIM selector used for signing outgoing emails (default: "default")
+	OutgoingInlineCSS         bool                           // Move the rules of <style> blocks into the style attributes of outbound HTML emails, keeping media queries in a <style> block (Defaults to false)
+	outgoingUnsubscribe       string                         // Address advertised in the List-Unsubscribe header
+	outgoingPort              string                         // Port of the mail exchangers outbound emails are delivered to, only changed by tests (Defaults to "25")
+	IncomingValidateDKIM      bool                           // Verify and record DKIM signatures of Incoming Emails? (Defaults to true)
+	IncomingRejectDKIMFail    bool                           // Reject Incoming Email without a passing DKIM signature, bounces (MAIL FROM:<>) are exempt (Defaults to false)
+	IncomingValidateSPF       bool                           // Evaluate SPF for Incoming Emails? (Defaults to true)
+	IncomingRejectSPFFail     bool                           // Reject Incoming Email during MAIL FROM if SPF result is 'fail' (Defaults to false)
+	IncomingValidateDMARC     bool                           // Evaluate DMARC for Incoming Emails? (Defaults to true)
+	IncomingEnforceDMARC      bool                           // Reject Incoming Email if the sender's DMARC policy says so (Defaults to true)
+	IncomingMaxRecipients     int                            // Reject Incoming Email if amount of recipients is larger than given value (Defaults to 5)
+	IncomingTagSeparator      string                         // Separates usernames from sub-address tags, empty disables sub-addressing (Defaults to "+")
+	IncomingGreylistDelay     time.Duration                  // Tempfail unseen (network, sender, recipient) triplets until they retry after given duration (Defaults to 0, disabled)
+	IncomingGreylistExpiry    time.Duration                  // Forget greylisted triplets which were not retried within given duration (Defaults to 4 hours)
+	IncomingGreylistWhitelist time.Duration                  // Skip greylisting for networks which delivered an email within given duration (Defaults to 36 days)
+	Greylist                  GreylistStore                  // Greylisting state (Defaults to an in-memory store)
+	IncomingBlocklists        []Blocklist                    // DNS blocklists queried for the address of connecting clients
+	IncomingBlocklistReject   int                            // Reject clients whose blocklist score reaches given value (Defaults to 0, disabled)
+	IncomingBlocklistTag      int                            // Tag emails whose client blocklist score reaches given value (Defaults to 0, disabled)
+	IncomingBlocklistCacheTTL time.Duration                  // Cache blocklist answers for given duration, the resolver does not report record TTLs (Defaults to 15 minutes)
+	blocklistCache            blocklistCache                 // Cached blocklist answers
+	greylistExpired           atomic.Int64                   // Unix time of the last greylist expiry
+	IncomingMaxConnections    int                            // Refuse clients with more than given amount of open connections per address (Defaults to 10)
+	IncomingMaxConnectionRate int                            // Refuse clients opening more than given amount of connections per minute per network (Defaults to 60)
+	IncomingMaxSenderRate     int                            // Tempfail senders of more than given amount of emails per minute (Defaults to 0, disabled)
+	limiter                   rateLimiter                    // Incoming connection and email counters
+	IncomingMaxBytes          int64                          // Reject Incoming Email if payload is larger than x bytes (Defaults to 10MB)
+	IncomingTimeout           time.Duration                  // Reject Incoming Email if processing takes longer than given duration
+	incomingMiddleware        []HandlerMiddleware            // Incoming Email Middleware
+	connectHooks              []HandlerSession               // Hooks for new SMTP connections
+	heloHooks                 []HandlerSession               // Hooks for HELO/EHLO commands
+	mailHooks                 []HandlerEnvelope              // Hooks for MAIL FROM commands
+	rcptHooks                 []HandlerEnvelope              // Hooks for RCPT TO commands
+	Domain                    string                         // Advertising Domain for SMTP Server
+	Resolver                  Resolver                       // DNS Resolver for MX, SPF, DKIM and DMARC lookups (Defaults to net.DefaultResolver)
+	ErrorLogger               HandlerError                   // Provided Error Handler
+	NoInboxHandler            HandlerEmail                   // Receives emails for unknown recipients, if nil they are rejected during RCPT TO
+	AuthHandler               HandlerAuthorization           // Determines if a REST API request is authorized
+	Credentials               CredentialStore                // Authenticates clients of the submission server, if nil all logins fail
+	Suppressions              SuppressionStore               // Addresses outbound emails are never delivered to (Defaults to an in-memory store)
+	SRSSecret                 string                         // Key signing the rewritten senders of forwarded emails, set a persistent one so bounces are still routed after a restart (Defaults to a random key)
+	WebhookSecret             string                         // Key signing requests to webhooks, see Webhook.Secret (Defaults to none)
+	Events                    EventStore                     // Delivery events waiting to be posted to event webhooks, use a persistent store so none are lost on restart (Defaults to an in-memory store)
+	eventLock                 sync.RWMutex                   // Guards eventHandlers and eventWebhooks
+	eventHandlers             []HandlerDeliveryEvent         // Delivery Event Handlers
+	eventWebhooks             []*eventWebhook                // Delivery Event Webhooks
+	eventWorkers              sync.WaitGroup                 // Tracks event webhook goroutines
+	eventStop                 chan struct{}                  // Closed by Shutdown to stop event webhooks
+	templateLock              sync.RWMutex                   // Guards templates, templateLayouts and templatePartials
+	templates                 map[templateKey]*templateEntry // Registered Templates by name and locale, with their versions
+	templateLayouts           map[string]string              // Shared Template Layouts
+	templatePartials          map[string]string              // Shared Template Partials
+	messageLock               sync.RWMutex                   // Guards templateMessages
+	templateMessages          map[string]map[string]Message  // Translated Template Messages by locale
+	TemplateLocale            string                         // Locale of templates and recipients which set none, the last fallback of every locale (Defaults to "en")
+	inboxLock                 sync.RWMutex                   // Guards inboxes, inboxRules and inboxCatchAll
+	inboxes                   map[string]inboxEntry          // Incoming Email Inbox Handlers
+	inboxRules                []inboxRule                    // Incoming Email Inbox Patterns
+	inboxCatchAll             HandlerEmail                   // Incoming Email Inbox for unmatched addresses of Domain
+	serversLock               sync.Mutex                     // Guards smtpServers and httpServers
+	smtpServers               []*smtp.Server                 // Email Servers
+	httpServers               []*http.Server                 // HTTP Servers
 }
 
 // Start the internal REST API for externally queueing emails.
 // Provide a nil tlsConfig to disable HTTPS.
 func (e *Engine) StartHTTP(addr string, tlsConfig *tls.Config) error {
-	httpServer := http.Server{
-		Addr:         addr,
-		Handler:      newHttpHandler(e),
+	if addr == "" {
+		addr = ":http"
+		if tlsConfig != nil {
+			addr = ":https"
+		}
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return e.ServeAPI(context.Background(), listener, tlsConfig)
+}
+
+// Serve the internal REST API on an existing listener until ctx is cancelled,
+// which closes the server and its connections, use Shutdown to stop gracefully.
+// Provide a nil tlsConfig to disable HTTPS.
+func (e *Engine) ServeAPI(ctx context.Context, listener net.Listener, tlsConfig *tls.Config) error {
+	httpServer := &http.Server{
+		Handler:      e.Handler(),
 		TLSConfig:    tlsConfig,
 		WriteTimeout: e.IncomingTimeout,
 		ReadTimeout:  e.IncomingTimeout,
 	}
-	e.httpServer = &httpServer
+	e.serversLock.Lock()
+	e.httpServers = append(e.httpServers, httpServer)
+	e.serversLock.Unlock()
+	stop := context.AfterFunc(ctx, func() { httpServer.Close() })
+	defer stop()
+
+	var err error
 	if tlsConfig != nil {
-		return httpServer.ListenAndServeTLS("", "")
+		err = httpServer.ServeTLS(listener, "", "")
+	} else {
+		err = httpServer.Serve(listener)
+	}
+	if ctx.Err() != nil && errors.Is(err, http.ErrServerClosed) {
+		return nil
 	}
-	return httpServer.ListenAndServe()
+	return err
+}
+
+// Returns the internal REST API as a handler, allowing it to be mounted in an
+// existing server with your own middleware. Mount it at the root path or strip
+// the prefix (e.g. http.StripPrefix("/email", e.Handler())).
+func (e *Engine) Handler() http.Handler {
+	return newHttpHandler(e)
 }
 
 // Start the internal SMTP Server and Outbound Queue Workers.
 // Provide a nil tlsConfig to disable TLS.
 // Provide a nil dkimSigner to disable the signing of outbound emails.
+//
+// Any amount of SMTP servers may be started on the same engine, they share inboxes,
+// middleware and a single pool of workers which signs using the dkimSigner of the first
+// server. Passing a different dkimSigner to a later server returns an error.
+// Set OutgoingWorkerCount to 0 beforehand for a receive-only deployment.
 func (e *Engine) StartSMTP(addr string, dkimSigner crypto.Signer, tlsConfig *tls.Config) error {
+	if addr == "" {
+		addr = ":smtp"
+	}
+	return e.listenSMTP(addr, false, false, dkimSigner, tlsConfig)
+}
+
+// Start the internal SMTP Server using implicit TLS (usually port 465) instead of
+// STARTTLS, otherwise identical to StartSMTP.
+func (e *Engine) StartSMTPTLS(addr string, dkimSigner crypto.Signer, tlsConfig *tls.Config) error {
+	return e.listenSMTP(addr, false, true, dkimSigner, tlsConfig)
+}
+
+// Start an SMTP Submission Server (usually port 587) which offers STARTTLS and
+// queues emails sent by clients authenticated against Credentials.
+// Provide a nil dkimSigner to disable the signing of outbound emails.
+func (e *Engine) StartSubmission(addr string, dkimSigner crypto.Signer, tlsConfig *tls.Config) error {
+	return e.listenSMTP(addr, true, false, dkimSigner, tlsConfig)
+}
+
+// Start an SMTP Submission Server using implicit TLS (usually port 465), otherwise
+// identical to StartSubmission.
+func (e *Engine) StartSubmissionTLS(addr string, dkimSigner crypto.Signer, tlsConfig *tls.Config) error {
+	return e.listenSMTP(addr, true, true, dkimSigner, tlsConfig)
+}
+
+// Serve the internal SMTP Server on an existing TCP listener (e.g. from socket
+// activation or "127.0.0.1:0" in tests) until ctx is cancelled, which closes the
+// server and its connections, use Shutdown to stop gracefully. Otherwise
+// identical to StartSMTP.
+func (e *Engine) ServeSMTP(ctx context.Context, listener net.Listener, dkimSigner crypto.Signer, tlsConfig *tls.Config) error {
+	return e.serveSMTP(ctx, listener, false, false, dkimSigner, tlsConfig)
+}
+
+// Serve the internal SMTP Server using implicit TLS on an existing TCP listener,
+// the handshake is performed by the server so the listener must not use TLS itself.
+// Otherwise identical to ServeSMTP.
+func (e *Engine) ServeSMTPTLS(ctx context.Context, listener net.Listener, dkimSigner crypto.Signer, tlsConfig *tls.Config) error {
+	return e.serveSMTP(ctx, listener, false, true, dkimSigner, tlsConfig)
+}
+
+// Serve an SMTP Submission Server on an existing TCP listener, otherwise identical to ServeSMTP.
+func (e *Engine) ServeSubmission(ctx context.Context, listener net.Listener, dkimSigner crypto.Signer, tlsConfig *tls.Config) error {
+	return e.serveSMTP(ctx, listener, true, false, dkimSigner, tlsConfig)
+}
+
+// Serve an SMTP Submission Server using implicit TLS on an existing TCP listener,
+// otherwise identical to ServeSMTPTLS.
+func (e *Engine) ServeSubmissionTLS(ctx context.Context, listener net.Listener, dkimSigner crypto.Signer, tlsConfig *tls.Config) error {
+	return e.serveSMTP(ctx, listener, true, true, dkimSigner, tlsConfig)
+}
+
+// Listen on an address and serve an SMTP Server in the given mode
+func (e *Engine) listenSMTP(addr string, submission, implicitTLS bool, dkimSigner crypto.Signer, tlsConfig *tls.Config) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return e.serveSMTP(context.Background(), listener, submission, implicitTLS, dkimSigner, tlsConfig)
+}
+
+// Serve an SMTP Server in the given mode until ctx is cancelled, starting the
+// Outbound Queue Workers alongside the first server unless OutgoingWorkerCount is 0
+func (e *Engine) serveSMTP(ctx context.Context, listener net.Listener, submission, implicitTLS bool, dkimSigner crypto.Signer, tlsConfig *tls.Config) error {
+	if tlsConfig == nil && (submission || implicitTLS) {
+		listener.Close()
+		return fmt.Errorf("smtp server requires a tls config")
+	}
+	if err := e.startWorkers(dkimSigner); err != nil {
+		listener.Close()
+		return err
+	}
+	listener = e.limitListener(listener, implicitTLS)
+	if implicitTLS {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
 
 	// Initialize Server
-	smtpServer := smtp.NewServer(&Backend{engine: e})
-	smtpServer.Addr = addr
+	smtpServer := smtp.NewServer(&Backend{engine: e, submission: submission})
 	smtpServer.Domain = e.Domain
 	smtpServer.ReadTimeout = e.IncomingTimeout
 	smtpServer.WriteTimeout = e.OutgoingTimeout
 	smtpServer.MaxMessageBytes = e.IncomingMaxBytes
 	smtpServer.MaxRecipients = e.IncomingMaxRecipients
 	smtpServer.TLSConfig = tlsConfig
-	e.outgoingDKIMSigner = dkimSigner
-	e.smtpServer = smtpServer
+	e.serversLock.Lock()
+	e.smtpServers = append(e.smtpServers, smtpServer)
+	e.serversLock.Unlock()
 
-	// Start Worker Threads
-	for i := 0; i < e.OutgoingWorkerCount; i++ {
-		e.activeWorkers.Add(1)
-		go func() {
-			defer e.activeWorkers.Done()
-			for email := range e.outgoingQueue {
-				if err := e.SendEmail(email); err != nil {
-					e.ErrorLogger(err)
+	stop := context.AfterFunc(ctx, func() { smtpServer.Close() })
+	defer stop()
+	err := smtpServer.Serve(listener)
+	if ctx.Err() != nil && errors.Is(err, smtp.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Start the Outbound Queue Workers without any servers, for deployments which
+// only send emails queued via QueueEmail or a REST API mounted using Handler().
+// Provide a nil dkimSigner to disable the signing of outbound emails.
+//
+// Returns once Shutdown has sent all queued emails, or once ctx is cancelled in
+// which case workers finish the email they are sending and the rest stay queued.
+// Workers are only started once per engine, calling this after starting an SMTP
+// server waits on the existing workers. An error is returned immediately if they
+// were started using a different dkimSigner.
+func (e *Engine) StartWorkers(ctx context.Context, dkimSigner crypto.Signer) error {
+	if err := e.startWorkers(dkimSigner); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	go func() {
+		e.activeWorkers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		e.stopWorkers.Do(func() { close(e.outgoingStop) })
+		<-done
+	}
+	return nil
+}
+
+// Start the Outbound Queue Workers if they are not running yet, the signer of
+// running workers cannot be changed so a different one is reported as an error
+func (e *Engine) startWorkers(dkimSigner crypto.Signer) error {
+	started := false
+	e.activeStarting.Do(func() {
+		started = true
+		e.outgoingDKIMSigner = dkimSigner
+		for i := 0; i < e.OutgoingWorkerCount; i++ {
+			e.activeWorkers.Add(1)
+			go func() {
+				defer e.activeWorkers.Done()
+				for {
+					select {
+					case <-e.outgoingStop:
+						return
+					case email, ok := <-e.outgoingQueue:
+						if !ok {
+							return
+						}
+						if err := e.SendEmail(email); err != nil {
+							e.ErrorLogger(err)
+						}
+					}
 				}
-			}
-		}()
+			}()
+		}
+		e.activeSending.Store(e.OutgoingWorkerCount > 0)
+	})
+	if !started && !sameSigner(e.outgoingDKIMSigner, dkimSigner) {
+		return fmt.Errorf("outbound workers were already started using a different dkim signer")
 	}
+	return nil
+}
 
-	return smtpServer.ListenAndServe()
+// Determines if two signers use the same key, nil signers only equal each other
+func sameSigner(a, b crypto.Signer) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	public, ok := a.Public().(interface{ Equal(crypto.PublicKey) bool })
+	return ok && public.Equal(b.Public())
 }
 
 // Gracefully attempt to shutdown the REST API and SMTP servers if started.
-// It will return once all connections are closed and emails have been sent.
-// It is safe to call this function multiple times.
+// It will return once all connections are closed, queued emails have been
+// sent and their delivery events posted, or once ctx is cancelled. Emails can
+// no longer be queued afterwards. It is safe to call this function multiple times.
 func (e *Engine) Shutdown(ctx context.Context) {
 	e.activeClosing.Do(func() {
 		var wg sync.WaitGroup
-		if e.httpServer != nil {
+		e.serversLock.Lock()
+		httpServers := e.httpServers
+		smtpServers := e.smtpServers
+		e.serversLock.Unlock()
+		for _, httpServer := range httpServers {
 			wg.Add(1)
 			go func() {
 				// Wait for incoming HTTP Requests to Finish
 				defer wg.Done()
-				if err := e.httpServer.Shutdown(ctx); err != nil {
+				if err := httpServer.Shutdown(ctx); err != nil {
 					log.Println("HTTP shutdown error:", err)
 				}
 			}()
 		}
-		if e.smtpServer != nil {
+		for _, smtpServer := range smtpServers {
 			wg.Add(1)
 			go func() {
 				// Wait for incoming SMTP Connections to Finish
 				defer wg.Done()
-				if err := e.smtpServer.Shutdown(ctx); err != nil {
+				if err := smtpServer.Shutdown(ctx); err != nil {
 					log.Println("SMTP shutdown error:", err)
 				}
 			}()
-			wg.Add(1)
+		}
+		wg.Wait()
+
+		// Wait for Outgoing Queue to Complete
+		// 	Submission sessions and REST API requests add to the queue,
+		// 	so it is only closed once the servers have stopped
+		e.outgoingLock.Lock()
+		e.outgoingClosed = true
+		close(e.outgoingQueue)
+		e.outgoingLock.Unlock()
+		if e.activeSending.Load() {
+			done := make(chan struct{})
 			go func() {
-				// Wait for Outgoing Queue to Complete
-				defer wg.Done()
-				close(e.outgoingQueue)
 				e.activeWorkers.Wait()
+				close(done)
 			}()
+			select {
+			case <-done:
+			case <-ctx.Done():
+				log.Println("Outbound queue shutdown error:", ctx.Err())
+			}
+		}
+		if n := len(e.outgoingQueue); n > 0 {
+			e.ErrorLogger(fmt.Errorf("%d queued emails were not sent before shutdown", n))
+		}
+		if store, ok := e.Greylist.(interface{ Flush() error }); ok {
+			if err := store.Flush(); err != nil {
+				e.ErrorLogger(err)
+			}
+		}
+
+		// Wait for Event Webhooks
+		// 	Pending events are posted one last time, failed ones stay in
+		// 	the event store for the next run
+		close(e.eventStop)
+		done := make(chan struct{})
+		go func() {
+			e.eventWorkers.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			log.Println("Event webhook shutdown error:", ctx.Err())
 		}
-		wg.Wait()
 	})
 }
@@ -0,0 +1,164 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// A DNS blocklist (DNSBL) queried for the address of connecting clients. The
+// thresholds of a list apply to the total score of clients listed in it, in
+// addition to the engine wide IncomingBlocklistReject and IncomingBlocklistTag.
+type Blocklist struct {
+	Zone   string // DNS zone of the list (e.g. "zen.spamhaus.org")
+	Weight int    // Added to the blocklist score of a client listed in this zone
+	Reject int    // Reject clients listed in this zone once their score reaches given value (Defaults to 0, disabled)
+	Tag    int    // Tag emails of clients listed in this zone once their score reaches given value (Defaults to 0, disabled)
+}
+
+type blocklistCacheEntry struct {
+	listed  bool
+	expires time.Time
+}
+
+// Caches blocklist answers per (zone, ip) to avoid querying for every connection
+type blocklistCache struct {
+	mu        sync.Mutex
+	entries   map[string]blocklistCacheEntry
+	nextPrune time.Time
+}
+
+func (c *blocklistCache) get(key string, now time.Time) (listed, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || now.After(entry.expires) {
+		return false, false
+	}
+	return entry.listed, true
+}
+
+func (c *blocklistCache) put(key string, listed bool, now time.Time, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]blocklistCacheEntry)
+	}
+	if now.After(c.nextPrune) {
+		for k, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		c.nextPrune = now.Add(ttl)
+	}
+	c.entries[key] = blocklistCacheEntry{listed: listed, expires: now.Add(ttl)}
+}
+
+// Query all configured blocklists for an address in parallel
+func (e *Engine) checkBlocklists(ip net.IP) *BlocklistResult {
+	result := &BlocklistResult{Listed: []string{}}
+	if len(e.IncomingBlocklists) == 0 || ip == nil {
+		return result
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), e.IncomingTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	reversed := reverseIP(ip)
+	for _, list := range e.IncomingBlocklists {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			listed, err := e.queryBlocklist(ctx, reversed, list.Zone)
+			if err != nil {
+				e.ErrorLogger(fmt.Errorf("cannot query blocklist '%s': %s", list.Zone, err))
+				return
+			}
+			if listed {
+				mu.Lock()
+				result.Score += list.Weight
+				result.Listed = append(result.Listed, list.Zone)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	slices.Sort(result.Listed)
+	result.Tagged = e.blocklistReached(result, e.IncomingBlocklistTag, func(list Blocklist) int { return list.Tag })
+	return result
+}
+
+// Determine if a blocklist score reaches the engine threshold or the threshold of
+// any list the client is listed in, thresholds of 0 are disabled
+func (e *Engine) blocklistReached(result *BlocklistResult, threshold int, listThreshold func(Blocklist) int) bool {
+	if threshold > 0 && result.Score >= threshold {
+		return true
+	}
+	for _, list := range e.IncomingBlocklists {
+		if t := listThreshold(list); t > 0 && result.Score >= t && slices.Contains(result.Listed, list.Zone) {
+			return true
+		}
+	}
+	return false
+}
+
+// Determine if a reversed address is listed in a zone, answers are cached for IncomingBlocklistCacheTTL
+// as the Resolver does not report the TTL of DNS records
+func (e *Engine) queryBlocklist(ctx context.Context, reversed, zone string) (bool, error) {
+	now := time.Now()
+	name := reversed + "." + strings.TrimSuffix(zone, ".")
+	if listed, ok := e.blocklistCache.get(name, now); ok {
+		return listed, nil
+	}
+	addrs, err := e.Resolver.LookupIP(ctx, "ip4", name)
+	var dnsErr *net.DNSError
+	if err != nil && !(errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+		return false, err
+	}
+
+	// Listings are answered with an address in 127.0.0.0/8, lists answer with
+	// 127.255.255.0/24 to signal errors (e.g. queries from public resolvers)
+	listed := false
+	for _, addr := range addrs {
+		if v4 := addr.To4(); v4 != nil && v4[0] == 127 && !(v4[1] == 255 && v4[2] == 255) {
+			listed = true
+		} else if v4 != nil && v4[0] == 127 {
+			return false, fmt.Errorf("blocklist returned error code %s", v4)
+		}
+	}
+	e.blocklistCache.put(name, listed, now, e.IncomingBlocklistCacheTTL)
+	return listed, nil
+}
+
+// Reject a client if its blocklist score reaches IncomingBlocklistReject or the
+// Reject threshold of a list it is listed in
+func (e *Engine) rejectBlocklisted(result *BlocklistResult) error {
+	if !e.blocklistReached(result, e.IncomingBlocklistReject, func(list Blocklist) int { return list.Reject }) {
+		return nil
+	}
+	return &smtp.SMTPError{
+		Code:         554,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      fmt.Sprint("Client host blocked using ", strings.Join(result.Listed, ", ")),
+	}
+}
+
+// Format an address for a blocklist query (e.g. 192.0.2.1 => 1.2.0.192),
+// IPv6 addresses are written as reversed nibbles
+func reverseIP(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d", v4[3], v4[2], v4[1], v4[0])
+	}
+	parts := strings.Split(spfDottedIP(ip), ".")
+	slices.Reverse(parts)
+	return strings.Join(parts, ".")
+}
@@ -0,0 +1,191 @@
+package email
+
+import (
+	"context"
+	"net"
+	"net/textproto"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Resolver counting the address lookups it answers
+type countingResolver struct {
+	testResolver
+	lookups atomic.Int32
+}
+
+func (r *countingResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	r.lookups.Add(1)
+	return r.testResolver.LookupIP(ctx, network, host)
+}
+
+func TestReverseIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{ip: "192.0.2.1", want: "1.2.0.192"},
+		{ip: "::ffff:192.0.2.1", want: "1.2.0.192"},
+		{ip: "2001:db8::1", want: "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2"},
+	}
+	for _, tt := range tests {
+		if got := reverseIP(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("reverseIP(%s) = %s, want %s", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestCheckBlocklists(t *testing.T) {
+	listed := []net.IP{net.IPv4(127, 0, 0, 2)}
+	resolver := &testResolver{ip: map[string][]net.IP{
+		"ip4 1.2.0.192.a.example":      listed,
+		"ip4 1.2.0.192.b.example":      listed,
+		"ip4 1.2.0.192.c.example":      listed,
+		"ip4 1.2.0.192.public.example": {net.IPv4(127, 255, 255, 254)},
+		"ip4 1.2.0.192.other.example":  {net.IPv4(192, 0, 2, 1)},
+	}}
+	tests := []struct {
+		name       string
+		lists      []Blocklist
+		reject     int // Engine wide reject threshold
+		tag        int // Engine wide tag threshold
+		wantScore  int
+		wantListed []string
+		wantTagged bool
+		wantReject bool
+	}{
+		{
+			name:       "unlisted",
+			lists:      []Blocklist{{Zone: "d.example", Weight: 5, Reject: 1}},
+			wantListed: []string{},
+		},
+		{
+			name:       "weights add up",
+			lists:      []Blocklist{{Zone: "b.example", Weight: 2}, {Zone: "a.example", Weight: 3}, {Zone: "d.example", Weight: 10}},
+			wantScore:  5,
+			wantListed: []string{"a.example", "b.example"},
+		},
+		{
+			name:       "engine thresholds",
+			lists:      []Blocklist{{Zone: "a.example", Weight: 2}, {Zone: "b.example", Weight: 2}},
+			reject:     4,
+			tag:        3,
+			wantScore:  4,
+			wantListed: []string{"a.example", "b.example"},
+			wantTagged: true,
+			wantReject: true,
+		},
+		{
+			name:       "engine thresholds not reached",
+			lists:      []Blocklist{{Zone: "a.example", Weight: 2}},
+			reject:     4,
+			tag:        3,
+			wantScore:  2,
+			wantListed: []string{"a.example"},
+		},
+		{
+			name:       "list thresholds",
+			lists:      []Blocklist{{Zone: "a.example", Weight: 1, Reject: 2, Tag: 1}, {Zone: "b.example", Weight: 1}},
+			wantScore:  2,
+			wantListed: []string{"a.example", "b.example"},
+			wantTagged: true,
+			wantReject: true,
+		},
+		{
+			name:       "list thresholds not reached",
+			lists:      []Blocklist{{Zone: "a.example", Weight: 1, Reject: 3, Tag: 2}},
+			wantScore:  1,
+			wantListed: []string{"a.example"},
+		},
+		{
+			name:       "thresholds of unlisted zones ignored",
+			lists:      []Blocklist{{Zone: "a.example", Weight: 5}, {Zone: "d.example", Weight: 1, Reject: 1, Tag: 1}},
+			wantScore:  5,
+			wantListed: []string{"a.example"},
+		},
+		{
+			name:       "error codes and other answers ignored",
+			lists:      []Blocklist{{Zone: "public.example", Weight: 5, Reject: 1}, {Zone: "other.example", Weight: 5, Reject: 1}, {Zone: "c.example", Weight: 1}},
+			wantScore:  1,
+			wantListed: []string{"c.example"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := New("example.org")
+			e.ErrorLogger = func(err error) {}
+			e.Resolver = resolver
+			e.IncomingBlocklists = tt.lists
+			e.IncomingBlocklistReject = tt.reject
+			e.IncomingBlocklistTag = tt.tag
+			got := e.checkBlocklists(net.ParseIP("192.0.2.1"))
+			if got.Score != tt.wantScore || !slices.Equal(got.Listed, tt.wantListed) || got.Tagged != tt.wantTagged {
+				t.Errorf("checkBlocklists() = %+v, want score %d, listed %q and tagged %t", got, tt.wantScore, tt.wantListed, tt.wantTagged)
+			}
+			if err := e.rejectBlocklisted(got); (err != nil) != tt.wantReject {
+				t.Errorf("rejectBlocklisted() = %v, want rejection %t", err, tt.wantReject)
+			}
+		})
+	}
+}
+
+func TestBlocklistCache(t *testing.T) {
+	resolver := &countingResolver{testResolver: testResolver{ip: map[string][]net.IP{
+		"ip4 1.2.0.192.a.example": {net.IPv4(127, 0, 0, 2)},
+	}}}
+	e := New("example.org")
+	e.Resolver = resolver
+	e.IncomingBlocklists = []Blocklist{{Zone: "a.example", Weight: 1}, {Zone: "b.example", Weight: 1}}
+
+	for range 3 {
+		if got := e.checkBlocklists(net.ParseIP("192.0.2.1")); got.Score != 1 {
+			t.Fatalf("checkBlocklists() = %+v, want a score of 1", got)
+		}
+	}
+	if n := resolver.lookups.Load(); n != 2 {
+		t.Errorf("resolver answered %d lookups, want one per zone as listings and unlistings are cached", n)
+	}
+
+	// Expire Cache
+	now := time.Now()
+	c := &blocklistCache{}
+	c.put("listed", true, now, time.Minute)
+	if listed, ok := c.get("listed", now.Add(time.Minute)); !ok || !listed {
+		t.Errorf("get() at expiry = %t, %t, want a cached listing", listed, ok)
+	}
+	if _, ok := c.get("listed", now.Add(time.Minute+time.Second)); ok {
+		t.Error("get() after expiry returned a cached answer")
+	}
+	c.put("other", false, now.Add(2*time.Minute), time.Minute)
+	if _, exists := c.entries["listed"]; exists {
+		t.Error("put() did not prune the expired entry")
+	}
+}
+
+func TestBlocklistRejection(t *testing.T) {
+	e := New("example.org")
+	e.ErrorLogger = func(err error) {}
+	e.Resolver = &testResolver{ip: map[string][]net.IP{
+		"ip4 1.0.0.127.a.example": {net.IPv4(127, 0, 0, 2)},
+	}}
+	e.IncomingBlocklists = []Blocklist{{Zone: "a.example", Weight: 1, Reject: 1}}
+	addr := testServe(t, &e, false, nil)
+
+	c, err := textproto.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.PrintfLine("EHLO client.example.net"); err != nil {
+		t.Fatal(err)
+	}
+	code, message, _ := c.ReadResponse(250)
+	if code != 554 || message != "5.7.1 Client host blocked using a.example" {
+		t.Errorf("EHLO reply = %d %s, want 554 5.7.1 naming the list", code, message)
+	}
+}
@@ -1,6 +1,7 @@
 package email
 
 import (
+	"crypto/rand"
 	"fmt"
 	"net"
 	"net/http"
@@ -24,19 +25,41 @@ func DefaultAuthHandler(r *http.Request) bool {
 // Create a New Engine using the Default Settings
 func New(domain string) Engine {
 	return Engine{
-		Domain:                domain,
-		OutgoingWorkerCount:   runtime.NumCPU(),
-		OutgoingTimeout:       30 * time.Second,
-		outgoingQueue:         make(chan *Email, 1024),
-		outgoingMiddleware:    []HandlerMiddleware{},
-		OutgoingSelectorName:  "default",
-		IncomingValidateDKIM:  true,
-		IncomingMaxRecipients: 5,
-		IncomingMaxBytes:      10 << 20,
-		IncomingTimeout:       30 * time.Second,
-		incomingMiddleware:    []HandlerMiddleware{},
-		AuthHandler:           DefaultAuthHandler,
-		ErrorLogger:           DefaultErrorLogger,
-		inboxes:               make(map[string]HandlerEmail),
+		Domain:                    domain,
+		OutgoingWorkerCount:       runtime.NumCPU(),
+		OutgoingTimeout:           30 * time.Second,
+		outgoingPort:              "25",
+		outgoingQueue:             make(chan *Email, 1024),
+		outgoingStop:              make(chan struct{}),
+		outgoingMiddleware:        []HandlerMiddleware{},
+		OutgoingSelectorName:      "default",
+		IncomingValidateDKIM:      true,
+		IncomingValidateSPF:       true,
+		IncomingValidateDMARC:     true,
+		IncomingEnforceDMARC:      true,
+		IncomingMaxRecipients:     5,
+		IncomingTagSeparator:      "+",
+		IncomingMaxBytes:          10 << 20,
+		IncomingGreylistExpiry:    4 * time.Hour,
+		IncomingGreylistWhitelist: 36 * 24 * time.Hour,
+		Greylist:                  NewMemoryGreylistStore(),
+		IncomingBlocklistCacheTTL: 15 * time.Minute,
+		IncomingMaxConnections:    10,
+		IncomingMaxConnectionRate: 60,
+		IncomingTimeout:           30 * time.Second,
+		incomingMiddleware:        []HandlerMiddleware{},
+		Resolver:                  net.DefaultResolver,
+		AuthHandler:               DefaultAuthHandler,
+		ErrorLogger:               DefaultErrorLogger,
+		SRSSecret:                 rand.Text(),
+		Suppressions:              NewMemorySuppressionStore(),
+		Events:                    NewMemoryEventStore(),
+		eventStop:                 make(chan struct{}),
+		inboxes:                   make(map[string]inboxEntry),
+		templates:                 make(map[templateKey]*templateEntry),
+		templateLayouts:           make(map[string]string),
+		templatePartials:          make(map[string]string),
+		templateMessages:          make(map[string]map[string]Message),
+		TemplateLocale:            "en",
 	}
 }
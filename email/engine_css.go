@@ -0,0 +1,335 @@
+package email
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/andybalholm/cascadia"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+var (
+	cssComments      = regexp.MustCompile(`(?s)/\*.*?\*/`)
+	cssDynamicPseudo = regexp.MustCompile(`(?i):(hover|active|focus|focus-within|focus-visible|visited|link|target)\b`) // Depend on user interaction, so cannot be inlined
+)
+
+// A rule from a <style> block which can be moved into style attributes
+type cssRule struct {
+	selector     cascadia.Sel
+	specificity  cascadia.Specificity
+	order        int
+	declarations []cssDeclaration
+}
+
+type cssDeclaration struct {
+	property  string
+	value     string
+	important bool
+}
+
+// Position of a declaration in the cascade, a higher rank wins
+type cssRank struct {
+	important   bool
+	inline      bool
+	specificity cascadia.Specificity
+	order       int
+}
+
+func (r cssRank) less(other cssRank) bool {
+	if r.important != other.important {
+		return other.important
+	}
+	if r.inline != other.inline {
+		return other.inline
+	}
+	if r.specificity != other.specificity {
+		return r.specificity.Less(other.specificity)
+	}
+	return r.order < other.order
+}
+
+// Move the rules of <style> blocks into the style attributes of the elements they
+// match, following the cascade: !important declarations win, then existing style
+// attributes, then the most specific selector and finally the rule declared last.
+// Media queries, other at-rules and selectors which cannot be inlined (e.g. :hover
+// or ::before) are kept in a <style> block, their declarations are made !important
+// as they would otherwise lose to the inlined styles. Style blocks with a media
+// attribute other than 'all' or 'screen' are left untouched.
+func inlineCSS(content string) (string, error) {
+	if !strings.Contains(strings.ToLower(content), "<style") {
+		return content, nil
+	}
+	document, err := html.Parse(strings.NewReader(content))
+	if err != nil {
+		return "", err
+	}
+
+	// Collect Rules
+	// 	Rules which cannot be inlined are written back to the block they came
+	// 	from, blocks which are left empty are removed
+	var rules []cssRule
+	var styles []*html.Node
+	for n := range document.Descendants() {
+		if n.Type == html.ElementNode && n.DataAtom == atom.Style {
+			styles = append(styles, n)
+		}
+	}
+	for _, style := range styles {
+		if media := strings.ToLower(strings.TrimSpace(htmlAttribute(style, "media"))); media != "" && media != "all" && media != "screen" {
+			continue
+		}
+		var source strings.Builder
+		for child := range style.ChildNodes() {
+			if child.Type == html.TextNode {
+				source.WriteString(child.Data)
+			}
+		}
+		var kept strings.Builder
+		for _, block := range splitCSS(source.String()) {
+			if strings.HasPrefix(block.prelude, "@") {
+				kept.WriteString(importantCSS(block))
+				kept.WriteString("\n")
+				continue
+			}
+			declarations := parseDeclarations(block.body)
+			for _, selector := range splitCSSList(block.prelude, ',') {
+				sel, err := cascadia.ParseWithPseudoElement(selector)
+				if err != nil || sel.PseudoElement() != "" || cssDynamicPseudo.MatchString(selector) {
+					fmt.Fprintf(&kept, "%s { %s }\n", selector, formatDeclarations(declarations, true))
+					continue
+				}
+				rules = append(rules, cssRule{
+					selector:     sel,
+					specificity:  sel.Specificity(),
+					order:        len(rules),
+					declarations: declarations,
+				})
+			}
+		}
+		for style.FirstChild != nil {
+			style.RemoveChild(style.FirstChild)
+		}
+		if kept.Len() == 0 {
+			style.Parent.RemoveChild(style)
+			continue
+		}
+		style.AppendChild(&html.Node{Type: html.TextNode, Data: "\n" + kept.String()})
+	}
+
+	// Apply Rules
+	// 	Declarations keep the position of the first declaration for their property,
+	// 	existing style attributes are applied first so their order is kept
+	if len(rules) > 0 {
+		for n := range document.Descendants() {
+			if n.Type != html.ElementNode || n.DataAtom == atom.Head || n.Parent.DataAtom == atom.Head {
+				continue
+			}
+			var properties []string
+			winners := make(map[string]cssDeclaration)
+			ranks := make(map[string]cssRank)
+			apply := func(declarations []cssDeclaration, rank cssRank) {
+				for _, d := range declarations {
+					rank.important = d.important
+					current, exists := ranks[d.property]
+					if !exists {
+						properties = append(properties, d.property)
+					} else if rank.less(current) {
+						continue
+					}
+					winners[d.property], ranks[d.property] = d, rank
+				}
+			}
+			matched := false
+			apply(parseDeclarations(htmlAttribute(n, "style")), cssRank{inline: true})
+			for _, rule := range rules {
+				if rule.selector.Match(n) {
+					apply(rule.declarations, cssRank{specificity: rule.specificity, order: rule.order})
+					matched = true
+				}
+			}
+			if !matched {
+				continue
+			}
+			declarations := make([]cssDeclaration, len(properties))
+			for i, property := range properties {
+				declarations[i] = winners[property]
+			}
+			setHTMLAttribute(n, "style", formatDeclarations(declarations, false))
+		}
+	}
+
+	// Render Document
+	var output bytes.Buffer
+	if err := html.Render(&output, document); err != nil {
+		return "", err
+	}
+	return output.String(), nil
+}
+
+// Write an at-rule with the declarations of its nested rules made !important, so
+// media queries still apply to elements with inlined styles. At-rules which do not
+// contain style rules (e.g. @font-face or @keyframes) are written as is.
+func importantCSS(block cssBlock) string {
+	name := strings.ToLower(block.prelude)
+	if !strings.HasPrefix(name, "@media") && !strings.HasPrefix(name, "@supports") {
+		return block.raw
+	}
+	var output strings.Builder
+	output.WriteString(block.prelude + " {\n")
+	for _, inner := range splitCSS(block.body) {
+		if strings.HasPrefix(inner.prelude, "@") {
+			output.WriteString(importantCSS(inner))
+		} else {
+			fmt.Fprintf(&output, "%s { %s }", inner.prelude, formatDeclarations(parseDeclarations(inner.body), true))
+		}
+		output.WriteString("\n")
+	}
+	output.WriteString("}")
+	return output.String()
+}
+
+// Write declarations for a rule or style attribute, optionally making all of them !important
+func formatDeclarations(declarations []cssDeclaration, important bool) string {
+	var output strings.Builder
+	for i, d := range declarations {
+		if i > 0 {
+			output.WriteString(" ")
+		}
+		output.WriteString(d.property + ": " + d.value)
+		if d.important || important {
+			output.WriteString(" !important")
+		}
+		output.WriteString(";")
+	}
+	return output.String()
+}
+
+// A rule or at-rule of a stylesheet
+type cssBlock struct {
+	prelude string // Selectors of a rule or the at-rule itself
+	body    string // Declarations between the braces
+	raw     string // The block as written
+}
+
+// Split a stylesheet into its top level blocks, comments are removed
+func splitCSS(source string) []cssBlock {
+	source = cssComments.ReplaceAllString(source, "")
+	var blocks []cssBlock
+	start, depth, open := 0, 0, 0
+	var quote byte
+	for i := 0; i < len(source); i++ {
+		c := source[i]
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '{':
+			if depth == 0 {
+				open = i
+			}
+			depth++
+		case c == '}' && depth > 0:
+			depth--
+			if depth == 0 {
+				blocks = append(blocks, cssBlock{
+					prelude: strings.TrimSpace(source[start:open]),
+					body:    strings.TrimSpace(source[open+1 : i]),
+					raw:     strings.TrimSpace(source[start : i+1]),
+				})
+				start = i + 1
+			}
+		case c == ';' && depth == 0:
+			// Statement At-Rules
+			// 	For example @import or @charset, which have no block
+			blocks = append(blocks, cssBlock{
+				prelude: strings.TrimSpace(source[start:i]),
+				raw:     strings.TrimSpace(source[start : i+1]),
+			})
+			start = i + 1
+		}
+	}
+	return slices.DeleteFunc(blocks, func(b cssBlock) bool { return b.prelude == "" })
+}
+
+// Split a list on a separator, ignoring those within quotes, parentheses or brackets
+func splitCSSList(source string, separator byte) []string {
+	var parts []string
+	start, depth := 0, 0
+	var quote byte
+	for i := 0; i < len(source); i++ {
+		c := source[i]
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '(' || c == '[':
+			depth++
+		case (c == ')' || c == ']') && depth > 0:
+			depth--
+		case c == separator && depth == 0:
+			parts = append(parts, source[start:i])
+			start = i + 1
+		}
+	}
+	parts = append(parts, source[start:])
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+	return slices.DeleteFunc(parts, func(p string) bool { return p == "" })
+}
+
+// Parse the declarations of a rule or style attribute
+func parseDeclarations(source string) []cssDeclaration {
+	var declarations []cssDeclaration
+	for _, part := range splitCSSList(source, ';') {
+		property, value, found := strings.Cut(part, ":")
+		if !found {
+			continue
+		}
+		d := cssDeclaration{
+			property: strings.ToLower(strings.TrimSpace(property)),
+			value:    strings.TrimSpace(value),
+		}
+		if i := strings.LastIndex(d.value, "!"); i != -1 && strings.EqualFold(strings.TrimSpace(d.value[i+1:]), "important") {
+			d.value, d.important = strings.TrimSpace(d.value[:i]), true
+		}
+		if d.property == "" || d.value == "" {
+			continue
+		}
+		declarations = append(declarations, d)
+	}
+	return declarations
+}
+
+func htmlAttribute(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Namespace == "" && a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func setHTMLAttribute(n *html.Node, key, value string) {
+	for i, a := range n.Attr {
+		if a.Namespace == "" && a.Key == key {
+			n.Attr[i].Val = value
+			return
+		}
+	}
+	n.Attr = append(n.Attr, html.Attribute{Key: key, Val: value})
+}
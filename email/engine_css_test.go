@@ -0,0 +1,169 @@
+package email
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestInlineCSS(t *testing.T) {
+	const body = `<p class="note" id="first">x</p>`
+	tests := []struct {
+		name    string
+		style   string // Contents of a <style> block in the head
+		body    string // Body of the document (Defaults to body)
+		want    []string
+		wantNot []string
+	}{
+		{
+			name:  "type selector",
+			style: "p { color: red; }",
+			want:  []string{`<p class="note" id="first" style="color: red;">`},
+		},
+		{
+			name:  "later rule wins",
+			style: "p { color: red; } p { color: blue; }",
+			want:  []string{`style="color: blue;"`},
+		},
+		{
+			name:  "class beats type",
+			style: ".note { color: blue; } p { color: red; }",
+			want:  []string{`style="color: blue;"`},
+		},
+		{
+			name:  "id beats class",
+			style: "#first { color: green; } p.note { color: blue; }",
+			want:  []string{`style="color: green;"`},
+		},
+		{
+			name:  "important beats specificity",
+			style: "p { color: red !important; } #first { color: green; }",
+			want:  []string{`style="color: red !important;"`},
+		},
+		{
+			name:  "style attribute beats rules",
+			style: "#first { color: green; margin: 0; }",
+			body:  `<p id="first" style="color: purple">x</p>`,
+			want:  []string{`style="color: purple; margin: 0;"`},
+		},
+		{
+			name:  "important beats style attribute",
+			style: "p { color: red !important; }",
+			body:  `<p style="color: purple; padding: 1px">x</p>`,
+			want:  []string{`style="color: red !important; padding: 1px;"`},
+		},
+		{
+			name:  "important style attribute beats important rule",
+			style: "p { color: red !important; }",
+			body:  `<p style="color: purple !important">x</p>`,
+			want:  []string{`style="color: purple !important;"`},
+		},
+		{
+			name:  "selector lists",
+			style: "h1, .note { font-weight: bold; }",
+			body:  `<h1>a</h1><p class="note">b</p>`,
+			want:  []string{`<h1 style="font-weight: bold;">`, `<p class="note" style="font-weight: bold;">`},
+		},
+		{
+			name:    "block removed once inlined",
+			style:   "p { color: red; }",
+			wantNot: []string{"<style"},
+		},
+		{
+			name:    "comments",
+			style:   "/* p { color: red; } */ p { color: blue; }",
+			want:    []string{`style="color: blue;"`},
+			wantNot: []string{"red"},
+		},
+		{
+			name:  "quoted values",
+			style: `p { font-family: "a;b", serif; }`,
+			want:  []string{`style="font-family: &#34;a;b&#34;, serif;"`},
+		},
+		{
+			name:  "universal selector skips head",
+			style: "* { margin: 0; }",
+			want:  []string{`<p class="note" id="first" style="margin: 0;">`},
+			wantNot: []string{
+				`<style style=`,
+				`<head style=`,
+			},
+		},
+		{
+			name:  "media query kept as important",
+			style: "p { color: red; } @media (max-width: 600px) { .note { color: blue; } }",
+			want: []string{
+				`style="color: red;"`,
+				"@media (max-width: 600px) {\n.note { color: blue !important; }\n}",
+			},
+		},
+		{
+			name:  "nested supports kept as important",
+			style: "@media screen { @supports (display: grid) { p { display: grid; } } }",
+			want:  []string{"@media screen {\n@supports (display: grid) {\np { display: grid !important; }\n}\n}"},
+		},
+		{
+			name:  "other at-rules kept as is",
+			style: "@import url(a.css); @font-face { font-family: x; src: url(x.woff); } p { color: red; }",
+			want: []string{
+				"@import url(a.css);",
+				"@font-face { font-family: x; src: url(x.woff); }",
+				`style="color: red;"`,
+			},
+		},
+		{
+			name:    "dynamic pseudo-class kept as important",
+			style:   "p:hover { color: blue; } p { color: red; }",
+			want:    []string{"p:hover { color: blue !important; }", `style="color: red;"`},
+			wantNot: []string{`style="color: blue`},
+		},
+		{
+			name:  "pseudo-element kept as important",
+			style: "p::first-line { font-weight: bold; }",
+			want:  []string{"p::first-line { font-weight: bold !important; }"},
+			wantNot: []string{
+				`style="font-weight`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := tt.body
+			if content == "" {
+				content = body
+			}
+			got, err := inlineCSS("<html><head><style>" + tt.style + "</style></head><body>" + content + "</body></html>")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(got, want) {
+					t.Errorf("inlineCSS() = %s, want it to contain %s", got, want)
+				}
+			}
+			for _, unwanted := range tt.wantNot {
+				if strings.Contains(got, unwanted) {
+					t.Errorf("inlineCSS() = %s, want it not to contain %s", got, unwanted)
+				}
+			}
+		})
+	}
+}
+
+func TestInlineCSSUntouched(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{name: "no style block", content: `<p class="note">x</p>`},
+		{name: "print media", content: `<html><head><style media="print">p { color: red; }</style></head><body><p>x</p></body></html>`},
+	}
+	for _, tt := range tests {
+		got, err := inlineCSS(tt.content)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if strings.Contains(got, `style="`) {
+			t.Errorf("%s: inlineCSS() = %s, want no style attributes", tt.name, got)
+		}
+	}
+}
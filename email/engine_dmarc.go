@@ -0,0 +1,100 @@
+package email
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/emersion/go-msgauth/dmarc"
+	"golang.org/x/net/publicsuffix"
+)
+
+// Evaluate the DMARC policy (RFC 7489) of the 'From' header domain using the
+// results of the SPF check and DKIM signature verification
+func (e *Engine) checkDMARC(fromDomain string, spf *AuthenticationSPF, verifications []*dkim.Verification) *AuthenticationDMARC {
+	fromDomain = strings.ToLower(strings.TrimSuffix(fromDomain, "."))
+	result := &AuthenticationDMARC{
+		Result:      DMARCNone,
+		Domain:      fromDomain,
+		Disposition: DMARCPolicyNone,
+	}
+
+	// Lookup Policy
+	// 	Falling back to the organizational domain if the 'From' domain has
+	// 	no policy of its own, in which case the subdomain policy applies
+	options := &dmarc.LookupOptions{LookupTXT: e.lookupTXT}
+	orgDomain := organizationalDomain(fromDomain)
+	record, err := dmarc.LookupWithOptions(fromDomain, options)
+	isSubdomain := false
+	if errors.Is(err, dmarc.ErrNoPolicy) && orgDomain != fromDomain {
+		record, err = dmarc.LookupWithOptions(orgDomain, options)
+		isSubdomain = true
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, dmarc.ErrNoPolicy):
+			result.Reason = fmt.Sprintf("no dmarc policy for '%s'", fromDomain)
+		case dmarc.IsTempFail(err):
+			result.Result = DMARCTempError
+			result.Reason = err.Error()
+		default:
+			result.Result = DMARCPermError
+			result.Reason = err.Error()
+		}
+		return result
+	}
+	result.Policy = DMARCPolicy(record.Policy)
+	if isSubdomain && record.SubdomainPolicy != "" {
+		result.Policy = DMARCPolicy(record.SubdomainPolicy)
+	}
+
+	// Check Identifier Alignment
+	if spf != nil && spf.Result == SPFPass {
+		result.SPFAligned = isAligned(fromDomain, spf.Domain, record.SPFAlignment)
+	}
+	for _, v := range verifications {
+		if v.Err == nil && isAligned(fromDomain, v.Domain, record.DKIMAlignment) {
+			result.DKIMAligned = true
+			break
+		}
+	}
+	if result.SPFAligned || result.DKIMAligned {
+		result.Result = DMARCPass
+		result.Reason = fmt.Sprintf("aligned with policy for '%s'", fromDomain)
+		return result
+	}
+	result.Result = DMARCFail
+	result.Reason = fmt.Sprintf("no aligned spf or dkim identifier for '%s'", fromDomain)
+
+	// Apply Policy
+	// 	Messages not sampled by 'pct' are given the next least strict policy (Section 6.6.4)
+	result.Disposition = result.Policy
+	if record.Percent != nil && rand.IntN(100) >= *record.Percent {
+		switch result.Policy {
+		case DMARCPolicyReject:
+			result.Disposition = DMARCPolicyQuarantine
+		case DMARCPolicyQuarantine:
+			result.Disposition = DMARCPolicyNone
+		}
+	}
+	return result
+}
+
+// Determines if an authenticated domain is aligned with the 'From' header domain
+func isAligned(fromDomain, authDomain string, mode dmarc.AlignmentMode) bool {
+	authDomain = strings.ToLower(strings.TrimSuffix(authDomain, "."))
+	if mode == dmarc.AlignmentStrict {
+		return fromDomain == authDomain
+	}
+	return organizationalDomain(fromDomain) == organizationalDomain(authDomain)
+}
+
+// Returns the organizational domain (e.g. mail.example.co.uk => example.co.uk)
+func organizationalDomain(domain string) string {
+	if org, err := publicsuffix.EffectiveTLDPlusOne(domain); err == nil {
+		return org
+	}
+	return domain
+}
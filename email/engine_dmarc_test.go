@@ -0,0 +1,189 @@
+package email
+
+import (
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/emersion/go-msgauth/dmarc"
+	"github.com/emersion/go-smtp"
+)
+
+func TestIsAligned(t *testing.T) {
+	tests := []struct {
+		from string
+		auth string
+		mode dmarc.AlignmentMode
+		want bool
+	}{
+		{from: "example.org", auth: "example.org", mode: dmarc.AlignmentStrict, want: true},
+		{from: "example.org", auth: "Example.ORG.", mode: dmarc.AlignmentStrict, want: true},
+		{from: "example.org", auth: "mail.example.org", mode: dmarc.AlignmentStrict, want: false},
+		{from: "example.org", auth: "mail.example.org", mode: dmarc.AlignmentRelaxed, want: true},
+		{from: "news.example.org", auth: "mail.example.org", mode: dmarc.AlignmentRelaxed, want: true},
+		{from: "example.co.uk", auth: "other.co.uk", mode: dmarc.AlignmentRelaxed, want: false},
+		{from: "example.org", auth: "example.net", mode: dmarc.AlignmentRelaxed, want: false},
+	}
+	for _, tt := range tests {
+		if got := isAligned(tt.from, tt.auth, tt.mode); got != tt.want {
+			t.Errorf("isAligned(%q, %q, %q) = %t, want %t", tt.from, tt.auth, tt.mode, got, tt.want)
+		}
+	}
+}
+
+func TestCheckDMARC(t *testing.T) {
+	spfPass := func(domain string) *AuthenticationSPF {
+		return &AuthenticationSPF{Result: SPFPass, Domain: domain}
+	}
+	dkimPass := func(domain string) []*dkim.Verification {
+		return []*dkim.Verification{{Domain: domain}}
+	}
+	tests := []struct {
+		name            string
+		record          string // DMARC record of example.org
+		from            string // Domain of the 'From' header (Defaults to example.org)
+		spf             *AuthenticationSPF
+		dkim            []*dkim.Verification
+		failed          bool // Lookup of the record fails temporarily
+		wantResult      DMARCResult
+		wantPolicy      DMARCPolicy
+		wantDisposition DMARCPolicy
+	}{
+		{name: "no policy", wantResult: DMARCNone, wantDisposition: DMARCPolicyNone},
+		{name: "lookup failure", failed: true, wantResult: DMARCTempError, wantDisposition: DMARCPolicyNone},
+		{name: "invalid record", record: "v=DMARC1; p=banish", wantResult: DMARCPermError, wantDisposition: DMARCPolicyNone},
+		{
+			name: "spf aligned", record: "v=DMARC1; p=reject", spf: spfPass("example.org"),
+			wantResult: DMARCPass, wantPolicy: DMARCPolicyReject, wantDisposition: DMARCPolicyNone,
+		},
+		{
+			name: "dkim aligned", record: "v=DMARC1; p=reject", dkim: dkimPass("example.org"),
+			wantResult: DMARCPass, wantPolicy: DMARCPolicyReject, wantDisposition: DMARCPolicyNone,
+		},
+		{
+			name: "failed dkim signature", record: "v=DMARC1; p=reject",
+			dkim:       []*dkim.Verification{{Domain: "example.org", Err: errors.New("bad signature")}},
+			wantResult: DMARCFail, wantPolicy: DMARCPolicyReject, wantDisposition: DMARCPolicyReject,
+		},
+		{
+			name: "spf failed", record: "v=DMARC1; p=reject", spf: &AuthenticationSPF{Result: SPFFail, Domain: "example.org"},
+			wantResult: DMARCFail, wantPolicy: DMARCPolicyReject, wantDisposition: DMARCPolicyReject,
+		},
+		{
+			name: "relaxed spf subdomain", record: "v=DMARC1; p=reject", spf: spfPass("bounces.example.org"),
+			wantResult: DMARCPass, wantPolicy: DMARCPolicyReject, wantDisposition: DMARCPolicyNone,
+		},
+		{
+			name: "strict spf subdomain", record: "v=DMARC1; p=reject; aspf=s", spf: spfPass("bounces.example.org"),
+			wantResult: DMARCFail, wantPolicy: DMARCPolicyReject, wantDisposition: DMARCPolicyReject,
+		},
+		{
+			name: "relaxed dkim subdomain", record: "v=DMARC1; p=quarantine", dkim: dkimPass("mail.example.org"),
+			wantResult: DMARCPass, wantPolicy: DMARCPolicyQuarantine, wantDisposition: DMARCPolicyNone,
+		},
+		{
+			name: "strict dkim subdomain", record: "v=DMARC1; p=quarantine; adkim=s", dkim: dkimPass("mail.example.org"),
+			wantResult: DMARCFail, wantPolicy: DMARCPolicyQuarantine, wantDisposition: DMARCPolicyQuarantine,
+		},
+		{
+			name: "unaligned", record: "v=DMARC1; p=reject", spf: spfPass("example.net"), dkim: dkimPass("example.net"),
+			wantResult: DMARCFail, wantPolicy: DMARCPolicyReject, wantDisposition: DMARCPolicyReject,
+		},
+		{
+			name: "policy none", record: "v=DMARC1; p=none",
+			wantResult: DMARCFail, wantPolicy: DMARCPolicyNone, wantDisposition: DMARCPolicyNone,
+		},
+		{
+			name: "subdomain policy", record: "v=DMARC1; p=reject; sp=quarantine", from: "news.example.org",
+			wantResult: DMARCFail, wantPolicy: DMARCPolicyQuarantine, wantDisposition: DMARCPolicyQuarantine,
+		},
+		{
+			name: "subdomain without subdomain policy", record: "v=DMARC1; p=reject", from: "news.example.org",
+			wantResult: DMARCFail, wantPolicy: DMARCPolicyReject, wantDisposition: DMARCPolicyReject,
+		},
+		{
+			name: "reject sampled", record: "v=DMARC1; p=reject; pct=100",
+			wantResult: DMARCFail, wantPolicy: DMARCPolicyReject, wantDisposition: DMARCPolicyReject,
+		},
+		{
+			name: "reject not sampled", record: "v=DMARC1; p=reject; pct=0",
+			wantResult: DMARCFail, wantPolicy: DMARCPolicyReject, wantDisposition: DMARCPolicyQuarantine,
+		},
+		{
+			name: "quarantine not sampled", record: "v=DMARC1; p=quarantine; pct=0",
+			wantResult: DMARCFail, wantPolicy: DMARCPolicyQuarantine, wantDisposition: DMARCPolicyNone,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver := &testResolver{txt: map[string][]string{}, failed: map[string]bool{}}
+			if tt.record != "" {
+				resolver.txt["_dmarc.example.org"] = []string{tt.record}
+			}
+			if tt.failed {
+				resolver.failed["_dmarc.example.org"] = true
+			}
+			e := New("example.com")
+			e.Resolver = resolver
+			from := tt.from
+			if from == "" {
+				from = "example.org"
+			}
+			got := e.checkDMARC(from, tt.spf, tt.dkim)
+			if got.Result != tt.wantResult || got.Policy != tt.wantPolicy || got.Disposition != tt.wantDisposition {
+				t.Errorf("checkDMARC() = %s (policy %q, disposition %q), want %s (policy %q, disposition %q): %s",
+					got.Result, got.Policy, got.Disposition, tt.wantResult, tt.wantPolicy, tt.wantDisposition, got.Reason)
+			}
+			if got.Domain != from {
+				t.Errorf("checkDMARC() domain = %q, want %q", got.Domain, from)
+			}
+		})
+	}
+}
+
+func TestEnforceDMARC(t *testing.T) {
+	message := strings.Join([]string{
+		"From: <alice@example.net>",
+		"To: <bob@example.org>",
+		"Subject: Hello",
+		"",
+		"Hello World",
+		"",
+	}, "\r\n")
+	for _, enforce := range []bool{true, false} {
+		e := New("example.org")
+		e.ErrorLogger = func(err error) {}
+		e.IncomingValidateSPF = false
+		e.IncomingEnforceDMARC = enforce
+		e.Resolver = &testResolver{txt: map[string][]string{"_dmarc.example.net": {"v=DMARC1; p=reject"}}}
+		var disposition atomic.Value
+		if err := e.RegisterInbox("bob", func(em *Email) error {
+			disposition.Store(em.Authentication.DMARC.Disposition)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		addr := testServe(t, &e, false, nil)
+
+		c := testDial(t, addr, false)
+		err := c.SendMail("alice@example.net", []string{"bob@example.org"}, strings.NewReader(message))
+		if enforce {
+			var smtpErr *smtp.SMTPError
+			if !errors.As(err, &smtpErr) || smtpErr.Code != 550 || smtpErr.EnhancedCode != (smtp.EnhancedCode{5, 7, 1}) {
+				t.Errorf("enforced: SendMail() = %v, want a 550 5.7.1 reply", err)
+			}
+			if disposition.Load() != nil {
+				t.Error("enforced: rejected email reached the inbox")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("not enforced: SendMail() = %s, want the email accepted", err)
+		}
+		if got := disposition.Load(); got != DMARCPolicyReject {
+			t.Errorf("not enforced: inbox saw disposition %v, want %q", got, DMARCPolicyReject)
+		}
+	}
+}
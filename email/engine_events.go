@@ -0,0 +1,278 @@
+package email
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Receives delivery events of outbound emails, called from the worker sending the
+// email so events of an email arrive in order. Handlers should return quickly.
+type HandlerDeliveryEvent = func(event DeliveryEvent)
+
+const (
+	eventMaxDelay = 5 * time.Minute    // Longest wait between attempts to post an event
+	eventMaxAge   = 3 * 24 * time.Hour // Events which could not be posted within this duration are dropped
+)
+
+// Persists delivery events until the event webhook they are queued for accepted
+// them. Events must be returned in the order they were appended.
+type EventStore interface {
+	Append(webhook string, event DeliveryEvent) error // Queues an event for the webhook with the given URL
+	Pending(webhook string) ([]DeliveryEvent, error)  // Returns the queued events of a webhook, oldest first
+	Delete(webhook string, id string) error           // Removes an event after it was accepted
+}
+
+// In-memory Event Store, pending events are lost when the process exits
+type MemoryEventStore struct {
+	mu     sync.Mutex
+	events map[string][]DeliveryEvent
+}
+
+// Create an empty in-memory Event Store
+func NewMemoryEventStore() *MemoryEventStore {
+	return &MemoryEventStore{events: make(map[string][]DeliveryEvent)}
+}
+
+func (s *MemoryEventStore) Append(webhook string, event DeliveryEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events[webhook] = append(s.events[webhook], event)
+	return nil
+}
+
+func (s *MemoryEventStore) Pending(webhook string) ([]DeliveryEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.events[webhook]), nil
+}
+
+func (s *MemoryEventStore) Delete(webhook string, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.delete(webhook, id)
+	return nil
+}
+
+func (s *MemoryEventStore) delete(webhook string, id string) {
+	s.events[webhook] = slices.DeleteFunc(s.events[webhook], func(event DeliveryEvent) bool {
+		return event.ID == id
+	})
+	if len(s.events[webhook]) == 0 {
+		delete(s.events, webhook)
+	}
+}
+
+// File-backed Event Store, pending events are kept in memory and rewritten
+// to disk as JSON after every change so they survive a restart
+type FileEventStore struct {
+	MemoryEventStore
+	path string
+}
+
+// Open or create a file-backed Event Store at the given path
+func NewFileEventStore(path string) (*FileEventStore, error) {
+	s := &FileEventStore{
+		MemoryEventStore: MemoryEventStore{events: make(map[string][]DeliveryEvent)},
+		path:             path,
+	}
+	if err := readJSONFile(path, &s.events); err != nil {
+		return nil, fmt.Errorf("cannot read event store: %s", err)
+	}
+	return s, nil
+}
+
+func (s *FileEventStore) Append(webhook string, event DeliveryEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events[webhook] = append(s.events[webhook], event)
+	return writeJSONFile(s.path, s.events)
+}
+
+func (s *FileEventStore) Delete(webhook string, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.delete(webhook, id)
+	return writeJSONFile(s.path, s.events)
+}
+
+// Webhook receiving delivery events, posted to by its own goroutine
+type eventWebhook struct {
+	hook   Webhook
+	client *http.Client
+	wake   chan struct{} // Signals that new events were appended
+}
+
+// Failed attempts at posting an event
+type eventRetry struct {
+	attempts int
+	next     time.Time
+}
+
+// Append a handler which receives delivery events of outbound emails
+func (e *Engine) OnDeliveryEvent(handler HandlerDeliveryEvent) {
+	e.eventLock.Lock()
+	defer e.eventLock.Unlock()
+	e.eventHandlers = append(e.eventHandlers, handler)
+}
+
+// Register a Webhook which delivery events of outbound emails are posted to as
+// JSON, signed like incoming email webhooks. Events are kept in the engine Events
+// store until the webhook responds with a 2xx status code, failed events are retried
+// with backoff and later events of the same email wait for them. Events still
+// pending from a previous run are posted once the webhook is registered again.
+func (e *Engine) RegisterEventWebhook(hook Webhook) error {
+	if hook.URL == "" {
+		return fmt.Errorf("event webhook requires a url")
+	}
+	timeout := hook.Timeout
+	if timeout <= 0 {
+		timeout = e.IncomingTimeout
+	}
+	e.eventLock.Lock()
+	defer e.eventLock.Unlock()
+	for _, w := range e.eventWebhooks {
+		if w.hook.URL == hook.URL {
+			return fmt.Errorf("an event webhook already exists with that url: %s", hook.URL)
+		}
+	}
+	w := &eventWebhook{
+		hook:   hook,
+		client: &http.Client{Timeout: timeout},
+		wake:   make(chan struct{}, 1),
+	}
+	e.eventWebhooks = append(e.eventWebhooks, w)
+	e.eventWorkers.Add(1)
+	go e.runEventWebhook(w)
+	return nil
+}
+
+// Record a delivery event for an outbound email, passing it to every handler
+// and queueing it for every event webhook
+func (e *Engine) emitDeliveryEvent(email *Email, recipient string, status DeliveryStatus, response string) {
+	event := DeliveryEvent{
+		ID:        rand.Text(),
+		MessageID: email.ID,
+		Recipient: recipient,
+		Status:    status,
+		Response:  response,
+		Timestamp: time.Now().UTC(),
+	}
+	e.eventLock.RLock()
+	handlers, webhooks := e.eventHandlers, e.eventWebhooks
+	e.eventLock.RUnlock()
+	for _, handler := range handlers {
+		handler(event)
+	}
+	for _, w := range webhooks {
+		if err := e.Events.Append(w.hook.URL, event); err != nil {
+			e.ErrorLogger(fmt.Errorf("cannot store delivery event for '%s': %s", w.hook.URL, err))
+			continue
+		}
+		select {
+		case w.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Post the pending events of a webhook until Shutdown, which gives it one last
+// chance to post events emitted while the queue was draining
+func (e *Engine) runEventWebhook(w *eventWebhook) {
+	defer e.eventWorkers.Done()
+	retries := make(map[string]eventRetry)
+	for {
+		next := e.flushEvents(w, retries)
+		var timer *time.Timer
+		var retry <-chan time.Time
+		if !next.IsZero() {
+			timer = time.NewTimer(time.Until(next))
+			retry = timer.C
+		}
+		select {
+		case <-w.wake:
+		case <-retry:
+		case <-e.eventStop:
+			e.flushEvents(w, retries)
+			return
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// Post pending events in order, returning when the next failed event should be
+// retried or zero if none failed
+func (e *Engine) flushEvents(w *eventWebhook, retries map[string]eventRetry) time.Time {
+	pending, err := e.Events.Pending(w.hook.URL)
+	if err != nil {
+		e.ErrorLogger(fmt.Errorf("cannot read delivery events for '%s': %s", w.hook.URL, err))
+		return time.Now().Add(time.Minute)
+	}
+
+	// Post Events
+	// 	Once an event of an email fails, later events of that email are
+	// 	held back until it succeeds so they never arrive out of order
+	var next time.Time
+	blocked := make(map[string]bool)
+	for _, event := range pending {
+		if blocked[event.MessageID] {
+			continue
+		}
+		retry, failed := retries[event.ID]
+		if failed && time.Now().Before(retry.next) {
+			blocked[event.MessageID] = true
+			if next.IsZero() || retry.next.Before(next) {
+				next = retry.next
+			}
+			continue
+		}
+		if err := e.postEvent(w, event); err != nil {
+			if time.Since(event.Timestamp) > eventMaxAge {
+				e.ErrorLogger(fmt.Errorf("delivery event %s dropped after failing to post to '%s': %s", event.ID, w.hook.URL, err))
+				delete(retries, event.ID)
+				if err := e.Events.Delete(w.hook.URL, event.ID); err != nil {
+					e.ErrorLogger(fmt.Errorf("cannot delete delivery event for '%s': %s", w.hook.URL, err))
+				}
+				continue
+			}
+			if retry.attempts == 0 {
+				e.ErrorLogger(fmt.Errorf("cannot post delivery event to '%s', retrying: %s", w.hook.URL, err))
+			}
+			retry.attempts++
+			retry.next = time.Now().Add(min(time.Second<<min(retry.attempts, 16), eventMaxDelay))
+			retries[event.ID] = retry
+			blocked[event.MessageID] = true
+			if next.IsZero() || retry.next.Before(next) {
+				next = retry.next
+			}
+			continue
+		}
+		delete(retries, event.ID)
+		if err := e.Events.Delete(w.hook.URL, event.ID); err != nil {
+			e.ErrorLogger(fmt.Errorf("cannot delete delivery event for '%s': %s", w.hook.URL, err))
+		}
+	}
+	return next
+}
+
+// Post a single event to a webhook
+func (e *Engine) postEvent(w *eventWebhook, event DeliveryEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	status, _, err := e.postWebhook(w.client, w.hook, "application/json", body)
+	if err != nil {
+		return err
+	}
+	if status < 200 || status > 299 {
+		return fmt.Errorf("responded with status %d", status)
+	}
+	return nil
+}
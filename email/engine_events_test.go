@@ -0,0 +1,200 @@
+package email
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Webhook server recording the events it accepted, fail decides whether an event is refused
+type testEventServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	accepted []DeliveryEvent
+	received chan struct{}
+}
+
+func newTestEventServer(t *testing.T, fail func(event DeliveryEvent) bool) *testEventServer {
+	s := &testEventServer{received: make(chan struct{}, 100)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event DeliveryEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if fail != nil && fail(event) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		s.mu.Lock()
+		s.accepted = append(s.accepted, event)
+		s.mu.Unlock()
+		s.received <- struct{}{}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Wait until the server accepted n events, returning the responses of the accepted events
+func (s *testEventServer) wait(t *testing.T, n int) []string {
+	t.Helper()
+	timeout := time.After(10 * time.Second)
+	for range n {
+		select {
+		case <-s.received:
+		case <-timeout:
+			t.Fatalf("webhook did not accept %d events in time", n)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	responses := make([]string, len(s.accepted))
+	for i, event := range s.accepted {
+		responses[i] = event.Response
+	}
+	return responses
+}
+
+// Shut the engine down once the test ends, stopping its event webhooks
+func testShutdown(t *testing.T, e *Engine) {
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		e.Shutdown(ctx)
+	})
+}
+
+func TestEventStores(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.json")
+	file, err := NewFileEventStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stores := map[string]EventStore{"memory": NewMemoryEventStore(), "file": file}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			for _, id := range []string{"1", "2", "3"} {
+				if err := store.Append("https://a.example", DeliveryEvent{ID: id}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := store.Append("https://b.example", DeliveryEvent{ID: "4"}); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.Delete("https://a.example", "2"); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.Delete("https://b.example", "4"); err != nil {
+				t.Fatal(err)
+			}
+			pending, err := store.Pending("https://a.example")
+			if err != nil || len(pending) != 2 || pending[0].ID != "1" || pending[1].ID != "3" {
+				t.Errorf("Pending() = %v, %v, want events 1 and 3 in order", pending, err)
+			}
+			if pending, _ := store.Pending("https://b.example"); len(pending) != 0 {
+				t.Errorf("Pending() = %v, want no events", pending)
+			}
+		})
+	}
+
+	// Reopen File Store
+	reopened, err := NewFileEventStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending, _ := reopened.Pending("https://a.example"); len(pending) != 2 || pending[1].ID != "3" {
+		t.Errorf("Pending() after reopening = %v, want events 1 and 3", pending)
+	}
+}
+
+func TestEventWebhookOrder(t *testing.T) {
+	var failOnce sync.Once
+	server := newTestEventServer(t, func(event DeliveryEvent) bool {
+		failed := false
+		if event.Response == "a1" {
+			failOnce.Do(func() { failed = true })
+		}
+		return failed
+	})
+	e := New("example.org")
+	e.ErrorLogger = func(err error) {}
+	testShutdown(t, &e)
+	if err := e.RegisterEventWebhook(Webhook{URL: server.URL}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.RegisterEventWebhook(Webhook{URL: server.URL}); err == nil {
+		t.Error("RegisterEventWebhook() with a duplicate url succeeded")
+	}
+
+	// Emit Events
+	// 	The first event of email a fails once, so its second event waits for
+	// 	it while the events of email b are posted in the meantime
+	a, b := &Email{ID: "a"}, &Email{ID: "b"}
+	e.emitDeliveryEvent(a, "x@example.net", DeliveryDeferred, "a1")
+	e.emitDeliveryEvent(b, "y@example.net", DeliveryDelivered, "b1")
+	e.emitDeliveryEvent(a, "x@example.net", DeliveryDelivered, "a2")
+	if got := server.wait(t, 1); !slices.Equal(got, []string{"b1"}) {
+		t.Fatalf("accepted %q, want b1 while a1 is retried", got)
+	}
+	if got := server.wait(t, 2); !slices.Equal(got, []string{"b1", "a1", "a2"}) {
+		t.Errorf("accepted %q, want the events of a in order after b1", got)
+	}
+
+	// Check Event Store
+	// 	Events are removed once the webhook responded, which may be just after it was received
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		pending, _ := e.Events.Pending(server.URL)
+		if len(pending) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Pending() = %v, want accepted events removed", pending)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestEventWebhookPendingFromStore(t *testing.T) {
+	server := newTestEventServer(t, nil)
+	store, err := NewFileEventStore(filepath.Join(t.TempDir(), "events.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	for _, response := range []string{"first", "second"} {
+		if err := store.Append(server.URL, DeliveryEvent{ID: response, MessageID: "a", Response: response, Timestamp: now}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e := New("example.org")
+	e.Events = store
+	testShutdown(t, &e)
+	if err := e.RegisterEventWebhook(Webhook{URL: server.URL}); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.wait(t, 2); !slices.Equal(got, []string{"first", "second"}) {
+		t.Errorf("accepted %q, want the stored events in order", got)
+	}
+}
+
+func TestDeliveryEventHandlers(t *testing.T) {
+	e := New("example.org")
+	var events []DeliveryEvent
+	e.OnDeliveryEvent(func(event DeliveryEvent) { events = append(events, event) })
+	email := &Email{ID: "a"}
+	e.emitDeliveryEvent(email, "x@example.net", DeliveryDeferred, "451 try later")
+	e.emitDeliveryEvent(email, "x@example.net", DeliveryDelivered, "250 ok")
+	if len(events) != 2 || events[0].Status != DeliveryDeferred || events[1].Status != DeliveryDelivered {
+		t.Fatalf("handler received %+v, want deferred then delivered", events)
+	}
+	if events[0].MessageID != "a" || events[0].Recipient != "x@example.net" || events[0].ID == events[1].ID || events[0].Timestamp.IsZero() {
+		t.Errorf("handler received %+v, want unique events of email a", events[0])
+	}
+}
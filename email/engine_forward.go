@@ -0,0 +1,145 @@
+package email
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base32"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Original message of a forwarded email, delivered as is instead of being rebuilt
+type forwardedEmail struct {
+	sender string // Envelope sender rewritten using SRS, empty for bounces
+	raw    []byte
+}
+
+// Register an Alias which delivers incoming emails to the inbox of another username
+// (e.g. "sales" => "team"). The inbox is resolved for every email so it may be
+// registered later, aliases of aliases are not followed.
+func (e *Engine) RegisterAlias(alias, username string) error {
+	username = strings.ToLower(username)
+	if strings.EqualFold(alias, username) {
+		return fmt.Errorf("an alias cannot point to itself: %s", alias)
+	}
+	return e.registerInbox(alias, inboxEntry{alias: username})
+}
+
+// Register an Inbox which forwards incoming emails to external addresses via the
+// outbound queue. Emails keep their original MIME, the envelope sender is rewritten
+// using the Sender Rewriting Scheme so SPF passes at the receiving end and bounces
+// find their way back to the original sender.
+func (e *Engine) RegisterForward(username string, addresses ...string) error {
+	if len(addresses) == 0 {
+		return fmt.Errorf("no addresses to forward to")
+	}
+	return e.registerInbox(username, inboxEntry{
+		handler: e.forwardHandler(addresses),
+		forward: addresses,
+	})
+}
+
+// Returns an Inbox Handler which queues the original message of an email for
+// delivery to the given addresses
+func (e *Engine) forwardHandler(addresses []string) HandlerEmail {
+	return func(em *Email) error {
+		sender := ""
+		if em.Received != nil {
+			sender = e.srsForward(em.Received.MailFrom, time.Now())
+		}
+		forward := *em
+		forward.To = make([]Address, 0, len(addresses))
+		for _, address := range addresses {
+			forward.To = append(forward.To, Address{Address: address})
+		}
+		forward.Recipient = nil
+		forward.forward = &forwardedEmail{sender: sender, raw: em.Raw}
+		if !e.QueueEmail(&forward) {
+			return TempFail("Outbound queue is full, please try again later")
+		}
+		return nil
+	}
+}
+
+// Sender Rewriting Scheme
+// 	Forwarded emails are sent from 'SRS0=HHHH=TT=domain=local@Domain' where TT is a
+// 	timestamp in days and HHHH a truncated HMAC of the other fields. Emails forwarded
+// 	a second time become 'SRS1=HHHH=forwarder==HHHH=TT=domain=local@Domain' so bounces
+// 	only need to travel back through the first forwarder.
+
+const (
+	srsMaxAge   = 21                                 // Days a rewritten address is valid for
+	srsAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567" // Base32 alphabet of timestamps
+)
+
+// Returns a truncated HMAC of the given fields, fields are compared in lowercase
+// as some servers change the case of addresses
+func (e *Engine) srsHash(fields ...string) string {
+	mac := hmac.New(sha256.New, []byte(e.SRSSecret))
+	for _, field := range fields {
+		mac.Write([]byte(strings.ToLower(field)))
+		mac.Write([]byte{0})
+	}
+	return base32.StdEncoding.EncodeToString(mac.Sum(nil))[:4]
+}
+
+// Returns the SRS timestamp for a time, the day number modulo 1024 as two base32 characters
+func srsTimestamp(now time.Time) string {
+	days := now.Unix() / 86400 % 1024
+	return string([]byte{srsAlphabet[days>>5], srsAlphabet[days&31]})
+}
+
+// Rewrite the envelope sender of an email being forwarded
+func (e *Engine) srsForward(sender string, now time.Time) string {
+	local, domain, ok := cutAddress(sender)
+	if sender == "" || !ok || strings.EqualFold(domain, e.Domain) {
+		return sender
+	}
+	switch prefix := strings.ToUpper(local[:min(len(local), 5)]); prefix {
+	case "SRS0=":
+		// Forwarded by someone else, point bounces at them
+		rest := local[4:]
+		return fmt.Sprint("SRS1=", e.srsHash(domain, rest), "=", domain, "=", rest, "@", e.Domain)
+	case "SRS1=":
+		// Forwarded many times, bounces still go to the first forwarder
+		parts := strings.SplitN(local, "=", 4)
+		if len(parts) == 4 {
+			return fmt.Sprint("SRS1=", e.srsHash(parts[2], parts[3]), "=", parts[2], "=", parts[3], "@", e.Domain)
+		}
+	}
+	timestamp := srsTimestamp(now)
+	return fmt.Sprint("SRS0=", e.srsHash(timestamp, domain, local), "=", timestamp, "=", domain, "=", local, "@", e.Domain)
+}
+
+// Returns the original sender of a rewritten address, false if the address was
+// not rewritten by us or has expired
+func (e *Engine) srsReverse(address string, now time.Time) (string, bool) {
+	local, domain, ok := cutAddress(address)
+	if !ok || !strings.EqualFold(domain, e.Domain) || len(local) < 5 {
+		return "", false
+	}
+	switch strings.ToUpper(local[:5]) {
+	case "SRS0=":
+		parts := strings.SplitN(local[5:], "=", 4)
+		if len(parts) != 4 || !strings.EqualFold(parts[0], e.srsHash(parts[1], parts[2], parts[3])) {
+			return "", false
+		}
+		timestamp := strings.ToUpper(parts[1])
+		if len(timestamp) != 2 || strings.IndexByte(srsAlphabet, timestamp[0]) < 0 || strings.IndexByte(srsAlphabet, timestamp[1]) < 0 {
+			return "", false
+		}
+		days := strings.IndexByte(srsAlphabet, timestamp[0])<<5 | strings.IndexByte(srsAlphabet, timestamp[1])
+		if (int(now.Unix()/86400%1024)-days+1024)%1024 > srsMaxAge {
+			return "", false
+		}
+		return parts[3] + "@" + parts[2], true
+	case "SRS1=":
+		parts := strings.SplitN(local[5:], "=", 3)
+		if len(parts) != 3 || !strings.EqualFold(parts[0], e.srsHash(parts[1], parts[2])) {
+			return "", false
+		}
+		return "SRS0" + parts[2] + "@" + parts[1], true
+	}
+	return "", false
+}
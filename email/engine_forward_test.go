@@ -0,0 +1,104 @@
+package email
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSRS(t *testing.T) {
+	day := func(n int64) time.Time { return time.Unix(n*86400+3600, 0).UTC() }
+	now := day(20000)
+
+	tests := []struct {
+		name      string
+		sender    string
+		forwarded time.Time
+		reversed  time.Time
+		rewrite   func(string) string // Changes the rewritten address before it is reversed
+		prefix    string              // Expected prefix of the rewritten address, empty if unchanged
+		want      string              // Expected original address, empty if it cannot be reversed
+	}{
+		{name: "srs0", sender: "user@example.net", prefix: "SRS0=", want: "user@example.net"},
+		{name: "case changed", sender: "User@Example.net", rewrite: strings.ToUpper, prefix: "SRS0=", want: "USER@EXAMPLE.NET"},
+		{name: "local part with equals", sender: "a=b@example.net", prefix: "SRS0=", want: "a=b@example.net"},
+		{name: "valid until max age", sender: "user@example.net", reversed: now.AddDate(0, 0, srsMaxAge), prefix: "SRS0=", want: "user@example.net"},
+		{name: "expired", sender: "user@example.net", reversed: now.AddDate(0, 0, srsMaxAge+1), prefix: "SRS0="},
+		{name: "timestamp wraps", sender: "user@example.net", forwarded: day(1022), reversed: day(1027), prefix: "SRS0=", want: "user@example.net"},
+		{
+			name:    "tampered hash",
+			sender:  "user@example.net",
+			rewrite: func(s string) string { return "SRS0=AAAA" + s[9:] },
+			prefix:  "SRS0=",
+		},
+		{
+			name:    "tampered sender",
+			sender:  "user@example.net",
+			rewrite: func(s string) string { return strings.Replace(s, "=user@", "=admin@", 1) },
+			prefix:  "SRS0=",
+		},
+		{
+			name:    "other domain",
+			sender:  "user@example.net",
+			rewrite: func(s string) string { return strings.Replace(s, "@example.org", "@example.com", 1) },
+			prefix:  "SRS0=",
+		},
+		{
+			name:   "srs1 from srs0",
+			sender: "SRS0=HHHH=TT=origin.net=user@forwarder.net",
+			prefix: "SRS1=",
+			want:   "SRS0=HHHH=TT=origin.net=user@forwarder.net",
+		},
+		{
+			name:   "srs1 from srs1",
+			sender: "SRS1=XXXX=forwarder.net==HHHH=TT=origin.net=user@second.net",
+			prefix: "SRS1=",
+			want:   "SRS0=HHHH=TT=origin.net=user@forwarder.net",
+		},
+		{name: "own domain", sender: "user@example.org"},
+		{name: "bounce", sender: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := New("example.org")
+			e.SRSSecret = "secret"
+			forwarded, reversed := tt.forwarded, tt.reversed
+			if forwarded.IsZero() {
+				forwarded = now
+			}
+			if reversed.IsZero() {
+				reversed = forwarded
+			}
+
+			address := e.srsForward(tt.sender, forwarded)
+			if tt.prefix == "" {
+				if address != tt.sender {
+					t.Fatalf("srsForward(%q) = %q, want it unchanged", tt.sender, address)
+				}
+				return
+			}
+			if !strings.HasPrefix(address, tt.prefix) || !strings.HasSuffix(address, "@example.org") {
+				t.Fatalf("srsForward(%q) = %q, want a %s address of example.org", tt.sender, address, tt.prefix)
+			}
+			if tt.rewrite != nil {
+				address = tt.rewrite(address)
+			}
+			got, ok := e.srsReverse(address, reversed)
+			if ok != (tt.want != "") || got != tt.want {
+				t.Errorf("srsReverse(%q) = %q, %t, want %q", address, got, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestSRSSecret(t *testing.T) {
+	now := time.Now()
+	e := New("example.org")
+	e.SRSSecret = "secret"
+	address := e.srsForward("user@example.net", now)
+	other := New("example.org")
+	other.SRSSecret = "another secret"
+	if got, ok := other.srsReverse(address, now); ok {
+		t.Errorf("srsReverse(%q) with another secret = %q, want it rejected", address, got)
+	}
+}
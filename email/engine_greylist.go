@@ -0,0 +1,256 @@
+package email
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// The state of a greylisted triplet or whitelisted client
+type GreylistEntry struct {
+	FirstSeen time.Time `json:"first_seen"` // First delivery attempt
+	LastSeen  time.Time `json:"last_seen"`  // Latest delivery attempt
+	Passed    bool      `json:"passed"`     // Client retried after the greylist delay
+}
+
+// Persists greylisting state, keys are either a (network, sender, recipient)
+// triplet or a network which was automatically whitelisted
+type GreylistStore interface {
+	Get(key string) (*GreylistEntry, error) // Returns nil if the key is unknown
+	Put(key string, entry GreylistEntry) error
+	Delete(key string) error
+	Expire(pendingBefore, passedBefore time.Time) error // Removes pending entries first seen and passed entries last seen before the given times
+}
+
+// In-memory Greylist Store, entries are lost when the process exits
+type MemoryGreylistStore struct {
+	mu      sync.Mutex
+	entries map[string]GreylistEntry
+}
+
+// Create an empty in-memory Greylist Store
+func NewMemoryGreylistStore() *MemoryGreylistStore {
+	return &MemoryGreylistStore{entries: make(map[string]GreylistEntry)}
+}
+
+func (s *MemoryGreylistStore) Get(key string) (*GreylistEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if entry, ok := s.entries[key]; ok {
+		return &entry, nil
+	}
+	return nil, nil
+}
+
+func (s *MemoryGreylistStore) Put(key string, entry GreylistEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[key] = entry
+	return nil
+}
+
+func (s *MemoryGreylistStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+	return nil
+}
+
+func (s *MemoryGreylistStore) Expire(pendingBefore, passedBefore time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire(pendingBefore, passedBefore)
+	return nil
+}
+
+func (s *MemoryGreylistStore) expire(pendingBefore, passedBefore time.Time) {
+	for key, entry := range s.entries {
+		if (!entry.Passed && entry.FirstSeen.Before(pendingBefore)) ||
+			(entry.Passed && entry.LastSeen.Before(passedBefore)) {
+			delete(s.entries, key)
+		}
+	}
+}
+
+// Delay before changes to a FileGreylistStore are written, changes made in the
+// meantime are written along with them
+const greylistFlushDelay = 5 * time.Second
+
+// File-backed Greylist Store, all entries are kept in memory and written to disk
+// as JSON shortly after they change. Changes made just before a crash may be lost,
+// which at worst greylists a client again. Call Flush to write pending changes.
+type FileGreylistStore struct {
+	MemoryGreylistStore
+	path     string
+	flushing *time.Timer // Pending write, nil if the file is up to date
+	failure  error       // Error of the last background write, returned by the next change
+}
+
+// Open or create a file-backed Greylist Store at the given path
+func NewFileGreylistStore(path string) (*FileGreylistStore, error) {
+	s := &FileGreylistStore{
+		MemoryGreylistStore: MemoryGreylistStore{entries: make(map[string]GreylistEntry)},
+		path:                path,
+	}
+	if err := readJSONFile(path, &s.entries); err != nil {
+		return nil, fmt.Errorf("cannot read greylist store: %s", err)
+	}
+	return s, nil
+}
+
+func (s *FileGreylistStore) Put(key string, entry GreylistEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[key] = entry
+	return s.schedule()
+}
+
+func (s *FileGreylistStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+	return s.schedule()
+}
+
+func (s *FileGreylistStore) Expire(pendingBefore, passedBefore time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire(pendingBefore, passedBefore)
+	return s.schedule()
+}
+
+// Write pending changes to disk immediately
+func (s *FileGreylistStore) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.flushing == nil {
+		return nil
+	}
+	s.flushing.Stop()
+	return s.flush()
+}
+
+// Schedule a write if none is pending, returning the error of the previous write
+func (s *FileGreylistStore) schedule() error {
+	if s.flushing == nil {
+		s.flushing = time.AfterFunc(greylistFlushDelay, func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.failure = s.flush()
+		})
+	}
+	err := s.failure
+	s.failure = nil
+	return err
+}
+
+func (s *FileGreylistStore) flush() error {
+	s.flushing = nil
+	if err := writeJSONFile(s.path, s.entries); err != nil {
+		return fmt.Errorf("cannot write greylist store: %s", err)
+	}
+	return nil
+}
+
+// Returns the network a client belongs to, clients often retry from a
+// different address in the same pool so IPv4 uses the /24 and IPv6 the /64
+func clientNetwork(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+// Greylist a recipient, returning a 451 tempfail if the triplet is unseen or
+// the client retried too soon
+func (e *Engine) checkGreylist(s *Session, recipient string) error {
+	ip := s.RemoteIP()
+	if e.IncomingGreylistDelay <= 0 || e.Greylist == nil || ip == nil {
+		return nil
+	}
+	now := time.Now().UTC()
+	network := clientNetwork(ip)
+	e.expireGreylist(now)
+
+	// Skip Whitelisted Clients
+	whitelisted, err := e.Greylist.Get(network)
+	if err != nil {
+		e.ErrorLogger(fmt.Errorf("cannot lookup greylist: %s", err))
+		return nil
+	}
+	if whitelisted != nil && now.Sub(whitelisted.LastSeen) < e.IncomingGreylistWhitelist {
+		return nil
+	}
+
+	// Check Triplet
+	// 	Entries which were never retried are forgotten after IncomingGreylistExpiry,
+	// 	entries which passed live as long as a whitelisted client would
+	key := strings.ToLower(fmt.Sprint(network, " ", s.From(), " ", recipient))
+	entry, err := e.Greylist.Get(key)
+	if err != nil {
+		e.ErrorLogger(fmt.Errorf("cannot lookup greylist: %s", err))
+		return nil
+	}
+	if entry == nil ||
+		(!entry.Passed && now.Sub(entry.FirstSeen) > e.IncomingGreylistExpiry) ||
+		(entry.Passed && now.Sub(entry.LastSeen) > e.IncomingGreylistWhitelist) {
+		entry = &GreylistEntry{FirstSeen: now}
+	}
+	entry.LastSeen = now
+	if !entry.Passed && now.Sub(entry.FirstSeen) >= e.IncomingGreylistDelay {
+		entry.Passed = true
+	}
+	if err := e.Greylist.Put(key, *entry); err != nil {
+		e.ErrorLogger(fmt.Errorf("cannot update greylist: %s", err))
+		return nil
+	}
+	if !entry.Passed {
+		return &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+			Message:      "Greylisted, please try again later",
+		}
+	}
+	return nil
+}
+
+// Whitelist the client of a session after it successfully delivered an email
+// that passed greylisting, so it is not delayed again
+func (e *Engine) whitelistGreylist(s *Session) {
+	ip := s.RemoteIP()
+	if e.IncomingGreylistDelay <= 0 || e.Greylist == nil || ip == nil {
+		return
+	}
+	now := time.Now().UTC()
+	network := clientNetwork(ip)
+	entry, err := e.Greylist.Get(network)
+	if err != nil {
+		e.ErrorLogger(fmt.Errorf("cannot lookup greylist: %s", err))
+		return
+	}
+	if entry == nil {
+		entry = &GreylistEntry{FirstSeen: now, Passed: true}
+	}
+	entry.LastSeen = now
+	if err := e.Greylist.Put(network, *entry); err != nil {
+		e.ErrorLogger(fmt.Errorf("cannot update greylist: %s", err))
+	}
+}
+
+// Remove stale greylist entries, at most once a minute
+func (e *Engine) expireGreylist(now time.Time) {
+	last := e.greylistExpired.Load()
+	if now.Unix()-last < 60 || !e.greylistExpired.CompareAndSwap(last, now.Unix()) {
+		return
+	}
+	if err := e.Greylist.Expire(
+		now.Add(-e.IncomingGreylistExpiry),
+		now.Add(-e.IncomingGreylistWhitelist),
+	); err != nil {
+		e.ErrorLogger(fmt.Errorf("cannot expire greylist: %s", err))
+	}
+}
@@ -0,0 +1,157 @@
+package email
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestClientNetwork(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{ip: "192.0.2.3", want: "192.0.2.0/24"},
+		{ip: "::ffff:192.0.2.200", want: "192.0.2.0/24"},
+		{ip: "2001:db8:1:2:3:4:5:6", want: "2001:db8:1:2::/64"},
+	}
+	for _, tt := range tests {
+		if got := clientNetwork(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("clientNetwork(%s) = %s, want %s", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestGreylist(t *testing.T) {
+	e := New("example.org")
+	e.ErrorLogger = func(err error) {}
+	e.IncomingValidateSPF = false
+	e.IncomingValidateDKIM = false
+	e.IncomingValidateDMARC = false
+	e.IncomingGreylistDelay = time.Minute
+	for _, username := range []string{"bob", "carol"} {
+		if err := e.RegisterInbox(username, func(em *Email) error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	addr := testServe(t, &e, false, nil)
+	send := func(from, to string) error {
+		t.Helper()
+		c := testDial(t, addr, false)
+		message := "From: <" + from + ">\r\nTo: <" + to + ">\r\nSubject: Hello\r\n\r\nHello World\r\n"
+		return c.SendMail(from, []string{to}, strings.NewReader(message))
+	}
+	isGreylisted := func(err error) bool {
+		var smtpErr *smtp.SMTPError
+		return errors.As(err, &smtpErr) && smtpErr.Code == 451 && smtpErr.EnhancedCode == smtp.EnhancedCode{4, 7, 1}
+	}
+	const key = "127.0.0.0/24 alice@example.net bob@example.org"
+	const network = "127.0.0.0/24"
+
+	// First Seen
+	if err := send("alice@example.net", "bob@example.org"); !isGreylisted(err) {
+		t.Fatalf("first attempt = %v, want a 451 4.7.1 reply", err)
+	}
+	entry, _ := e.Greylist.Get(key)
+	if entry == nil || entry.Passed {
+		t.Fatalf("greylist entry = %+v, want a pending entry", entry)
+	}
+	if err := send("alice@example.net", "bob@example.org"); !isGreylisted(err) {
+		t.Fatalf("early retry = %v, want a 451 4.7.1 reply", err)
+	}
+	if whitelisted, _ := e.Greylist.Get(network); whitelisted != nil {
+		t.Fatalf("network was whitelisted before passing: %+v", whitelisted)
+	}
+
+	// Retry After Delay
+	entry.FirstSeen = entry.FirstSeen.Add(-e.IncomingGreylistDelay)
+	e.Greylist.Put(key, *entry)
+	if err := send("alice@example.net", "bob@example.org"); err != nil {
+		t.Fatalf("retry after the delay = %s, want the email accepted", err)
+	}
+	if entry, _ := e.Greylist.Get(key); entry == nil || !entry.Passed {
+		t.Errorf("greylist entry = %+v, want it passed", entry)
+	}
+
+	// Whitelisted After Data
+	whitelisted, _ := e.Greylist.Get(network)
+	if whitelisted == nil {
+		t.Fatal("network was not whitelisted after delivering")
+	}
+	if err := send("dave@example.com", "carol@example.org"); err != nil {
+		t.Fatalf("new triplet from a whitelisted network = %s, want the email accepted", err)
+	}
+	whitelisted.LastSeen = whitelisted.LastSeen.Add(-e.IncomingGreylistWhitelist)
+	e.Greylist.Put(network, *whitelisted)
+	if err := send("erin@example.com", "carol@example.org"); !isGreylisted(err) {
+		t.Errorf("new triplet after the whitelist expired = %v, want a 451 4.7.1 reply", err)
+	}
+}
+
+func TestGreylistStores(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	path := filepath.Join(t.TempDir(), "greylist.json")
+	file, err := NewFileGreylistStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stores := map[string]GreylistStore{"memory": NewMemoryGreylistStore(), "file": file}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			entries := map[string]GreylistEntry{
+				"pending":        {FirstSeen: now, LastSeen: now},
+				"stale pending":  {FirstSeen: now.Add(-2 * time.Hour), LastSeen: now},
+				"passed":         {FirstSeen: now.Add(-48 * time.Hour), LastSeen: now, Passed: true},
+				"stale passed":   {FirstSeen: now, LastSeen: now.Add(-48 * time.Hour), Passed: true},
+				"deleted passed": {FirstSeen: now, LastSeen: now, Passed: true},
+			}
+			for key, entry := range entries {
+				if err := store.Put(key, entry); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := store.Delete("deleted passed"); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.Expire(now.Add(-time.Hour), now.Add(-24*time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+			for key, entry := range entries {
+				got, err := store.Get(key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				kept := key == "pending" || key == "passed"
+				if kept && (got == nil || *got != entry) {
+					t.Errorf("Get(%q) = %+v, want %+v", key, got, entry)
+				}
+				if !kept && got != nil {
+					t.Errorf("Get(%q) = %+v, want it removed", key, got)
+				}
+			}
+		})
+	}
+
+	// Reopen File Store
+	if early, err := NewFileGreylistStore(path); err != nil || len(early.entries) != 0 {
+		t.Fatalf("changes were written before the flush delay: %v", err)
+	}
+	if err := file.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := NewFileGreylistStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := reopened.Get("passed"); got == nil || !got.Passed || !got.FirstSeen.Equal(now.Add(-48*time.Hour)) {
+		t.Errorf("Get() after reopening = %+v, want the passed entry", got)
+	}
+	if got, _ := reopened.Get("stale passed"); got != nil {
+		t.Errorf("Get() after reopening = %+v, want the expired entry removed", got)
+	}
+}
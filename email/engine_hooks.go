@@ -0,0 +1,50 @@
+package email
+
+// Connection-stage hooks run before the email body is uploaded, letting
+// unwanted clients be turned away early. A hook accepts by returning nil,
+// rejects by returning a *Rejection, any other error causes a 451 tempfail.
+type HandlerSession = func(s *Session) error
+type HandlerEnvelope = func(s *Session, address string) error
+
+// Append a hook which runs when a client connects, the remote IP and TLS state are available.
+// The underlying SMTP server creates sessions once the client introduces itself, so
+// these hooks run right before any HELO hooks. They run once per connection, not
+// again when the client introduces itself after STARTTLS.
+func (e *Engine) UseConnect(handler HandlerSession) {
+	e.connectHooks = append(e.connectHooks, handler)
+}
+
+// Append a hook which runs when a client first introduces itself with HELO or EHLO
+func (e *Engine) UseHelo(handler HandlerSession) {
+	e.heloHooks = append(e.heloHooks, handler)
+}
+
+// Append a hook which runs for the MAIL FROM command, after SPF has been evaluated
+func (e *Engine) UseMailFrom(handler HandlerEnvelope) {
+	e.mailHooks = append(e.mailHooks, handler)
+}
+
+// Append a hook which runs for every RCPT TO command, after the recipient has been accepted
+func (e *Engine) UseRcptTo(handler HandlerEnvelope) {
+	e.rcptHooks = append(e.rcptHooks, handler)
+}
+
+// Run session hooks in order, stopping at the first one which does not accept
+func (e *Engine) runSessionHooks(stage string, hooks []HandlerSession, s *Session) error {
+	for _, hook := range hooks {
+		if err := hook(s); err != nil {
+			return e.smtpReply(stage+" hook", err)
+		}
+	}
+	return nil
+}
+
+// Run envelope hooks in order, stopping at the first one which does not accept
+func (e *Engine) runEnvelopeHooks(stage string, hooks []HandlerEnvelope, s *Session, address string) error {
+	for _, hook := range hooks {
+		if err := hook(s, address); err != nil {
+			return e.smtpReply(stage+" hook", err)
+		}
+	}
+	return nil
+}
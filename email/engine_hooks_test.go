@@ -0,0 +1,191 @@
+package email
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestSMTPReply(t *testing.T) {
+	tests := []struct {
+		err     error
+		code    int
+		message string
+		logged  bool
+	}{
+		{Reject("Go away"), 550, "Go away", false},
+		{TempFail("Busy"), 451, "Busy", false},
+		{&Rejection{Code: 554, EnhancedCode: [3]int{5, 7, 0}, Message: "Custom"}, 554, "Custom", false},
+		{fmt.Errorf("wrapped: %w", Reject("Wrapped")), 550, "Wrapped", false},
+		{errors.New("disk full"), 451, "Temporary local error, please try again later", true},
+	}
+	for _, tt := range tests {
+		e := New("example.org")
+		logged := false
+		e.ErrorLogger = func(err error) { logged = true }
+		var smtpErr *smtp.SMTPError
+		if err := e.smtpReply("test", tt.err); !errors.As(err, &smtpErr) || smtpErr.Code != tt.code || smtpErr.Message != tt.message {
+			t.Errorf("smtpReply(%v) = %v, want %d %s", tt.err, err, tt.code, tt.message)
+		}
+		if logged != tt.logged {
+			t.Errorf("smtpReply(%v) logged = %t, want %t", tt.err, logged, tt.logged)
+		}
+	}
+}
+
+// Talk to a server until it replies with a failure, returns the failed command and its reply.
+// The command is empty if the email was accepted.
+func testDialogue(t *testing.T, addr string) (command string, code int, message string) {
+	t.Helper()
+	c, _, _ := testGreeting(t, addr)
+	for _, command := range []string{"EHLO client.example.net", "MAIL FROM:<sender@example.net>", "RCPT TO:<inbox@example.org>", "DATA"} {
+		if err := c.PrintfLine("%s", command); err != nil {
+			t.Fatal(err)
+		}
+		if code, message, _ := c.ReadResponse(0); code >= 400 {
+			return strings.Fields(command)[0], code, message
+		}
+	}
+	w := c.DotWriter()
+	fmt.Fprint(w, "From: Sender <sender@example.net>\r\n")
+	fmt.Fprint(w, "To: Inbox <inbox@example.org>\r\n")
+	fmt.Fprint(w, "Subject: Hello\r\n\r\nHello World\r\n")
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if code, message, _ := c.ReadResponse(0); code >= 400 {
+		return "DATA", code, message
+	}
+	return "", 250, ""
+}
+
+func TestHookReplies(t *testing.T) {
+	stages := []struct {
+		name    string
+		command string // Command the client sees the reply for
+		use     func(e *Engine, err error)
+	}{
+		{"connect", "EHLO", func(e *Engine, err error) {
+			e.UseConnect(func(s *Session) error { return err })
+		}},
+		{"helo", "EHLO", func(e *Engine, err error) {
+			e.UseHelo(func(s *Session) error { return err })
+		}},
+		{"mail from", "MAIL", func(e *Engine, err error) {
+			e.UseMailFrom(func(s *Session, address string) error { return err })
+		}},
+		{"rcpt to", "RCPT", func(e *Engine, err error) {
+			e.UseRcptTo(func(s *Session, address string) error { return err })
+		}},
+		{"incoming middleware", "DATA", func(e *Engine, err error) {
+			e.UseIncoming(func(email *Email) (bool, error) { return err == nil, err })
+		}},
+	}
+	replies := []struct {
+		name    string
+		err     error
+		code    int
+		message string
+		logged  bool
+	}{
+		{"reject", Reject("Go away"), 550, "5.7.1 Go away", false},
+		{"tempfail", TempFail("Busy"), 451, "4.3.0 Busy", false},
+		{"custom", &Rejection{Code: 554, EnhancedCode: [3]int{5, 7, 0}, Message: "Not here"}, 554, "5.7.0 Not here", false},
+		{"error", errors.New("disk full"), 451, "4.3.0 Temporary local error, please try again later", true},
+	}
+	for _, stage := range stages {
+		for _, reply := range replies {
+			t.Run(stage.name+"/"+reply.name, func(t *testing.T) {
+				e := New("example.org")
+				e.IncomingValidateSPF = false
+				e.IncomingValidateDKIM = false
+				e.IncomingValidateDMARC = false
+				var logLock sync.Mutex
+				var logs []string
+				e.ErrorLogger = func(err error) {
+					logLock.Lock()
+					defer logLock.Unlock()
+					logs = append(logs, err.Error())
+				}
+				if err := e.RegisterInbox("inbox", func(email *Email) error { return nil }); err != nil {
+					t.Fatal(err)
+				}
+				stage.use(&e, reply.err)
+				addr := testServe(t, &e, false, nil)
+
+				command, code, message := testDialogue(t, addr)
+				if command != stage.command || code != reply.code || message != reply.message {
+					t.Errorf("%s reply = %d %s, want %s reply %d %s", command, code, message, stage.command, reply.code, reply.message)
+				}
+				logLock.Lock()
+				defer logLock.Unlock()
+				if logged := len(logs) > 0 && strings.HasPrefix(logs[0], stage.name); logged != reply.logged {
+					t.Errorf("logs = %q, want logged %t", logs, reply.logged)
+				}
+			})
+		}
+	}
+
+	// Middleware which stops an email without a reason rejects it
+	e := New("example.org")
+	e.IncomingValidateSPF = false
+	e.IncomingValidateDKIM = false
+	e.IncomingValidateDMARC = false
+	if err := e.RegisterInbox("inbox", func(email *Email) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	e.UseIncoming(func(email *Email) (bool, error) { return false, nil })
+	addr := testServe(t, &e, false, nil)
+	if command, code, message := testDialogue(t, addr); command != "DATA" || code != 550 || message != "5.7.1 Email rejected" {
+		t.Errorf("%s reply = %d %s, want DATA reply 550 5.7.1 Email rejected", command, code, message)
+	}
+}
+
+// Hooks which accept let the email through to its inbox
+func TestHooksAccept(t *testing.T) {
+	e := New("example.org")
+	e.IncomingValidateSPF = false
+	e.IncomingValidateDKIM = false
+	e.IncomingValidateDMARC = false
+	var stages []string
+	e.UseConnect(func(s *Session) error {
+		stages = append(stages, "connect")
+		return nil
+	})
+	e.UseHelo(func(s *Session) error {
+		stages = append(stages, "helo "+s.Hostname())
+		return nil
+	})
+	e.UseMailFrom(func(s *Session, address string) error {
+		stages = append(stages, "mail from "+address)
+		return nil
+	})
+	e.UseRcptTo(func(s *Session, address string) error {
+		stages = append(stages, "rcpt to "+address)
+		return nil
+	})
+	e.UseIncoming(func(email *Email) (bool, error) {
+		stages = append(stages, "incoming")
+		return true, nil
+	})
+	if err := e.RegisterInbox("inbox", func(email *Email) error {
+		stages = append(stages, "inbox")
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	addr := testServe(t, &e, false, nil)
+
+	if command, code, message := testDialogue(t, addr); command != "" {
+		t.Fatalf("%s reply = %d %s, want the email accepted", command, code, message)
+	}
+	want := []string{"connect", "helo client.example.net", "mail from sender@example.net", "rcpt to inbox@example.org", "incoming", "inbox"}
+	if !slices.Equal(stages, want) {
+		t.Errorf("stages = %q, want %q", stages, want)
+	}
+}
@@ -2,9 +2,14 @@ package email
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net/mail"
+	"strings"
+	"time"
 
 	"github.com/emersion/go-msgauth/dkim"
 	"github.com/emersion/go-smtp"
@@ -16,17 +21,14 @@ func (e *Engine) UseIncoming(handler HandlerMiddleware) {
 	e.incomingMiddleware = append(e.incomingMiddleware, handler)
 }
 
-// Register an Inbox to Handle Incoming Emails
-func (e *Engine) RegisterInbox(username string, handler HandlerEmail) error {
-	address := fmt.Sprint(username, "@", e.Domain)
-	if _, exists := e.inboxes[address]; exists {
-		return fmt.Errorf("an inbox already exists with that username: %s", address)
-	}
-	e.inboxes[address] = handler
-	return nil
+// Lookup TXT records using the engine resolver, for use in DKIM and DMARC options
+func (e *Engine) lookupTXT(domain string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), e.IncomingTimeout)
+	defer cancel()
+	return e.Resolver.LookupTXT(ctx, domain)
 }
 
-func (e *Engine) incomingHandler(r io.Reader) error {
+func (e *Engine) incomingHandler(s *Session, r io.Reader) error {
 
 	// Read Incoming Envelope
 	// 	Additionally we need to clone this message otherwise the DKIM Reader
@@ -43,50 +45,56 @@ func (e *Engine) incomingHandler(r io.Reader) error {
 	}
 
 	// Validate Incoming Addresses
+	// 	Routing is decided by the envelope recipients, the 'To' header is only informative
+	// 	and is missing or empty for Bcc'd and mailing list emails
 	var emailFrom *mail.Address
-	var emailTo []*mail.Address
-	if emailTo, err = mail.ParseAddressList(envelope.GetHeader("To")); err != nil {
-		e.ErrorLogger(fmt.Errorf("incoming email contains an invalid 'To' header: %s", err))
-		return smtp.ErrDataReset
-	}
+	emailTo, _ := mail.ParseAddressList(envelope.GetHeader("To"))
 	if emailFrom, err = mail.ParseAddress(envelope.GetHeader("From")); err != nil {
 		e.ErrorLogger(fmt.Errorf("incoming email contains an invalid 'From' header: %s", err))
 		return smtp.ErrDataReset
 	}
-	if len(emailTo) > e.IncomingMaxRecipients {
+	if len(s.to) > e.IncomingMaxRecipients {
 		// SMTP Backend should have filtered this out earlier, but we stop it here jic
 		e.ErrorLogger(fmt.Errorf("incoming email includes too many recipients"))
 		return smtp.ErrDataReset
 	}
 
-	// Validate Incoming Signature
-	if e.IncomingValidateDKIM {
-		if _, err := dkim.Verify(bytes.NewReader(body)); err != nil {
-			e.ErrorLogger(fmt.Errorf("incoming email failed dkim signature validation: %s", err))
-			return smtp.ErrDataReset
-		}
+	// Verify Incoming Signatures
+	// 	Signatures are verified once and recorded, DKIM and DMARC then
+	// 	apply their own policies to the results independently
+	var verifications []*dkim.Verification
+	var signatures []AuthenticationDKIM
+	if e.IncomingValidateDKIM || e.IncomingValidateDMARC {
+		verifications, signatures = e.verifyDKIM(body, envelope.GetHeaderValues("DKIM-Signature"))
 	}
 
-	// Apply Abstraction
-	incomingAttachments := make([]Attachment, 0, len(envelope.Attachments)+len(envelope.Inlines))
-	for i := range envelope.Attachments {
-		a := envelope.Attachments[i]
-		incomingAttachments = append(incomingAttachments, Attachment{
-			Filename:    a.FileName,
-			ContentType: a.ContentType,
-			Data:        a.Content,
-			Inline:      false,
-		})
+	// Enforce DKIM Policy
+	// 	The email is only rejected here if IncomingRejectDKIMFail is set, otherwise
+	// 	middleware gets to decide. Bounces are often unsigned, so null sender
+	// 	emails are never rejected
+	if e.IncomingValidateDKIM && e.IncomingRejectDKIMFail && s.From() != "" {
+		if err := rejectDKIM(signatures); err != nil {
+			return err
+		}
 	}
-	for i := range envelope.Inlines {
-		a := envelope.Inlines[i]
-		incomingAttachments = append(incomingAttachments, Attachment{
-			Filename:    a.FileName,
-			ContentType: a.ContentType,
-			Data:        a.Content,
-			Inline:      true,
-		})
+
+	// Enforce DMARC Policy
+	// 	Only the policy published by the sender domain is applied, missing or
+	// 	failing signatures alone never cause a rejection here
+	var dmarcResult *AuthenticationDMARC
+	if e.IncomingValidateDMARC {
+		_, fromDomain, _ := strings.Cut(emailFrom.Address, "@")
+		dmarcResult = e.checkDMARC(fromDomain, s.spf, verifications)
+		if dmarcResult.Disposition == DMARCPolicyReject && e.IncomingEnforceDMARC {
+			return &smtp.SMTPError{
+				Code:         550,
+				EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+				Message:      fmt.Sprintf("Email rejected per DMARC policy for %s", dmarcResult.Domain),
+			}
+		}
 	}
+
+	// Apply Abstraction
 	incomingRecipients := make([]Address, 0, len(emailTo))
 	for _, recipient := range emailTo {
 		incomingRecipients = append(incomingRecipients, Address{
@@ -94,57 +102,147 @@ func (e *Engine) incomingHandler(r io.Reader) error {
 			Address: recipient.Address,
 		})
 	}
+	authentication := &Authentication{
+		SPF:   s.spf,
+		DKIM:  signatures,
+		DMARC: dmarcResult,
+	}
+	received := &Received{
+		Hostname:  s.Hostname(),
+		MailFrom:  s.From(),
+		RcptTo:    s.To(),
+		Timestamp: time.Now().UTC(),
+		MessageID: strings.TrimSpace(envelope.GetHeader("Message-ID")),
+		Blocklist: s.Blocklist(),
+	}
+	if ip := s.RemoteIP(); ip != nil {
+		received.RemoteIP = ip.String()
+	}
+	if state, ok := s.TLS(); ok {
+		received.TLSVersion = tls.VersionName(state.Version)
+		received.TLSCipher = tls.CipherSuiteName(state.CipherSuite)
+	}
 	email := &Email{
 		From: Address{
 			Address: emailFrom.Address,
 			Name:    emailFrom.Name,
 		},
-		To:          incomingRecipients,
-		Subject:     envelope.GetHeader("Subject"),
-		Attachments: incomingAttachments,
-	}
-	if envelope.HTML == "" {
-		email.Content = envelope.Text
-		email.HTML = false
-	} else {
-		email.Content = envelope.HTML
-		email.HTML = true
+		To:             incomingRecipients,
+		Subject:        envelope.GetHeader("Subject"),
+		Attachments:    envelopeAttachments(envelope),
+		Authentication: authentication,
+		Received:       received,
+		Raw: addAuthenticationResults(
+			body,
+			e.Domain,
+			authentication.format(e.Domain, s.from, s.conn.Hostname()),
+		),
 	}
+	email.Content, email.HTML, email.Text = envelopeContent(envelope)
 
 	// Run Middleware
 	for _, mw := range e.incomingMiddleware {
 		if proceed, err := mw(email); !proceed {
 			if err != nil {
-				e.ErrorLogger(fmt.Errorf("incoming middleware encountered an error: %s", err))
+				return e.smtpReply("incoming middleware", err)
 			}
-			return smtp.ErrDataReset
+			return e.smtpReply("incoming middleware", Reject("Email rejected"))
 		}
 	}
 
 	// Route to Appropriate Inboxes
-	receivedBy := 0
-	for _, recipient := range emailTo {
-		if handler, ok := e.inboxes[recipient.Address]; ok {
-			if err := handler(email); err != nil {
-				e.ErrorLogger(fmt.Errorf("inbox handler encountered an error: %s", err))
-				return smtp.ErrDataReset
-			}
-			receivedBy++
+	// 	An inbox may be unregistered between RCPT and DATA, its recipient is skipped
+	// 	so the other inboxes are not failed along with it
+	unknownRecipients := 0
+	var handled int
+	var failures []error
+	for _, address := range s.to {
+		handler, recipient := e.lookupInbox(address)
+		if handler == nil {
+			unknownRecipients++
+			continue
+		}
+		delivery := *email
+		delivery.Recipient = recipient
+		handled++
+		if err := handler(&delivery); err != nil {
+			failures = append(failures, err)
 		}
 	}
-	if receivedBy == 0 {
-		if e.NoInboxHandler != nil {
-			if err := e.NoInboxHandler(email); err != nil {
-				e.ErrorLogger(fmt.Errorf("no inbox handler encountered an error: %s", err))
-				return smtp.ErrDataReset
+	if unknownRecipients > 0 {
+		// Session only accepts unknown recipients if a NoInboxHandler was provided,
+		// without one the email is only rejected if no inbox received it
+		if e.NoInboxHandler == nil {
+			if handled > 0 {
+				return e.combinedReply(handled, failures)
 			}
+			return &smtp.SMTPError{
+				Code:         550,
+				EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+				Message:      "Unknown Recipient",
+			}
+		}
+		handled++
+		if err := e.NoInboxHandler(email); err != nil {
+			failures = append(failures, err)
+		}
+	}
+
+	return e.combinedReply(handled, failures)
+}
+
+// Combine the results of every inbox handler into the single reply of a transaction.
+// Once any inbox accepted the email it is accepted as a whole and the failures are
+// logged, as a retry would deliver it again to the inboxes which already accepted it.
+// If every inbox failed a temporary failure is preferred, so nothing is lost by a retry.
+func (e *Engine) combinedReply(handled int, failures []error) error {
+	if len(failures) == 0 {
+		return nil
+	}
+	if len(failures) < handled {
+		for _, err := range failures {
+			e.ErrorLogger(fmt.Errorf("inbox handler failed after another inbox accepted the email: %s", err))
 		}
-		return &smtp.SMTPError{
-			Code:         550,
-			EnhancedCode: smtp.EnhancedCodeNotSet,
-			Message:      "Unknown Recipient",
+		return nil
+	}
+	for _, err := range failures {
+		var r *Rejection
+		if !errors.As(err, &r) || r.Temporary() {
+			return e.smtpReply("inbox handler", err)
 		}
 	}
+	return e.smtpReply("inbox handler", failures[0])
+}
+
+// Convert the attachments and inline parts of a parsed message
+func envelopeAttachments(envelope *enmime.Envelope) []Attachment {
+	attachments := make([]Attachment, 0, len(envelope.Attachments)+len(envelope.Inlines))
+	for i := range envelope.Attachments {
+		a := envelope.Attachments[i]
+		attachments = append(attachments, Attachment{
+			Filename:    a.FileName,
+			ContentType: a.ContentType,
+			Data:        a.Content,
+			Inline:      false,
+		})
+	}
+	for i := range envelope.Inlines {
+		a := envelope.Inlines[i]
+		attachments = append(attachments, Attachment{
+			Filename:    a.FileName,
+			ContentType: a.ContentType,
+			Data:        a.Content,
+			Inline:      true,
+		})
+	}
+	return attachments
+}
 
-	return nil
+// Returns the HTML body of a parsed message along with its plain text alternative,
+// or the text body if it has no HTML
+func envelopeContent(envelope *enmime.Envelope) (content string, html bool, text string) {
+	if envelope.HTML == "" {
+		return envelope.Text, false, ""
+	}
+	return envelope.HTML, true, envelope.Text
 }
@@ -0,0 +1,280 @@
+package email
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/text/feature/plural"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+	"golang.org/x/text/number"
+)
+
+// A translated message, keyed by plural form ("zero", "one", "two", "few", "many",
+// "other") or an exact count like "=0". A message without plural forms only sets
+// "other", which is what a plain JSON string decodes to.
+type Message map[string]string
+
+func (m *Message) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*m = Message{"other": text}
+		return nil
+	}
+	var forms map[string]string
+	if err := json.Unmarshal(data, &forms); err != nil {
+		return err
+	}
+	*m = forms
+	return nil
+}
+
+var pluralForms = map[string]plural.Form{
+	"zero":  plural.Zero,
+	"one":   plural.One,
+	"two":   plural.Two,
+	"few":   plural.Few,
+	"many":  plural.Many,
+	"other": plural.Other,
+}
+
+// Returns the canonical form of a locale, or the template locale if it is empty
+func (e *Engine) canonicalLocale(locale string) (string, error) {
+	if locale == "" {
+		locale = e.TemplateLocale
+	}
+	tag, err := language.Parse(locale)
+	if err != nil {
+		return "", fmt.Errorf("invalid locale '%s': %s", locale, err)
+	}
+	return tag.String(), nil
+}
+
+// Returns the locales tried for a locale, most specific first and ending with the
+// template locale. For example 'pt-BR' falls back to 'pt' and then 'en'.
+func (e *Engine) localeChain(locale string) []string {
+	var chain []string
+	if tag, err := language.Parse(locale); err == nil {
+		for ; !tag.IsRoot(); tag = tag.Parent() {
+			chain = append(chain, tag.String())
+		}
+	}
+	if fallback, err := e.canonicalLocale(""); err == nil && !slices.Contains(chain, fallback) {
+		chain = append(chain, fallback)
+	}
+	return chain
+}
+
+// Register the messages of a locale which templates translate using {{t "key"}},
+// replacing any messages previously registered for the locale. Messages are
+// formatted like fmt.Sprintf with numbers written the way the locale expects.
+func (e *Engine) RegisterMessages(locale string, messages map[string]Message) error {
+	locale, err := e.canonicalLocale(locale)
+	if err != nil {
+		return err
+	}
+	for key, m := range messages {
+		if len(m) == 0 {
+			return fmt.Errorf("message '%s' of locale '%s' is empty", key, locale)
+		}
+		for form := range m {
+			if _, known := pluralForms[form]; known {
+				continue
+			}
+			if _, err := strconv.Atoi(strings.TrimPrefix(form, "=")); err != nil || !strings.HasPrefix(form, "=") {
+				return fmt.Errorf("message '%s' of locale '%s' has an unknown plural form: %s", key, locale, form)
+			}
+		}
+	}
+	e.messageLock.Lock()
+	defer e.messageLock.Unlock()
+	e.templateMessages[locale] = messages
+	return nil
+}
+
+// Remove the messages of a locale registered with RegisterMessages
+func (e *Engine) UnregisterMessages(locale string) error {
+	locale, err := e.canonicalLocale(locale)
+	if err != nil {
+		return err
+	}
+	e.messageLock.Lock()
+	defer e.messageLock.Unlock()
+	if _, exists := e.templateMessages[locale]; !exists {
+		return fmt.Errorf("no messages exist for that locale: %s", locale)
+	}
+	delete(e.templateMessages, locale)
+	return nil
+}
+
+// Returns the registered messages of every locale, sorted by locale
+func (e *Engine) Messages() []MessageCatalog {
+	e.messageLock.RLock()
+	defer e.messageLock.RUnlock()
+	catalogs := make([]MessageCatalog, 0, len(e.templateMessages))
+	for locale, messages := range e.templateMessages {
+		catalogs = append(catalogs, MessageCatalog{Locale: locale, Messages: messages})
+	}
+	slices.SortFunc(catalogs, func(a, b MessageCatalog) int {
+		return strings.Compare(a.Locale, b.Locale)
+	})
+	return catalogs
+}
+
+// Find a message in the fallback chain of a locale, returning the locale it was found in
+func (e *Engine) lookupMessage(locale, key string) (Message, string, bool) {
+	e.messageLock.RLock()
+	defer e.messageLock.RUnlock()
+	for _, candidate := range e.localeChain(locale) {
+		if m, exists := e.templateMessages[candidate][key]; exists {
+			return m, candidate, true
+		}
+	}
+	return nil, "", false
+}
+
+// Select the plural form of a message for a count, exact counts take priority
+func selectPlural(tag language.Tag, forms map[string]string, count int) (string, bool) {
+	if text, exists := forms["="+strconv.Itoa(count)]; exists {
+		return text, true
+	}
+	n := max(count, -count)
+	form := plural.Cardinal.MatchPlural(tag, n, 0, 0, 0, 0)
+	for name, f := range pluralForms {
+		if f == form {
+			if text, exists := forms[name]; exists {
+				return text, true
+			}
+		}
+	}
+	text, exists := forms["other"]
+	return text, exists
+}
+
+// Convert a template argument to an integer count for plural selection
+func pluralCount(value any) (int, error) {
+	switch v := value.(type) {
+	case int:
+		return v, nil
+	case int8:
+		return int(v), nil
+	case int16:
+		return int(v), nil
+	case int32:
+		return int(v), nil
+	case int64:
+		return int(v), nil
+	case uint:
+		return int(v), nil
+	case uint8:
+		return int(v), nil
+	case uint16:
+		return int(v), nil
+	case uint32:
+		return int(v), nil
+	case uint64:
+		return int(v), nil
+	case float32:
+		return int(v), nil
+	case float64:
+		return int(v), nil
+	}
+	return 0, fmt.Errorf("cannot use %T as a count", value)
+}
+
+// Layout elements of month and day names, which are translated using messages
+// keyed by their English name (e.g. "March" or "Tue")
+var dateNames = []string{"January", "Jan", "Monday", "Mon"}
+
+// Returns the functions available to templates rendered for a locale:
+//
+//	{{locale}}                   The locale the template is rendered for
+//	{{t "key" args...}}          Translate a message, a plural message is selected by its first argument
+//	{{plural n "one" "item" "other" "items"}}
+//	                             Select the text of a plural form for a count
+//	{{number n}}                 Format a number, e.g. 1,234.5 or 1.234,5
+//	{{date time "2 January 2006"}}
+//	                             Format a time using a Go layout, month and day names are translated
+func (e *Engine) templateFuncs(locale string) map[string]any {
+	tag := language.Make(locale)
+	printer := message.NewPrinter(tag)
+	translate := func(key string) string {
+		if m, _, exists := e.lookupMessage(locale, key); exists && len(m) == 1 && m["other"] != "" {
+			return m["other"]
+		}
+		return key
+	}
+	return map[string]any{
+		"locale": func() string {
+			return locale
+		},
+		"t": func(key string, args ...any) (string, error) {
+			m, found, exists := e.lookupMessage(locale, key)
+			if !exists {
+				return "", fmt.Errorf("no message exists for '%s' in locale '%s'", key, locale)
+			}
+			text, exists := m["other"]
+			if len(args) > 0 && len(m) > 1 {
+				count, err := pluralCount(args[0])
+				if err != nil {
+					return "", fmt.Errorf("message '%s': %s", key, err)
+				}
+				text, exists = selectPlural(language.Make(found), m, count)
+			}
+			if !exists {
+				return "", fmt.Errorf("message '%s' of locale '%s' has no 'other' form", key, found)
+			}
+			if len(args) == 0 {
+				return text, nil
+			}
+			return printer.Sprintf(text, args...), nil
+		},
+		"plural": func(n any, forms ...string) (string, error) {
+			count, err := pluralCount(n)
+			if err != nil {
+				return "", err
+			}
+			if len(forms)%2 != 0 {
+				return "", fmt.Errorf("plural requires pairs of forms and text")
+			}
+			pairs := make(map[string]string, len(forms)/2)
+			for i := 0; i < len(forms); i += 2 {
+				pairs[forms[i]] = forms[i+1]
+			}
+			text, exists := selectPlural(tag, pairs, count)
+			if !exists {
+				return "", fmt.Errorf("plural has no 'other' form")
+			}
+			return text, nil
+		},
+		"number": func(n any) string {
+			return printer.Sprint(number.Decimal(n))
+		},
+		"date": func(t time.Time, layout string) string {
+			// Format Layout
+			// 	Names are cut out of the layout and translated separately, the
+			// 	longest name is tried first so 'January' is not read as 'Jan'
+			var output strings.Builder
+			for layout != "" {
+				index, name := len(layout), ""
+				for _, candidate := range dateNames {
+					i := strings.Index(layout, candidate)
+					if i != -1 && (i < index || (i == index && len(candidate) > len(name))) {
+						index, name = i, candidate
+					}
+				}
+				output.WriteString(t.Format(layout[:index]))
+				if name == "" {
+					break
+				}
+				output.WriteString(translate(t.Format(name)))
+				layout = layout[index+len(name):]
+			}
+			return output.String()
+		},
+	}
+}
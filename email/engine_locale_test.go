@@ -0,0 +1,63 @@
+package email
+
+import (
+	"slices"
+	"testing"
+
+	"golang.org/x/text/language"
+)
+
+func TestLocaleChain(t *testing.T) {
+	tests := []struct {
+		locale   string
+		fallback string
+		want     []string
+	}{
+		{locale: "pt-BR", fallback: "en", want: []string{"pt-BR", "pt", "en"}},
+		{locale: "pt", fallback: "en", want: []string{"pt", "en"}},
+		{locale: "en", fallback: "en", want: []string{"en"}},
+		{locale: "en-GB", fallback: "en", want: []string{"en-GB", "en-001", "en"}},
+		{locale: "zh-Hant-TW", fallback: "en", want: []string{"zh-Hant-TW", "zh-Hant", "en"}},
+		{locale: "de-CH", fallback: "de", want: []string{"de-CH", "de"}},
+		{locale: "", fallback: "en", want: []string{"en"}},
+		{locale: "not a locale", fallback: "en", want: []string{"en"}},
+	}
+	for _, tt := range tests {
+		e := New("example.org")
+		e.TemplateLocale = tt.fallback
+		if got := e.localeChain(tt.locale); !slices.Equal(got, tt.want) {
+			t.Errorf("localeChain(%q) = %q, want %q", tt.locale, got, tt.want)
+		}
+	}
+}
+
+func TestSelectPlural(t *testing.T) {
+	forms := map[string]string{"=0": "none", "one": "one", "few": "few", "many": "many", "other": "other"}
+	tests := []struct {
+		locale string
+		forms  map[string]string
+		count  int
+		want   string
+		found  bool
+	}{
+		{locale: "en", forms: forms, count: 0, want: "none", found: true},
+		{locale: "en", forms: forms, count: 1, want: "one", found: true},
+		{locale: "en", forms: forms, count: 2, want: "other", found: true},
+		{locale: "en", forms: forms, count: -1, want: "one", found: true},
+		{locale: "fr", forms: forms, count: 1, want: "one", found: true},
+		{locale: "pt", forms: map[string]string{"one": "one", "other": "other"}, count: 0, want: "one", found: true},
+		{locale: "pl", forms: forms, count: 3, want: "few", found: true},
+		{locale: "pl", forms: forms, count: 5, want: "many", found: true},
+		{locale: "pl", forms: forms, count: 22, want: "few", found: true},
+		{locale: "ru", forms: forms, count: 21, want: "one", found: true},
+		{locale: "ja", forms: forms, count: 1, want: "other", found: true},
+		{locale: "pl", forms: map[string]string{"one": "one", "other": "other"}, count: 3, want: "other", found: true},
+		{locale: "en", forms: map[string]string{"one": "one"}, count: 2, want: "", found: false},
+	}
+	for _, tt := range tests {
+		got, found := selectPlural(language.Make(tt.locale), tt.forms, tt.count)
+		if got != tt.want || found != tt.found {
+			t.Errorf("selectPlural(%s, %d) = %q, %t, want %q, %t", tt.locale, tt.count, got, found, tt.want, tt.found)
+		}
+	}
+}
@@ -2,11 +2,16 @@ package email
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"net/smtp"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/emersion/go-msgauth/dkim"
 	"github.com/jhillyerd/enmime"
@@ -18,7 +23,17 @@ func (e *Engine) UseOutgoing(handler HandlerMiddleware) {
 }
 
 // Queue an Outgoing Email, returns false if email was dropped for being full
+// or because the engine is shutting down. Emails without an ID are given one,
+// which is used in their Message-ID header and delivery events.
 func (e *Engine) QueueEmail(email *Email) bool {
+	e.outgoingLock.RLock()
+	defer e.outgoingLock.RUnlock()
+	if e.outgoingClosed {
+		return false
+	}
+	if email.ID == "" {
+		email.ID = rand.Text()
+	}
 	select {
 	case e.outgoingQueue <- email:
 		return true
@@ -34,6 +49,9 @@ func (e *Engine) SendEmail(email *Email) error {
 	if len(email.To) == 0 {
 		return fmt.Errorf("outbound email contains no recipients")
 	}
+	if email.ID == "" {
+		email.ID = rand.Text()
+	}
 
 	// Run Middleware
 	for _, mw := range e.outgoingMiddleware {
@@ -42,99 +60,251 @@ func (e *Engine) SendEmail(email *Email) error {
 		}
 	}
 
+	// Inline Stylesheets
+	// 	Many clients strip <style> blocks, so their rules are moved into style attributes
+	if err := e.inlineOutgoingCSS(email); err != nil {
+		return err
+	}
+
 	// Generate Unique Email for Each Recipient
 	// 	Because sending an email to 10 people probably isn't the
 	// 	behaviour you were hoping for
+	deliveryErrors := []error{}
 	for _, addressee := range email.To {
 
+		// Skip Suppressed Recipients
+		if entry, err := e.Suppressed(addressee.Address); err != nil {
+			return fmt.Errorf("cannot check suppression list: %s", err)
+		} else if entry != nil {
+			e.ErrorLogger(fmt.Errorf("outbound email to '%s' skipped, address is suppressed (%s)", addressee.Address, entry.Reason))
+			e.emitDeliveryEvent(email, addressee.Address, DeliverySuppressed, fmt.Sprint("Address is suppressed (", entry.Reason, ")"))
+			continue
+		}
+
 		// Create New Envelope for Recipient
-		var envelope bytes.Buffer
-		builder := enmime.Builder().
-			From(email.From.Name, email.From.Address).
-			To(addressee.Name, addressee.Address).
-			Subject(email.Subject)
-
-		// Append Content
-		if email.HTML {
-			builder = builder.HTML([]byte(email.Content))
+		// 	Forwarded emails keep their original MIME and signatures, their
+		// 	envelope sender was already rewritten using SRS
+		sender := email.From.Address
+		var complete []byte
+		if email.forward != nil {
+			sender, complete = email.forward.sender, email.forward.raw
 		} else {
-			builder = builder.Text([]byte(email.Content))
+			var err error
+			if complete, err = e.buildEnvelope(email, addressee); err != nil {
+				return err
+			}
 		}
 
-		// Append Attachments
-		for i := range email.Attachments {
-			a := &email.Attachments[i]
-			if a.Inline {
-				builder = builder.AddInline(a.Data, a.ContentType, a.Filename, a.Filename)
-			} else {
-				builder = builder.AddAttachment(a.Data, a.ContentType, a.Filename)
+		// Deliver Envelope
+		response, err := e.deliverEnvelope(email, sender, addressee.Address, complete)
+		if err != nil {
+			e.emitDeliveryEvent(email, addressee.Address, DeliveryBounced, response)
+			if isHardBounce(err) {
+				if err := e.Suppress(addressee.Address, SuppressionHardBounce); err != nil {
+					e.ErrorLogger(fmt.Errorf("cannot suppress hard bounced address '%s': %s", addressee.Address, err))
+				}
 			}
+			deliveryErrors = append(deliveryErrors, err)
+			continue
 		}
+		e.emitDeliveryEvent(email, addressee.Address, DeliveryDelivered, response)
+	}
+	return errors.Join(deliveryErrors...)
+}
+
+// Inline the stylesheets of an outbound HTML email if OutgoingInlineCSS is enabled,
+// forwarded emails are left as they are
+func (e *Engine) inlineOutgoingCSS(email *Email) error {
+	if !e.OutgoingInlineCSS || !email.HTML || email.forward != nil {
+		return nil
+	}
+	content, err := inlineCSS(email.Content)
+	if err != nil {
+		return fmt.Errorf("cannot inline css of outbound email: %s", err)
+	}
+	email.Content = content
+	return nil
+}
+
+// Build and sign the envelope of an email for a single recipient
+func (e *Engine) buildEnvelope(email *Email, addressee Address) ([]byte, error) {
+	var envelope bytes.Buffer
+	builder := enmime.Builder().
+		From(email.From.Name, email.From.Address).
+		To(addressee.Name, addressee.Address).
+		Subject(email.Subject)
+	if email.ID != "" {
+		builder = builder.Header("Message-ID", fmt.Sprintf("<%s@%s>", email.ID, e.Domain))
+	}
+	for _, cc := range email.Cc {
+		builder = builder.CC(cc.Name, cc.Address)
+	}
+	if email.ReplyTo != nil {
+		builder = builder.ReplyTo(email.ReplyTo.Name, email.ReplyTo.Address)
+	}
+	if email.InReplyTo != "" {
+		builder = builder.Header("In-Reply-To", email.InReplyTo)
+	}
+	if email.References != "" {
+		builder = builder.Header("References", email.References)
+	}
+	e.outgoingLock.RLock()
+	unsubscribe := e.outgoingUnsubscribe
+	e.outgoingLock.RUnlock()
+	if unsubscribe != "" {
+		builder = builder.Header("List-Unsubscribe", fmt.Sprintf("<mailto:%s?subject=unsubscribe>", unsubscribe))
+	}
 
-		// Build Envelope
-		if p, err := builder.Build(); err != nil {
-			return fmt.Errorf("cannot build outbound email: %s", err)
-		} else if err := p.Encode(&envelope); err != nil {
-			return fmt.Errorf("cannot encode outbound email: %s", err)
+	// Append Content
+	if email.HTML {
+		builder = builder.HTML([]byte(email.Content))
+		if email.Text != "" {
+			builder = builder.Text([]byte(email.Text))
 		}
+	} else {
+		builder = builder.Text([]byte(email.Content))
+	}
 
-		// Sign Envelope
-		var complete bytes.Buffer
-		if e.outgoingDKIMSigner != nil {
-			// Sign Email using DKIM Key
-			if err := dkim.Sign(&complete, &envelope, &dkim.SignOptions{
-				Domain:   e.Domain,
-				Signer:   e.outgoingDKIMSigner,
-				Selector: e.OutgoingSelectorName,
-			}); err != nil {
-				return fmt.Errorf("cannot sign outbound email: %s", err)
-			}
+	// Append Attachments
+	for i := range email.Attachments {
+		a := &email.Attachments[i]
+		if a.Inline {
+			builder = builder.AddInline(a.Data, a.ContentType, a.Filename, a.Filename)
 		} else {
-			// inb4 marked as spam or rejected
-			complete = envelope
+			builder = builder.AddAttachment(a.Data, a.ContentType, a.Filename)
 		}
+	}
 
-		// Lookup MX Records for Provided Addressee
-		host, err := extractHostFromAddress(addressee.Address)
-		if err != nil {
-			return err
+	// Build Envelope
+	if p, err := builder.Build(); err != nil {
+		return nil, fmt.Errorf("cannot build outbound email: %s", err)
+	} else if err := p.Encode(&envelope); err != nil {
+		return nil, fmt.Errorf("cannot encode outbound email: %s", err)
+	}
+
+	// Sign Envelope
+	var complete bytes.Buffer
+	if e.outgoingDKIMSigner != nil {
+		// Sign Email using DKIM Key
+		if err := dkim.Sign(&complete, &envelope, &dkim.SignOptions{
+			Domain:   e.Domain,
+			Signer:   e.outgoingDKIMSigner,
+			Selector: e.OutgoingSelectorName,
+		}); err != nil {
+			return nil, fmt.Errorf("cannot sign outbound email: %s", err)
+		}
+	} else {
+		// inb4 marked as spam or rejected
+		complete = envelope
+	}
+	return complete.Bytes(), nil
+}
+
+// Deliver a signed envelope to the mail servers of a single recipient, returning
+// the reply of the server which accepted it or the last error which occurred.
+// Failed attempts which are followed by another are reported as deferred.
+func (e *Engine) deliverEnvelope(email *Email, sender, recipient string, envelope []byte) (string, error) {
+
+	// Lookup MX Records for Provided Addressee
+	host, err := extractHostFromAddress(recipient)
+	if err != nil {
+		return err.Error(), err
+	}
+	records, err := e.Resolver.LookupMX(context.Background(), host)
+	if err != nil {
+		if e, ok := err.(*net.DNSError); ok && e.IsNotFound {
+			err = fmt.Errorf("no mx records for outbound host '%s'", host)
+		} else {
+			err = fmt.Errorf("cannot lookup mx records for outbound host '%s': %s", host, err)
 		}
-		records, err := net.LookupMX(host)
+		return err.Error(), err
+	}
+	sort.Slice(records, func(i, j int) bool {
+		// These should already be sorted, but we sort them ourselves jic
+		return records[i].Pref < records[j].Pref
+	})
+
+	// Attempt to Deliver Envelope
+	//	Each attempt may take up to 10 seconds to connect, we additionally
+	// 	want to cycle through as many available servers as possible
+	attemptErrors := []string{}
+	attemptTotal := max(int(e.OutgoingTimeout.Seconds()/10), 1)
+	var lastErr error
+	for i := 0; i < attemptTotal; i++ {
+		if lastErr != nil {
+			e.emitDeliveryEvent(email, recipient, DeliveryDeferred, lastErr.Error())
+		}
+		host := records[i%len(records)].Host
+		reply, err := e.sendMail(net.JoinHostPort(host, e.outgoingPort), sender, recipient, envelope)
 		if err != nil {
-			if e, ok := err.(*net.DNSError); ok && e.IsNotFound {
-				return fmt.Errorf("no mx records for outbound host '%s'", host)
-			} else {
-				return fmt.Errorf("cannot lookup mx records for outbound host '%s': %s", host, err)
+			if isHardBounce(err) {
+				// Other servers will give us the same answer, don't bother asking
+				return err.Error(), fmt.Errorf("email delivery to '%s' rejected: %w", recipient, err)
 			}
+			message := fmt.Sprintf("attempt %d/%d failed: %s", i+1, attemptTotal, err.Error())
+			attemptErrors = append(attemptErrors, message)
+			lastErr = err
+			continue
 		}
-		sort.Slice(records, func(i, j int) bool {
-			// These should already be sorted, but we sort them ourselves jic
-			return records[i].Pref < records[j].Pref
-		})
-
-		// Attempt to Deliver Envelope
-		//	The smtp.SendEmail function has an internal timeout of 10 seconds (lame)
-		// 	We additionally want to cycle through as many available servers as possible
-		attemptErrors := []string{}
-		attemptTotal := max(int(e.OutgoingTimeout.Seconds()/10), 1)
-		for i := 0; i < attemptTotal; i++ {
-			host := records[i%len(records)].Host
-			if err := smtp.SendMail(
-				fmt.Sprint(host, ":", 25),
-				nil, // anonymous
-				email.From.Address,
-				[]string{addressee.Address},
-				complete.Bytes(),
-			); err != nil {
-				message := fmt.Sprintf("attempt %d/%d failed: %s", i+1, attemptTotal, err.Error())
-				attemptErrors = append(attemptErrors, message)
-				continue
-			}
-			return nil
+		return reply, nil
+	}
+	return lastErr.Error(), fmt.Errorf("email delivery failed:\n %s", strings.Join(attemptErrors, "\n"))
+}
+
+// Send an envelope to a single server like smtp.SendMail, returning the reply
+// to the message (e.g. "250 2.0.0 Ok: queued as 12345") which it discards
+func (e *Engine) sendMail(addr, sender, recipient string, envelope []byte) (string, error) {
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return "", err
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return "", err
+	}
+	defer c.Close()
+	if err := c.Hello(e.Domain); err != nil {
+		return "", err
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return "", err
 		}
-		return fmt.Errorf("email delivery failed:\n %s", strings.Join(attemptErrors, "\n"))
 	}
-	return nil
+	if err := c.Mail(sender); err != nil {
+		return "", err
+	}
+	if err := c.Rcpt(recipient); err != nil {
+		return "", err
+	}
+
+	// Write Message
+	// 	Performed by hand as the writer returned by c.Data() hides the reply
+	id, err := c.Text.Cmd("DATA")
+	if err != nil {
+		return "", err
+	}
+	c.Text.StartResponse(id)
+	_, _, err = c.Text.ReadResponse(354)
+	c.Text.EndResponse(id)
+	if err != nil {
+		return "", err
+	}
+	w := c.Text.DotWriter()
+	if _, err := w.Write(envelope); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	code, message, err := c.Text.ReadResponse(250)
+	if err != nil {
+		return "", err
+	}
+	c.Quit()
+	return fmt.Sprint(code, " ", message), nil
 }
 
 // Extracts the Host from an Email Address (e.g. bakonpancakz@gmail.com => gmail.com)
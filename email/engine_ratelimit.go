@@ -0,0 +1,198 @@
+package email
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// A snapshot of the incoming rate limiter
+type RateLimitStats struct {
+	Connections         map[string]int `json:"connections"`          // Open connections per client address
+	RejectedConnections uint64         `json:"rejected_connections"` // Connections refused for exceeding IncomingMaxConnections
+	RejectedRate        uint64         `json:"rejected_rate"`        // Connections refused for exceeding IncomingMaxConnectionRate
+	RejectedMessages    uint64         `json:"rejected_messages"`    // Emails refused for exceeding IncomingMaxSenderRate
+}
+
+// Counts events per key within fixed one minute windows
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+// Tracks open connections per address, new connections per network and
+// emails per sender for the incoming SMTP server
+type rateLimiter struct {
+	mu                  sync.Mutex
+	connections         map[string]int
+	windows             map[string]*rateWindow
+	nextPrune           time.Time
+	rejectedConnections atomic.Uint64
+	rejectedRate        atomic.Uint64
+	rejectedMessages    atomic.Uint64
+}
+
+// Increment the counter of a key within the current window, returns false
+// without counting if the limit was already reached
+func (l *rateLimiter) hit(key string, limit int, now time.Time) bool {
+	if l.windows == nil {
+		l.windows = make(map[string]*rateWindow)
+	}
+	if now.After(l.nextPrune) {
+		for k, w := range l.windows {
+			if now.Sub(w.start) >= time.Minute {
+				delete(l.windows, k)
+			}
+		}
+		l.nextPrune = now.Add(time.Minute)
+	}
+	w, ok := l.windows[key]
+	if !ok || now.Sub(w.start) >= time.Minute {
+		w = &rateWindow{start: now}
+		l.windows[key] = w
+	}
+	if w.count >= limit {
+		return false
+	}
+	w.count++
+	return true
+}
+
+// Returns the reason a new connection from an address should be refused, or
+// an empty string after counting it as open
+func (e *Engine) acquireConnection(ip net.IP) string {
+	l := &e.limiter
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.connections == nil {
+		l.connections = make(map[string]int)
+	}
+	addr := ip.String()
+	if e.IncomingMaxConnections > 0 && l.connections[addr] >= e.IncomingMaxConnections {
+		l.rejectedConnections.Add(1)
+		return "Too many connections from your address"
+	}
+	if e.IncomingMaxConnectionRate > 0 && !l.hit("connect "+clientNetwork(ip), e.IncomingMaxConnectionRate, time.Now()) {
+		l.rejectedRate.Add(1)
+		return "Too many connections from your network"
+	}
+	l.connections[addr]++
+	return ""
+}
+
+// Count a connection from an address as closed
+func (e *Engine) releaseConnection(ip net.IP) {
+	l := &e.limiter
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	addr := ip.String()
+	if l.connections[addr]--; l.connections[addr] <= 0 {
+		delete(l.connections, addr)
+	}
+}
+
+// Count an email from a sender, returning a 421 reply if the sender exceeded
+// IncomingMaxSenderRate. Bounces have no sender so are counted per client network.
+func (e *Engine) checkSenderRate(s *Session, sender string) error {
+	if e.IncomingMaxSenderRate <= 0 {
+		return nil
+	}
+	key := "sender " + strings.ToLower(sender)
+	if sender == "" {
+		if ip := s.RemoteIP(); ip != nil {
+			key = "bounce " + clientNetwork(ip)
+		}
+	}
+	l := &e.limiter
+	l.mu.Lock()
+	ok := l.hit(key, e.IncomingMaxSenderRate, time.Now())
+	l.mu.Unlock()
+	if !ok {
+		l.rejectedMessages.Add(1)
+		return &smtp.SMTPError{
+			Code:         421,
+			EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+			Message:      "Too many emails from sender, please try again later",
+		}
+	}
+	return nil
+}
+
+// Returns a snapshot of the incoming rate limiter
+func (e *Engine) RateLimitStats() RateLimitStats {
+	l := &e.limiter
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	stats := RateLimitStats{
+		Connections:         make(map[string]int, len(l.connections)),
+		RejectedConnections: l.rejectedConnections.Load(),
+		RejectedRate:        l.rejectedRate.Load(),
+		RejectedMessages:    l.rejectedMessages.Load(),
+	}
+	for addr, count := range l.connections {
+		stats.Connections[addr] = count
+	}
+	return stats
+}
+
+// Listener which enforces connection limits before the SMTP greeting is sent
+type limitedListener struct {
+	net.Listener
+	engine      *Engine
+	implicitTLS bool // Clients expect a TLS handshake, so they are disconnected without a reply
+}
+
+// Wrap a listener so clients over the connection limits receive a 421 reply
+func (e *Engine) limitListener(l net.Listener, implicitTLS bool) net.Listener {
+	return &limitedListener{Listener: l, engine: e, implicitTLS: implicitTLS}
+}
+
+func (l *limitedListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		addr, ok := c.RemoteAddr().(*net.TCPAddr)
+		if !ok {
+			return &limitedConn{Conn: c, engine: l.engine}, nil
+		}
+		if reason := l.engine.acquireConnection(addr.IP); reason != "" {
+			// Reply in the Background
+			// 	A slow client must not hold up the connections queued behind it
+			go func() {
+				if !l.implicitTLS {
+					c.SetWriteDeadline(time.Now().Add(5 * time.Second))
+					fmt.Fprintf(c, "421 4.7.0 %s %s\r\n", l.engine.Domain, reason)
+				}
+				c.Close()
+			}()
+			continue
+		}
+		return &limitedConn{Conn: c, engine: l.engine, ip: addr.IP}, nil
+	}
+}
+
+// Connection which is counted as closed once, it also keeps the result of the
+// connect checks as STARTTLS creates a new session on the same connection
+type limitedConn struct {
+	net.Conn
+	engine   *Engine
+	ip       net.IP // Counted client address, nil if the connection is not counted
+	once     sync.Once
+	checked  bool             // Connect checks were run for the first session
+	listed   *BlocklistResult // Blocklist result of the connect checks
+	rejected error            // Reply of the connect checks, nil if accepted
+}
+
+func (c *limitedConn) Close() error {
+	if c.ip != nil {
+		c.once.Do(func() { c.engine.releaseConnection(c.ip) })
+	}
+	return c.Conn.Close()
+}
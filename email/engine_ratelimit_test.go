@@ -0,0 +1,121 @@
+package email
+
+import (
+	"errors"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestRateLimiterHit(t *testing.T) {
+	start := time.Now()
+	l := &rateLimiter{}
+	for i := range 3 {
+		if !l.hit("a", 3, start.Add(time.Duration(i)*time.Second)) {
+			t.Fatalf("hit %d refused, want it counted", i+1)
+		}
+	}
+	if l.hit("a", 3, start.Add(59*time.Second)) {
+		t.Error("hit over the limit counted")
+	}
+	if !l.hit("b", 3, start.Add(59*time.Second)) {
+		t.Error("hit of another key refused")
+	}
+	if !l.hit("a", 3, start.Add(time.Minute)) {
+		t.Error("hit in the next window refused")
+	}
+}
+
+// Open a connection to a server started with testServe and read its greeting
+func testGreeting(t *testing.T, addr string) (*textproto.Conn, int, string) {
+	t.Helper()
+	c, err := textproto.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	code, message, _ := c.ReadResponse(220)
+	return c, code, message
+}
+
+func TestMaxConnections(t *testing.T) {
+	e := New("example.org")
+	e.IncomingMaxConnections = 2
+	e.IncomingMaxConnectionRate = 0
+	addr := testServe(t, &e, false, nil)
+
+	first, _, _ := testGreeting(t, addr)
+	testGreeting(t, addr)
+	if _, code, message := testGreeting(t, addr); code != 421 || message != "4.7.0 example.org Too many connections from your address" {
+		t.Fatalf("greeting over the limit = %d %s, want a 421 reply", code, message)
+	}
+	stats := e.RateLimitStats()
+	if stats.Connections["127.0.0.1"] != 2 || stats.RejectedConnections != 1 || stats.RejectedRate != 0 {
+		t.Errorf("RateLimitStats() = %+v, want 2 open and 1 rejected connection", stats)
+	}
+
+	// Close Connection
+	// 	The server notices once it reads from the closed connection
+	first.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for e.RateLimitStats().Connections["127.0.0.1"] != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("closed connection was never released")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, code, message := testGreeting(t, addr); code != 220 {
+		t.Errorf("greeting after a connection closed = %d %s, want 220", code, message)
+	}
+}
+
+func TestMaxConnectionRate(t *testing.T) {
+	e := New("example.org")
+	e.IncomingMaxConnections = 0
+	e.IncomingMaxConnectionRate = 2
+	addr := testServe(t, &e, false, nil)
+
+	for range 2 {
+		c, code, message := testGreeting(t, addr)
+		if code != 220 {
+			t.Fatalf("greeting within the rate = %d %s, want 220", code, message)
+		}
+		c.Close()
+	}
+	if _, code, message := testGreeting(t, addr); code != 421 || message != "4.7.0 example.org Too many connections from your network" {
+		t.Fatalf("greeting over the rate = %d %s, want a 421 reply", code, message)
+	}
+	if stats := e.RateLimitStats(); stats.RejectedRate != 1 || stats.RejectedConnections != 0 {
+		t.Errorf("RateLimitStats() = %+v, want 1 connection rejected for its rate", stats)
+	}
+}
+
+func TestMaxSenderRate(t *testing.T) {
+	e := New("example.org")
+	e.IncomingValidateSPF = false
+	e.IncomingMaxSenderRate = 1
+	addr := testServe(t, &e, false, nil)
+
+	c := testDial(t, addr, false)
+	if err := c.Mail("alice@example.net", nil); err != nil {
+		t.Fatalf("first email = %s, want it accepted", err)
+	}
+	if err := c.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	var smtpErr *smtp.SMTPError
+	if err := c.Mail("Alice@Example.net", nil); !errors.As(err, &smtpErr) || smtpErr.Code != 421 {
+		t.Fatalf("second email = %v, want a 421 reply", err)
+	}
+	if err := c.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Mail("bob@example.net", nil); err != nil {
+		t.Errorf("email of another sender = %s, want it accepted", err)
+	}
+	if stats := e.RateLimitStats(); stats.RejectedMessages != 1 {
+		t.Errorf("RateLimitStats() = %+v, want 1 rejected email", stats)
+	}
+}
@@ -0,0 +1,54 @@
+package email
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/emersion/go-smtp"
+)
+
+// An SMTP reply returned by middleware or inbox handlers to reject an incoming email.
+// Any other error returned by a handler is treated as a temporary failure.
+type Rejection struct {
+	Code         int    // SMTP Reply Code (e.g. 550)
+	EnhancedCode [3]int // Enhanced Status Code (e.g. {5, 7, 1})
+	Message      string // Reason sent to the client
+}
+
+func (r *Rejection) Error() string {
+	return fmt.Sprintf("%d %d.%d.%d %s", r.Code, r.EnhancedCode[0], r.EnhancedCode[1], r.EnhancedCode[2], r.Message)
+}
+
+// Returns true if the client is expected to retry later (4xx)
+func (r *Rejection) Temporary() bool {
+	return r.Code >= 400 && r.Code < 500
+}
+
+// Permanently reject an email for policy reasons (550 5.7.1)
+func Reject(message string) *Rejection {
+	return &Rejection{Code: 550, EnhancedCode: [3]int{5, 7, 1}, Message: message}
+}
+
+// Temporarily reject an email, asking the client to retry later (451 4.3.0)
+func TempFail(message string) *Rejection {
+	return &Rejection{Code: 451, EnhancedCode: [3]int{4, 3, 0}, Message: message}
+}
+
+// Convert an error returned by a handler into an SMTP reply, errors which are
+// not a Rejection are logged and answered with a temporary failure
+func (e *Engine) smtpReply(source string, err error) error {
+	var r *Rejection
+	if errors.As(err, &r) {
+		return &smtp.SMTPError{
+			Code:         r.Code,
+			EnhancedCode: smtp.EnhancedCode(r.EnhancedCode),
+			Message:      r.Message,
+		}
+	}
+	e.ErrorLogger(fmt.Errorf("%s encountered an error: %s", source, err))
+	return &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+		Message:      "Temporary local error, please try again later",
+	}
+}
@@ -0,0 +1,273 @@
+package email
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Inbox registered for an exact address
+type inboxEntry struct {
+	handler HandlerEmail
+	webhook string   // Set for inboxes backed by a webhook
+	alias   string   // Set for aliases, the username emails are delivered to
+	forward []string // Set for inboxes forwarding to external addresses
+}
+
+// Inbox matching a pattern against the local part of an address
+type inboxRule struct {
+	glob    string         // Set for glob patterns
+	regex   *regexp.Regexp // Set for regular expressions
+	handler HandlerEmail
+}
+
+// Register an Inbox to Handle Incoming Emails, inboxes may be registered and
+// unregistered at any time
+func (e *Engine) RegisterInbox(username string, handler HandlerEmail) error {
+	return e.registerInbox(username, inboxEntry{handler: handler})
+}
+
+func (e *Engine) registerInbox(username string, entry inboxEntry) error {
+	address := strings.ToLower(fmt.Sprint(username, "@", e.Domain))
+	e.inboxLock.Lock()
+	defer e.inboxLock.Unlock()
+	if _, exists := e.inboxes[address]; exists {
+		return fmt.Errorf("an inbox already exists with that username: %s", address)
+	}
+	e.inboxes[address] = entry
+	return nil
+}
+
+// Register several Inboxes at once, either all of them are registered or none are.
+// On conflict the index of the first username which already exists is returned.
+func (e *Engine) registerInboxes(usernames []string, entries []inboxEntry) (int, error) {
+	addresses := make([]string, len(usernames))
+	e.inboxLock.Lock()
+	defer e.inboxLock.Unlock()
+	for i, username := range usernames {
+		addresses[i] = strings.ToLower(fmt.Sprint(username, "@", e.Domain))
+		if _, exists := e.inboxes[addresses[i]]; exists || slices.Contains(addresses[:i], addresses[i]) {
+			return i, fmt.Errorf("an inbox already exists with that username: %s", addresses[i])
+		}
+	}
+	for i, address := range addresses {
+		e.inboxes[address] = entries[i]
+	}
+	return -1, nil
+}
+
+// Remove an Inbox registered with RegisterInbox or RegisterWebhookInbox,
+// emails which are already being delivered to it are unaffected
+func (e *Engine) UnregisterInbox(username string) error {
+	address := strings.ToLower(fmt.Sprint(username, "@", e.Domain))
+	e.inboxLock.Lock()
+	defer e.inboxLock.Unlock()
+	if _, exists := e.inboxes[address]; !exists {
+		return fmt.Errorf("no inbox exists with that username: %s", address)
+	}
+	delete(e.inboxes, address)
+	return nil
+}
+
+// Returns the Inboxes registered with RegisterInbox or RegisterWebhookInbox, sorted by username
+func (e *Engine) Inboxes() []Inbox {
+	e.inboxLock.RLock()
+	defer e.inboxLock.RUnlock()
+	inboxes := make([]Inbox, 0, len(e.inboxes))
+	for address, entry := range e.inboxes {
+		username, _, _ := cutAddress(address)
+		inboxes = append(inboxes, entry.info(username))
+	}
+	slices.SortFunc(inboxes, func(a, b Inbox) int {
+		return strings.Compare(a.Username, b.Username)
+	})
+	return inboxes
+}
+
+// Returns the Inbox registered for a username, nil if it does not exist
+func (e *Engine) lookupRegisteredInbox(username string) *Inbox {
+	address := strings.ToLower(fmt.Sprint(username, "@", e.Domain))
+	e.inboxLock.RLock()
+	defer e.inboxLock.RUnlock()
+	if entry, exists := e.inboxes[address]; exists {
+		username, _, _ := cutAddress(address)
+		info := entry.info(username)
+		return &info
+	}
+	return nil
+}
+
+// Register an Inbox for usernames matching a glob pattern (e.g. "*-alerts"), using
+// the syntax of path.Match. Patterns are tried in the order they were registered.
+func (e *Engine) RegisterInboxPattern(pattern string, handler HandlerEmail) error {
+	pattern = strings.ToLower(pattern)
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid inbox pattern '%s': %s", pattern, err)
+	}
+	e.inboxLock.Lock()
+	defer e.inboxLock.Unlock()
+	for _, rule := range e.inboxRules {
+		if rule.regex == nil && rule.glob == pattern {
+			return fmt.Errorf("an inbox already exists with that pattern: %s", pattern)
+		}
+	}
+	e.inboxRules = append(e.inboxRules, inboxRule{glob: pattern, handler: handler})
+	return nil
+}
+
+// Register an Inbox for usernames matching a regular expression, usernames are
+// lowercase so expressions should be too. Expressions are tried in the order they
+// were registered, after all glob patterns.
+func (e *Engine) RegisterInboxRegexp(expr *regexp.Regexp, handler HandlerEmail) error {
+	e.inboxLock.Lock()
+	defer e.inboxLock.Unlock()
+	for _, rule := range e.inboxRules {
+		if rule.regex != nil && rule.regex.String() == expr.String() {
+			return fmt.Errorf("an inbox already exists with that expression: %s", expr)
+		}
+	}
+	e.inboxRules = append(e.inboxRules, inboxRule{regex: expr, handler: handler})
+	return nil
+}
+
+// Register an Inbox for every address of the engine domain which is not matched by
+// any other inbox. Unlike the NoInboxHandler, addresses of other domains are not included.
+func (e *Engine) RegisterCatchAll(handler HandlerEmail) error {
+	e.inboxLock.Lock()
+	defer e.inboxLock.Unlock()
+	if e.inboxCatchAll != nil {
+		return fmt.Errorf("a catch-all inbox already exists")
+	}
+	e.inboxCatchAll = handler
+	return nil
+}
+
+// Remove an Inbox registered with RegisterInboxPattern
+func (e *Engine) UnregisterInboxPattern(pattern string) error {
+	pattern = strings.ToLower(pattern)
+	return e.unregisterInboxRule(pattern, func(rule inboxRule) bool {
+		return rule.regex == nil && rule.glob == pattern
+	})
+}
+
+// Remove an Inbox registered with RegisterInboxRegexp
+func (e *Engine) UnregisterInboxRegexp(expr *regexp.Regexp) error {
+	return e.unregisterInboxRule(expr.String(), func(rule inboxRule) bool {
+		return rule.regex != nil && rule.regex.String() == expr.String()
+	})
+}
+
+func (e *Engine) unregisterInboxRule(name string, match func(rule inboxRule) bool) error {
+	e.inboxLock.Lock()
+	defer e.inboxLock.Unlock()
+	i := slices.IndexFunc(e.inboxRules, match)
+	if i < 0 {
+		return fmt.Errorf("no inbox exists with that pattern: %s", name)
+	}
+	e.inboxRules = slices.Delete(e.inboxRules, i, i+1)
+	return nil
+}
+
+// Remove the Inbox registered with RegisterCatchAll
+func (e *Engine) UnregisterCatchAll() {
+	e.inboxLock.Lock()
+	defer e.inboxLock.Unlock()
+	e.inboxCatchAll = nil
+}
+
+// Returns the Inbox Handler for an address or nil if no inbox exists, along with the
+// recipient details given to it. Inboxes are matched in the following order:
+//
+//  1. Inboxes registered with RegisterInbox, for the full username
+//  2. Inboxes registered with RegisterInbox, for the username without its tag (e.g. "support+ticket123" => "support")
+//  3. Glob patterns registered with RegisterInboxPattern, for the username without its tag
+//  4. Regular expressions registered with RegisterInboxRegexp, for the username without its tag
+//  5. The inbox registered with RegisterCatchAll
+func (e *Engine) lookupInbox(original string) (HandlerEmail, *Recipient) {
+	address := strings.ToLower(original)
+	username, domain, ok := cutAddress(address)
+	recipient := &Recipient{Address: address, Inbox: username}
+	e.inboxLock.RLock()
+	defer e.inboxLock.RUnlock()
+
+	// Match Exact Address
+	if entry, exists := e.inboxes[address]; exists {
+		return e.resolveInbox(entry, domain, recipient)
+	}
+	if !ok || domain != strings.ToLower(e.Domain) {
+		return nil, nil
+	}
+
+	// Match Rewritten Sender
+	// 	Bounces of forwarded emails are sent back to the original sender
+	if sender, ok := e.srsReverse(original, time.Now()); ok {
+		recipient.Inbox = ""
+		return e.forwardHandler([]string{sender}), recipient
+	}
+
+	// Match Sub-Address
+	if e.IncomingTagSeparator != "" {
+		if base, _, found := strings.Cut(username, e.IncomingTagSeparator); found {
+			// Tags keep their case as they may be identifiers
+			local, _, _ := cutAddress(original)
+			_, recipient.Tag, _ = strings.Cut(local, e.IncomingTagSeparator)
+			recipient.Inbox = base
+			if entry, exists := e.inboxes[base+"@"+domain]; exists {
+				return e.resolveInbox(entry, domain, recipient)
+			}
+		}
+	}
+
+	// Match Patterns
+	for _, rule := range e.inboxRules {
+		if rule.regex == nil {
+			if matched, _ := path.Match(rule.glob, recipient.Inbox); matched {
+				return rule.handler, recipient
+			}
+		}
+	}
+	for _, rule := range e.inboxRules {
+		if rule.regex != nil && rule.regex.MatchString(recipient.Inbox) {
+			return rule.handler, recipient
+		}
+	}
+	if e.inboxCatchAll != nil {
+		return e.inboxCatchAll, recipient
+	}
+	return nil, nil
+}
+
+// Returns the handler of an inbox, following aliases to the inbox they point to
+func (e *Engine) resolveInbox(entry inboxEntry, domain string, recipient *Recipient) (HandlerEmail, *Recipient) {
+	if entry.alias == "" {
+		return entry.handler, recipient
+	}
+	target, exists := e.inboxes[entry.alias+"@"+domain]
+	if !exists || target.alias != "" {
+		return nil, nil
+	}
+	recipient.Inbox = entry.alias
+	return target.handler, recipient
+}
+
+// Describe an inbox for listing
+func (entry inboxEntry) info(username string) Inbox {
+	return Inbox{
+		Username: username,
+		Webhook:  entry.webhook,
+		Alias:    entry.alias,
+		Forward:  entry.forward,
+	}
+}
+
+// Split an address into its local part and domain at the last '@'
+func cutAddress(address string) (local, domain string, ok bool) {
+	i := strings.LastIndex(address, "@")
+	if i < 0 {
+		return address, "", false
+	}
+	return address[:i], address[i+1:], true
+}
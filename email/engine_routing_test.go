@@ -0,0 +1,283 @@
+package email
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Returns an Inbox Handler which fails with its name, so tests can tell handlers apart
+func testNamedHandler(name string) HandlerEmail {
+	return func(email *Email) error {
+		return errors.New(name)
+	}
+}
+
+func TestLookupInbox(t *testing.T) {
+	e := New("example.org")
+	e.SRSSecret = "secret"
+	e.ErrorLogger = func(err error) {}
+	if err := e.RegisterInbox("support", testNamedHandler("support")); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.RegisterInbox("sales+eu", testNamedHandler("sales+eu")); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.RegisterAlias("help", "support"); err != nil {
+		t.Fatal(err)
+	}
+	// Regular expressions are registered first to show glob patterns still win
+	if err := e.RegisterInboxRegexp(regexp.MustCompile(`^alert-.*$`), testNamedHandler("regexp alert")); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.RegisterInboxRegexp(regexp.MustCompile(`^ticket-[0-9]+$`), testNamedHandler("regexp ticket")); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.RegisterInboxPattern("alert-*", testNamedHandler("glob alert")); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.RegisterInboxPattern("support*", testNamedHandler("glob support")); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.RegisterCatchAll(testNamedHandler("catch-all")); err != nil {
+		t.Fatal(err)
+	}
+	bounce := e.srsForward("user@example.net", time.Now())
+
+	tests := []struct {
+		address   string
+		handler   string // Name of the matched handler, "forward" for SRS bounces and empty for none
+		recipient *Recipient
+	}{
+		{"support@example.org", "support", &Recipient{Address: "support@example.org", Inbox: "support"}},
+		{"Support@Example.ORG", "support", &Recipient{Address: "support@example.org", Inbox: "support"}},
+		{"help@example.org", "support", &Recipient{Address: "help@example.org", Inbox: "support"}},
+		{"sales+eu@example.org", "sales+eu", &Recipient{Address: "sales+eu@example.org", Inbox: "sales+eu"}},
+		{"support+Ticket123@example.org", "support", &Recipient{Address: "support+ticket123@example.org", Inbox: "support", Tag: "Ticket123"}},
+		{"supportdesk@example.org", "glob support", &Recipient{Address: "supportdesk@example.org", Inbox: "supportdesk"}},
+		{"alert-disk@example.org", "glob alert", &Recipient{Address: "alert-disk@example.org", Inbox: "alert-disk"}},
+		{"alert-disk+Host1@example.org", "glob alert", &Recipient{Address: "alert-disk+host1@example.org", Inbox: "alert-disk", Tag: "Host1"}},
+		{"ticket-42@example.org", "regexp ticket", &Recipient{Address: "ticket-42@example.org", Inbox: "ticket-42"}},
+		{"ticket-abc@example.org", "catch-all", &Recipient{Address: "ticket-abc@example.org", Inbox: "ticket-abc"}},
+		{"nobody+Tag@example.org", "catch-all", &Recipient{Address: "nobody+tag@example.org", Inbox: "nobody", Tag: "Tag"}},
+		{bounce, "forward", &Recipient{Address: strings.ToLower(bounce)}},
+		{"support@example.net", "", nil},
+		{"support", "", nil},
+	}
+	for _, tt := range tests {
+		handler, recipient := e.lookupInbox(tt.address)
+		if tt.handler == "" {
+			if handler != nil || recipient != nil {
+				t.Errorf("lookupInbox(%q) = %v, want no inbox", tt.address, recipient)
+			}
+			continue
+		}
+		if handler == nil {
+			t.Errorf("lookupInbox(%q) found no inbox, want %s", tt.address, tt.handler)
+			continue
+		}
+		if tt.handler != "forward" {
+			if name := handler(&Email{}).Error(); name != tt.handler {
+				t.Errorf("lookupInbox(%q) handler = %s, want %s", tt.address, name, tt.handler)
+			}
+		}
+		if *recipient != *tt.recipient {
+			t.Errorf("lookupInbox(%q) recipient = %+v, want %+v", tt.address, *recipient, *tt.recipient)
+		}
+	}
+
+	// Without Catch-All
+	e.UnregisterCatchAll()
+	if handler, _ := e.lookupInbox("nobody@example.org"); handler != nil {
+		t.Errorf("lookupInbox() after UnregisterCatchAll() found an inbox, want none")
+	}
+
+	// Without Sub-Addressing
+	e.IncomingTagSeparator = ""
+	handler, recipient := e.lookupInbox("support+Ticket123@example.org")
+	if handler == nil || handler(&Email{}).Error() != "glob support" || recipient.Tag != "" {
+		t.Errorf("lookupInbox() without a tag separator = %+v, want the glob to match the full username", recipient)
+	}
+}
+
+func TestRcptUnknownInbox(t *testing.T) {
+	e := New("example.org")
+	e.IncomingValidateSPF = false
+	if err := e.RegisterInbox("known", func(email *Email) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	addr := testServe(t, &e, false, nil)
+
+	c := testDial(t, addr, false)
+	if err := c.Mail("sender@example.net", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("known@example.org", nil); err != nil {
+		t.Errorf("RCPT for a known inbox = %s, want nil", err)
+	}
+	var smtpErr *smtp.SMTPError
+	err := c.Rcpt("unknown@example.org", nil)
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 550 || smtpErr.EnhancedCode != (smtp.EnhancedCode{5, 1, 1}) {
+		t.Errorf("RCPT for an unknown inbox = %v, want 550 5.1.1", err)
+	}
+	err = c.Rcpt("known@example.net", nil)
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 550 {
+		t.Errorf("RCPT for another domain = %v, want 550", err)
+	}
+
+	// Unknown Recipients are accepted once a NoInboxHandler exists
+	e.NoInboxHandler = func(email *Email) error { return nil }
+	if err := c.Rcpt("unknown@example.org", nil); err != nil {
+		t.Errorf("RCPT for an unknown inbox with a NoInboxHandler = %s, want nil", err)
+	}
+}
+
+// Send a plain email over an SMTP client to the given recipients
+func testSendMail(t *testing.T, c *smtp.Client, to ...string) error {
+	t.Helper()
+	if err := c.Mail("sender@example.net", nil); err != nil {
+		return err
+	}
+	for _, address := range to {
+		if err := c.Rcpt(address, nil); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(w, "From: Sender <sender@example.net>\r\n")
+	fmt.Fprint(w, "To: Everyone <everyone@example.org>\r\n")
+	fmt.Fprint(w, "Subject: Hello\r\n\r\nHello World\r\n")
+	return w.Close()
+}
+
+func TestPerRecipientDelivery(t *testing.T) {
+	e := New("example.org")
+	e.IncomingValidateSPF = false
+	e.IncomingValidateDKIM = false
+	e.IncomingValidateDMARC = false
+	var deliveryLock sync.Mutex
+	deliveries := map[string][]Recipient{}
+	for _, inbox := range []string{"alice", "bob"} {
+		if err := e.RegisterInbox(inbox, func(email *Email) error {
+			deliveryLock.Lock()
+			defer deliveryLock.Unlock()
+			deliveries[inbox] = append(deliveries[inbox], *email.Recipient)
+			if !slices.Equal(email.Received.RcptTo, []string{"alice@example.org", "Bob+Urgent@example.org"}) {
+				t.Errorf("Received.RcptTo = %q, want every recipient once", email.Received.RcptTo)
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	addr := testServe(t, &e, false, nil)
+
+	c := testDial(t, addr, false)
+	if err := testSendMail(t, c, "alice@example.org", "Bob+Urgent@example.org", "ALICE@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	deliveryLock.Lock()
+	defer deliveryLock.Unlock()
+	if want := []Recipient{{Address: "alice@example.org", Inbox: "alice"}}; !slices.Equal(deliveries["alice"], want) {
+		t.Errorf("alice received %+v, want %+v", deliveries["alice"], want)
+	}
+	if want := []Recipient{{Address: "bob+urgent@example.org", Inbox: "bob", Tag: "Urgent"}}; !slices.Equal(deliveries["bob"], want) {
+		t.Errorf("bob received %+v, want %+v", deliveries["bob"], want)
+	}
+}
+
+func TestPerRecipientReply(t *testing.T) {
+	tests := []struct {
+		name  string
+		alice error
+		bob   error
+		code  int // Reply code to the DATA command, 0 if the email is accepted
+	}{
+		{"all accept", nil, nil, 0},
+		{"one rejects", nil, Reject("No thanks"), 0},
+		{"all reject", Reject("No thanks"), Reject("Not me either"), 550},
+		{"one fails temporarily", Reject("No thanks"), TempFail("Busy"), 451},
+		{"one errors", Reject("No thanks"), errors.New("disk full"), 451},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := New("example.org")
+			e.IncomingValidateSPF = false
+			e.IncomingValidateDKIM = false
+			e.IncomingValidateDMARC = false
+			e.ErrorLogger = func(err error) {}
+			if err := e.RegisterInbox("alice", func(email *Email) error { return tt.alice }); err != nil {
+				t.Fatal(err)
+			}
+			if err := e.RegisterInbox("bob", func(email *Email) error { return tt.bob }); err != nil {
+				t.Fatal(err)
+			}
+			addr := testServe(t, &e, false, nil)
+
+			err := testSendMail(t, testDial(t, addr, false), "alice@example.org", "bob@example.org")
+			var smtpErr *smtp.SMTPError
+			switch {
+			case tt.code == 0 && err != nil:
+				t.Errorf("DATA = %s, want the email accepted", err)
+			case tt.code != 0 && (!errors.As(err, &smtpErr) || smtpErr.Code != tt.code):
+				t.Errorf("DATA = %v, want %d", err, tt.code)
+			}
+		})
+	}
+}
+
+func TestSendEmailAllRecipients(t *testing.T) {
+	e := New("example.org")
+	receiver := testReceiver(t, &e, "example.net")
+	var deliveryLock sync.Mutex
+	var delivered []string
+	for _, inbox := range []string{"alice", "bob", "carol"} {
+		if err := receiver.RegisterInbox(inbox, func(email *Email) error {
+			deliveryLock.Lock()
+			defer deliveryLock.Unlock()
+			if len(email.To) != 1 || email.To[0].Address != email.Recipient.Address {
+				t.Errorf("%s received 'To' = %v, want only its own address", inbox, email.To)
+			}
+			delivered = append(delivered, email.Recipient.Address)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var statuses []DeliveryStatus
+	e.OnDeliveryEvent(func(event DeliveryEvent) {
+		statuses = append(statuses, event.Status)
+	})
+
+	err := e.SendEmail(&Email{
+		From: Address{Address: "noreply@example.org"},
+		To: []Address{
+			{Name: "Alice", Address: "alice@example.net"},
+			{Name: "Bob", Address: "bob@example.net"},
+			{Name: "Carol", Address: "carol@example.net"},
+		},
+		Subject: "Hello",
+		Content: "Hello World",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deliveryLock.Lock()
+	defer deliveryLock.Unlock()
+	if want := []string{"alice@example.net", "bob@example.net", "carol@example.net"}; !slices.Equal(delivered, want) {
+		t.Errorf("receiver got emails for %q, want %q", delivered, want)
+	}
+	if want := []DeliveryStatus{DeliveryDelivered, DeliveryDelivered, DeliveryDelivered}; !slices.Equal(statuses, want) {
+		t.Errorf("events = %q, want %q", statuses, want)
+	}
+}
@@ -0,0 +1,597 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RFC 7208 Section 4.6.4, limits on DNS querying terms
+const (
+	spfMaxLookups     = 10
+	spfMaxVoidLookups = 2
+)
+
+var (
+	errSPFTemp = errors.New("spf: temporary dns error")
+	errSPFVoid = errors.New("spf: void lookup")
+)
+
+// Tracks the state of a single SPF evaluation (RFC 7208)
+type spfCheck struct {
+	ctx      context.Context
+	resolver Resolver
+	ip       net.IP
+	helo     string
+	sender   string // Full sender address, "postmaster@helo" if MAIL FROM was empty
+	lookups  int    // DNS querying terms evaluated so far
+	voids    int    // DNS queries which returned no records
+}
+
+// Evaluate the SPF policy of the MAIL FROM domain (or the HELO domain for bounces)
+// against the connecting IP address
+func (e *Engine) checkSPF(ip net.IP, helo, sender string) *AuthenticationSPF {
+	if sender == "" {
+		sender = "postmaster@" + helo
+	}
+	_, domain, ok := strings.Cut(sender, "@")
+	if !ok {
+		domain = helo
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), e.IncomingTimeout)
+	defer cancel()
+
+	c := &spfCheck{
+		ctx:      ctx,
+		resolver: e.Resolver,
+		ip:       ip,
+		helo:     helo,
+		sender:   sender,
+	}
+	result, reason := c.checkHost(domain)
+	return &AuthenticationSPF{
+		Result: result,
+		Domain: strings.ToLower(domain),
+		Reason: reason,
+	}
+}
+
+// The check_host() function as described in RFC 7208 Section 4
+func (c *spfCheck) checkHost(domain string) (SPFResult, string) {
+
+	// Validate Domain
+	domain = strings.TrimSuffix(domain, ".")
+	if !isValidSPFDomain(domain) {
+		return SPFNone, fmt.Sprintf("invalid domain '%s'", domain)
+	}
+
+	// Lookup Record
+	txts, err := c.resolver.LookupTXT(c.ctx, domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return SPFNone, fmt.Sprintf("no spf record for '%s'", domain)
+		}
+		return SPFTempError, fmt.Sprintf("cannot lookup spf record for '%s': %s", domain, err)
+	}
+	var record string
+	var records int
+	for _, txt := range txts {
+		lower := strings.ToLower(txt)
+		if lower == "v=spf1" || strings.HasPrefix(lower, "v=spf1 ") {
+			record = txt
+			records++
+		}
+	}
+	switch records {
+	case 0:
+		return SPFNone, fmt.Sprintf("no spf record for '%s'", domain)
+	case 1:
+	default:
+		return SPFPermError, fmt.Sprintf("multiple spf records for '%s'", domain)
+	}
+
+	// Parse Record
+	var redirect, explanation string
+	var directives []string
+	for _, term := range strings.Fields(record)[1:] {
+		name, value, isModifier := strings.Cut(term, "=")
+		if isModifier && !strings.ContainsAny(name, ":/") {
+			switch strings.ToLower(name) {
+			case "redirect":
+				if redirect != "" {
+					return SPFPermError, "multiple redirect modifiers"
+				}
+				redirect = value
+			case "exp":
+				if explanation != "" {
+					return SPFPermError, "multiple exp modifiers"
+				}
+				explanation = value
+			}
+			// Unknown modifiers MUST be ignored
+			continue
+		}
+		directives = append(directives, term)
+	}
+
+	// Evaluate Mechanisms
+	for _, directive := range directives {
+		result := SPFPass
+		switch directive[0] {
+		case '+':
+			directive = directive[1:]
+		case '-':
+			result = SPFFail
+			directive = directive[1:]
+		case '~':
+			result = SPFSoftFail
+			directive = directive[1:]
+		case '?':
+			result = SPFNeutral
+			directive = directive[1:]
+		}
+		matched, mechResult, reason := c.evaluateMechanism(domain, directive)
+		if mechResult != "" {
+			return mechResult, reason
+		}
+		if !matched {
+			continue
+		}
+		if result == SPFFail && explanation != "" {
+			reason = c.explain(domain, explanation)
+		}
+		if reason == "" {
+			reason = fmt.Sprintf("matched '%s' in spf record for '%s'", directive, domain)
+		}
+		return result, reason
+	}
+
+	// Follow Redirect
+	if redirect != "" {
+		if err := c.countLookup(); err != nil {
+			return SPFPermError, err.Error()
+		}
+		target, err := c.expand(redirect, domain, false)
+		if err != nil {
+			return SPFPermError, err.Error()
+		}
+		result, reason := c.checkHost(target)
+		if result == SPFNone {
+			return SPFPermError, fmt.Sprintf("redirect target '%s' has no spf record", target)
+		}
+		return result, reason
+	}
+
+	return SPFNeutral, fmt.Sprintf("no mechanism matched in spf record for '%s'", domain)
+}
+
+// Evaluate a single mechanism, returning if it matched or a non-empty result
+// if evaluation must stop (temperror or permerror)
+func (c *spfCheck) evaluateMechanism(domain, mechanism string) (bool, SPFResult, string) {
+	name, arg, hasArg := strings.Cut(mechanism, ":")
+	if !hasArg {
+		// Mechanisms like "a/24" or "mx//64" carry a CIDR length without a domain
+		if i := strings.IndexByte(name, '/'); i >= 0 {
+			name, arg = name[:i], name[i:]
+		}
+	}
+	name = strings.ToLower(name)
+
+	switch name {
+	case "all":
+		if arg != "" {
+			return false, SPFPermError, fmt.Sprintf("invalid mechanism '%s'", mechanism)
+		}
+		return true, "", ""
+
+	case "include":
+		if err := c.countLookup(); err != nil {
+			return false, SPFPermError, err.Error()
+		}
+		target, err := c.expand(arg, domain, false)
+		if err != nil || arg == "" {
+			return false, SPFPermError, fmt.Sprintf("invalid mechanism '%s'", mechanism)
+		}
+		switch result, reason := c.checkHost(target); result {
+		case SPFPass:
+			return true, "", ""
+		case SPFFail, SPFSoftFail, SPFNeutral:
+			return false, "", ""
+		case SPFTempError:
+			return false, SPFTempError, reason
+		default:
+			return false, SPFPermError, fmt.Sprintf("include of '%s' failed: %s", target, reason)
+		}
+
+	case "a", "mx":
+		if err := c.countLookup(); err != nil {
+			return false, SPFPermError, err.Error()
+		}
+		spec, cidr4, cidr6, err := parseSPFCIDR(arg)
+		if err != nil || (hasArg && spec == "") {
+			return false, SPFPermError, fmt.Sprintf("invalid mechanism '%s'", mechanism)
+		}
+		target := domain
+		if spec != "" {
+			if target, err = c.expand(spec, domain, false); err != nil {
+				return false, SPFPermError, err.Error()
+			}
+		}
+		hosts := []string{target}
+		if name == "mx" {
+			records, err := c.lookupMX(target)
+			if err == errSPFTemp {
+				return false, SPFTempError, fmt.Sprintf("cannot lookup mx records for '%s'", target)
+			} else if err != nil {
+				return false, SPFPermError, err.Error()
+			}
+			if len(records) > spfMaxLookups {
+				return false, SPFPermError, fmt.Sprintf("too many mx records for '%s'", target)
+			}
+			hosts = hosts[:0]
+			for _, mx := range records {
+				hosts = append(hosts, mx.Host)
+			}
+		}
+		for _, host := range hosts {
+			addrs, err := c.lookupIP(c.network(), host)
+			if err == errSPFTemp {
+				return false, SPFTempError, fmt.Sprintf("cannot lookup addresses for '%s'", host)
+			} else if err != nil {
+				return false, SPFPermError, err.Error()
+			}
+			for _, addr := range addrs {
+				if matchSPFNetwork(c.ip, addr, cidr4, cidr6) {
+					return true, "", ""
+				}
+			}
+		}
+		return false, "", ""
+
+	case "ptr":
+		if err := c.countLookup(); err != nil {
+			return false, SPFPermError, err.Error()
+		}
+		target := domain
+		if arg != "" {
+			var err error
+			if target, err = c.expand(arg, domain, false); err != nil {
+				return false, SPFPermError, err.Error()
+			}
+		}
+		// Errors during PTR lookups are treated as a non-match (Section 5.5)
+		return c.validatedName(target) != "", "", ""
+
+	case "ip4", "ip6":
+		network := arg
+		if !strings.Contains(network, "/") {
+			if name == "ip4" {
+				network += "/32"
+			} else {
+				network += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil || (name == "ip4") != (ipNet.IP.To4() != nil) {
+			return false, SPFPermError, fmt.Sprintf("invalid mechanism '%s'", mechanism)
+		}
+		return ipNet.Contains(c.ip), "", ""
+
+	case "exists":
+		if err := c.countLookup(); err != nil {
+			return false, SPFPermError, err.Error()
+		}
+		target, err := c.expand(arg, domain, false)
+		if err != nil || arg == "" {
+			return false, SPFPermError, fmt.Sprintf("invalid mechanism '%s'", mechanism)
+		}
+		// Always an A lookup, whatever the family of the connecting address (Section 5.7)
+		addrs, err := c.lookupIP("ip4", target)
+		if err == errSPFTemp {
+			return false, SPFTempError, fmt.Sprintf("cannot lookup addresses for '%s'", target)
+		} else if err != nil {
+			return false, SPFPermError, err.Error()
+		}
+		return len(addrs) > 0, "", ""
+	}
+
+	return false, SPFPermError, fmt.Sprintf("unknown mechanism '%s'", mechanism)
+}
+
+// Count a DNS querying term against the lookup limit
+func (c *spfCheck) countLookup() error {
+	c.lookups++
+	if c.lookups > spfMaxLookups {
+		return fmt.Errorf("too many dns lookups")
+	}
+	return nil
+}
+
+// Count a query which returned no records against the void lookup limit
+func (c *spfCheck) countVoid(err error) error {
+	var dnsErr *net.DNSError
+	if err != nil && !(errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+		return errSPFTemp
+	}
+	c.voids++
+	if c.voids > spfMaxVoidLookups {
+		return fmt.Errorf("too many void dns lookups")
+	}
+	return errSPFVoid
+}
+
+// Returns the network matching the family of the connecting IP address
+func (c *spfCheck) network() string {
+	if c.ip.To4() != nil {
+		return "ip4"
+	}
+	return "ip6"
+}
+
+// Lookup the addresses of a host in the given network ("ip4" or "ip6")
+func (c *spfCheck) lookupIP(network, host string) ([]net.IP, error) {
+	addrs, err := c.resolver.LookupIP(c.ctx, network, host)
+	if err != nil || len(addrs) == 0 {
+		if err := c.countVoid(err); err != errSPFVoid {
+			return nil, err
+		}
+		return nil, nil
+	}
+	return addrs, nil
+}
+
+// Lookup the mail exchangers of a domain
+func (c *spfCheck) lookupMX(domain string) ([]*net.MX, error) {
+	records, err := c.resolver.LookupMX(c.ctx, domain)
+	if err != nil || len(records) == 0 {
+		if err := c.countVoid(err); err != errSPFVoid {
+			return nil, err
+		}
+		return nil, nil
+	}
+	return records, nil
+}
+
+// Returns a forward-confirmed PTR name of the connecting IP address which is
+// either the target domain or a subdomain of it, if any (Section 5.5)
+func (c *spfCheck) validatedName(target string) string {
+	names, err := c.resolver.LookupAddr(c.ctx, c.ip.String())
+	if err != nil {
+		return ""
+	}
+	target = strings.ToLower(strings.TrimSuffix(target, "."))
+	for i, name := range names {
+		if i >= spfMaxLookups {
+			break
+		}
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		if name != target && !strings.HasSuffix(name, "."+target) {
+			continue
+		}
+		addrs, err := c.resolver.LookupIP(c.ctx, "ip", name)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if addr.Equal(c.ip) {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// Fetch and expand the explanation string of a failing record, errors are
+// ignored as the explanation is purely informative
+func (c *spfCheck) explain(domain, spec string) string {
+	target, err := c.expand(spec, domain, false)
+	if err != nil {
+		return ""
+	}
+	txts, err := c.resolver.LookupTXT(c.ctx, target)
+	if err != nil || len(txts) != 1 {
+		return ""
+	}
+	explanation, err := c.expand(txts[0], domain, true)
+	if err != nil {
+		return ""
+	}
+	return explanation
+}
+
+// Expand the macros in a domain-spec or explanation string (Section 7)
+func (c *spfCheck) expand(spec, domain string, explanation bool) (string, error) {
+	var out strings.Builder
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			out.WriteByte(spec[i])
+			continue
+		}
+		if i+1 >= len(spec) {
+			return "", fmt.Errorf("invalid macro in '%s'", spec)
+		}
+		i++
+		switch spec[i] {
+		case '%':
+			out.WriteByte('%')
+			continue
+		case '_':
+			out.WriteByte(' ')
+			continue
+		case '-':
+			out.WriteString("%20")
+			continue
+		case '{':
+		default:
+			return "", fmt.Errorf("invalid macro in '%s'", spec)
+		}
+		end := strings.IndexByte(spec[i:], '}')
+		if end < 2 {
+			return "", fmt.Errorf("invalid macro in '%s'", spec)
+		}
+		macro := spec[i+1 : i+end]
+		i += end
+
+		// Resolve Macro Letter
+		letter := macro[0]
+		escape := letter >= 'A' && letter <= 'Z'
+		local, senderDomain, _ := strings.Cut(c.sender, "@")
+		var value string
+		switch letter | 0x20 {
+		case 's':
+			value = c.sender
+		case 'l':
+			value = local
+		case 'o':
+			value = senderDomain
+		case 'd':
+			value = domain
+		case 'i':
+			value = spfDottedIP(c.ip)
+		case 'p':
+			// Discouraged by the RFC, the lookup is skipped to save a query
+			value = "unknown"
+		case 'v':
+			value = "in-addr"
+			if c.ip.To4() == nil {
+				value = "ip6"
+			}
+		case 'h':
+			value = c.helo
+		case 'c', 'r', 't':
+			if !explanation {
+				return "", fmt.Errorf("invalid macro in '%s'", spec)
+			}
+			switch letter | 0x20 {
+			case 'c':
+				value = c.ip.String()
+			case 'r':
+				value = "unknown"
+			case 't':
+				value = strconv.FormatInt(time.Now().Unix(), 10)
+			}
+		default:
+			return "", fmt.Errorf("invalid macro in '%s'", spec)
+		}
+
+		// Apply Transformers
+		rest := macro[1:]
+		digits := 0
+		for len(rest) > 0 && rest[0] >= '0' && rest[0] <= '9' {
+			digits = digits*10 + int(rest[0]-'0')
+			rest = rest[1:]
+		}
+		reverse := false
+		if len(rest) > 0 && (rest[0] == 'r' || rest[0] == 'R') {
+			reverse = true
+			rest = rest[1:]
+		}
+		delimiters := "."
+		if rest != "" {
+			if strings.Trim(rest, ".-+,/_=") != "" {
+				return "", fmt.Errorf("invalid macro in '%s'", spec)
+			}
+			delimiters = rest
+		}
+		parts := strings.FieldsFunc(value, func(r rune) bool {
+			return strings.ContainsRune(delimiters, r)
+		})
+		if reverse {
+			for l, r := 0, len(parts)-1; l < r; l, r = l+1, r-1 {
+				parts[l], parts[r] = parts[r], parts[l]
+			}
+		}
+		if digits > 0 && digits < len(parts) {
+			parts = parts[len(parts)-digits:]
+		}
+		value = strings.Join(parts, ".")
+		if escape {
+			value = spfEscape(value)
+		}
+		out.WriteString(value)
+	}
+	return out.String(), nil
+}
+
+// Percent-encode every byte of a macro value outside the unreserved characters of RFC 3986
+func spfEscape(value string) string {
+	const hex = "0123456789ABCDEF"
+	var out strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("-._~", c) >= 0 {
+			out.WriteByte(c)
+			continue
+		}
+		out.WriteByte('%')
+		out.WriteByte(hex[c>>4])
+		out.WriteByte(hex[c&0xf])
+	}
+	return out.String()
+}
+
+// Format an IP address for the 'i' macro, IPv6 addresses use dotted nibbles
+func spfDottedIP(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return v4.String()
+	}
+	const hex = "0123456789abcdef"
+	nibbles := make([]string, 0, 32)
+	for _, b := range ip.To16() {
+		nibbles = append(nibbles, string(hex[b>>4]), string(hex[b&0xf]))
+	}
+	return strings.Join(nibbles, ".")
+}
+
+// Split an "a" or "mx" argument into its domain-spec and CIDR lengths
+func parseSPFCIDR(arg string) (spec string, cidr4, cidr6 int, err error) {
+	cidr4, cidr6 = 32, 128
+	spec, lengths, ok := strings.Cut(arg, "/")
+	if !ok {
+		return spec, cidr4, cidr6, nil
+	}
+	v4, v6, dual := strings.Cut("/"+lengths, "//")
+	v4 = strings.TrimPrefix(v4, "/")
+	if dual {
+		if cidr6, err = strconv.Atoi(v6); err != nil || cidr6 < 0 || cidr6 > 128 {
+			return "", 0, 0, fmt.Errorf("invalid ip6 cidr length")
+		}
+	}
+	if v4 != "" {
+		if cidr4, err = strconv.Atoi(v4); err != nil || cidr4 < 0 || cidr4 > 32 {
+			return "", 0, 0, fmt.Errorf("invalid ip4 cidr length")
+		}
+	}
+	return spec, cidr4, cidr6, nil
+}
+
+// Determines if two addresses share a network of the given CIDR length
+func matchSPFNetwork(ip, addr net.IP, cidr4, cidr6 int) bool {
+	if ip4, addr4 := ip.To4(), addr.To4(); ip4 != nil && addr4 != nil {
+		mask := net.CIDRMask(cidr4, 32)
+		return ip4.Mask(mask).Equal(addr4.Mask(mask))
+	}
+	if ip.To4() != nil || addr.To4() != nil {
+		return false
+	}
+	mask := net.CIDRMask(cidr6, 128)
+	return ip.Mask(mask).Equal(addr.Mask(mask))
+}
+
+// Determines if a domain is a syntactically valid multi-label domain name
+func isValidSPFDomain(domain string) bool {
+	if len(domain) == 0 || len(domain) > 253 || !strings.Contains(domain, ".") {
+		return false
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return false
+		}
+	}
+	return true
+}
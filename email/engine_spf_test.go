@@ -0,0 +1,299 @@
+package email
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+)
+
+// Resolver answering from fixed records, names without records are not found
+type testResolver struct {
+	txt    map[string][]string
+	ip     map[string][]net.IP // Keyed by "network host", e.g. "ip4 example.org"
+	mx     map[string][]*net.MX
+	addr   map[string][]string
+	failed map[string]bool // Names which fail with a temporary error
+}
+
+func (r *testResolver) lookup(name string) error {
+	if r.failed[name] {
+		return &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *testResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if records, ok := r.txt[name]; ok {
+		return records, nil
+	}
+	return nil, r.lookup(name)
+}
+
+func (r *testResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	var addrs []net.IP
+	if network == "ip" || network == "ip4" {
+		addrs = append(addrs, r.ip["ip4 "+host]...)
+	}
+	if network == "ip" || network == "ip6" {
+		addrs = append(addrs, r.ip["ip6 "+host]...)
+	}
+	if len(addrs) == 0 {
+		return nil, r.lookup(host)
+	}
+	return addrs, nil
+}
+
+func (r *testResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if records, ok := r.mx[name]; ok {
+		return records, nil
+	}
+	return nil, r.lookup(name)
+}
+
+func (r *testResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	if names, ok := r.addr[addr]; ok {
+		return names, nil
+	}
+	return nil, r.lookup(addr)
+}
+
+func TestCheckSPF(t *testing.T) {
+	includes := make(map[string][]string)
+	for i := 1; i <= spfMaxLookups+1; i++ {
+		includes[fmt.Sprintf("l%d.example.org", i)] = []string{fmt.Sprintf("v=spf1 include:l%d.example.org -all", i+1)}
+	}
+	includes["l12.example.org"] = []string{"v=spf1 +all"}
+
+	tests := []struct {
+		name     string
+		record   string
+		resolver testResolver
+		ip       string
+		sender   string
+		want     SPFResult
+	}{
+		{name: "ip4 pass", record: "v=spf1 ip4:192.0.2.0/24 -all", ip: "192.0.2.10", want: SPFPass},
+		{name: "ip4 fail", record: "v=spf1 ip4:192.0.2.0/24 -all", ip: "198.51.100.1", want: SPFFail},
+		{name: "softfail", record: "v=spf1 ip4:192.0.2.1 ~all", ip: "198.51.100.1", want: SPFSoftFail},
+		{name: "neutral qualifier", record: "v=spf1 ?all", ip: "198.51.100.1", want: SPFNeutral},
+		{name: "no match", record: "v=spf1 ip4:192.0.2.1", ip: "198.51.100.1", want: SPFNeutral},
+		{name: "ip6 pass", record: "v=spf1 ip6:2001:db8::/32 -all", ip: "2001:db8::1", want: SPFPass},
+		{name: "ip6 against ip4 client", record: "v=spf1 ip6:2001:db8::/32 -all", ip: "192.0.2.1", want: SPFFail},
+		{name: "invalid ip4", record: "v=spf1 ip4:2001:db8::1 -all", ip: "192.0.2.1", want: SPFPermError},
+		{name: "no record", ip: "192.0.2.1", want: SPFNone},
+		{name: "not spf", record: "v=spf10 +all", ip: "192.0.2.1", want: SPFNone},
+		{name: "unknown modifier", record: "v=spf1 foo=bar +all", ip: "192.0.2.1", want: SPFPass},
+		{name: "unknown mechanism", record: "v=spf1 foo:bar +all", ip: "192.0.2.1", want: SPFPermError},
+		{
+			name:     "multiple records",
+			resolver: testResolver{txt: map[string][]string{"example.org": {"v=spf1 +all", "v=spf1 -all"}}},
+			ip:       "192.0.2.1",
+			want:     SPFPermError,
+		},
+		{
+			name:     "temporary error",
+			resolver: testResolver{failed: map[string]bool{"example.org": true}},
+			ip:       "192.0.2.1",
+			want:     SPFTempError,
+		},
+		{
+			name:     "a",
+			record:   "v=spf1 a -all",
+			resolver: testResolver{ip: map[string][]net.IP{"ip4 example.org": {net.ParseIP("192.0.2.5")}}},
+			ip:       "192.0.2.5",
+			want:     SPFPass,
+		},
+		{
+			name:     "a with cidr",
+			record:   "v=spf1 a/24 -all",
+			resolver: testResolver{ip: map[string][]net.IP{"ip4 example.org": {net.ParseIP("192.0.2.5")}}},
+			ip:       "192.0.2.200",
+			want:     SPFPass,
+		},
+		{
+			name:     "a uses the client family",
+			record:   "v=spf1 a:mail.example.org -all",
+			resolver: testResolver{ip: map[string][]net.IP{"ip6 mail.example.org": {net.ParseIP("2001:db8::5")}}},
+			ip:       "2001:db8::5",
+			want:     SPFPass,
+		},
+		{name: "a with empty domain", record: "v=spf1 a: -all", ip: "192.0.2.1", want: SPFPermError},
+		{name: "mx with empty domain", record: "v=spf1 mx:/24 -all", ip: "192.0.2.1", want: SPFPermError},
+		{
+			name:   "mx",
+			record: "v=spf1 mx -all",
+			resolver: testResolver{
+				mx: map[string][]*net.MX{"example.org": {{Host: "mx.example.org", Pref: 10}}},
+				ip: map[string][]net.IP{"ip4 mx.example.org": {net.ParseIP("192.0.2.25")}},
+			},
+			ip:   "192.0.2.25",
+			want: SPFPass,
+		},
+		{
+			name:   "ptr",
+			record: "v=spf1 ptr -all",
+			resolver: testResolver{
+				addr: map[string][]string{"192.0.2.8": {"mail.example.org."}},
+				ip:   map[string][]net.IP{"ip4 mail.example.org": {net.ParseIP("192.0.2.8")}},
+			},
+			ip:   "192.0.2.8",
+			want: SPFPass,
+		},
+		{
+			name:     "include pass",
+			record:   "v=spf1 include:_spf.example.net -all",
+			resolver: testResolver{txt: map[string][]string{"_spf.example.net": {"v=spf1 ip4:192.0.2.0/24 -all"}}},
+			ip:       "192.0.2.1",
+			want:     SPFPass,
+		},
+		{
+			name:     "include fail does not match",
+			record:   "v=spf1 include:_spf.example.net ~all",
+			resolver: testResolver{txt: map[string][]string{"_spf.example.net": {"v=spf1 -all"}}},
+			ip:       "192.0.2.1",
+			want:     SPFSoftFail,
+		},
+		{name: "include without record", record: "v=spf1 include:_spf.example.net -all", ip: "192.0.2.1", want: SPFPermError},
+		{
+			name:     "redirect",
+			record:   "v=spf1 redirect=_spf.example.net",
+			resolver: testResolver{txt: map[string][]string{"_spf.example.net": {"v=spf1 ip4:192.0.2.1 -all"}}},
+			ip:       "192.0.2.1",
+			want:     SPFPass,
+		},
+		{name: "redirect without record", record: "v=spf1 redirect=_spf.example.net", ip: "192.0.2.1", want: SPFPermError},
+		{
+			name:     "exists ip4",
+			record:   "v=spf1 exists:%{i}._spf.%{d} -all",
+			resolver: testResolver{ip: map[string][]net.IP{"ip4 192.0.2.1._spf.example.org": {net.ParseIP("127.0.0.2")}}},
+			ip:       "192.0.2.1",
+			want:     SPFPass,
+		},
+		{
+			name:   "exists ip6 uses an A lookup",
+			record: "v=spf1 exists:%{ir}._spf.%{d} -all",
+			resolver: testResolver{ip: map[string][]net.IP{
+				"ip4 1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2._spf.example.org": {net.ParseIP("127.0.0.2")},
+			}},
+			ip:   "2001:db8::1",
+			want: SPFPass,
+		},
+		{
+			name:   "exp explains fail",
+			record: "v=spf1 -all exp=explain.example.org",
+			resolver: testResolver{txt: map[string][]string{
+				"explain.example.org": {"%{i} is not one of %{d}'s designated mail servers."},
+			}},
+			ip:   "192.0.2.1",
+			want: SPFFail,
+		},
+		{
+			name:     "too many lookups",
+			record:   "v=spf1 include:l1.example.org -all",
+			resolver: testResolver{txt: includes},
+			ip:       "192.0.2.1",
+			want:     SPFPermError,
+		},
+		{
+			name:   "too many void lookups",
+			record: "v=spf1 a:v1.example.org a:v2.example.org a:v3.example.org +all",
+			ip:     "192.0.2.1",
+			want:   SPFPermError,
+		},
+		{
+			name:   "void lookups within limit",
+			record: "v=spf1 a:v1.example.org a:v2.example.org +all",
+			ip:     "192.0.2.1",
+			want:   SPFPass,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver := tt.resolver
+			if tt.record != "" {
+				if resolver.txt == nil {
+					resolver.txt = make(map[string][]string)
+				}
+				resolver.txt["example.org"] = []string{tt.record}
+			}
+			sender := tt.sender
+			if sender == "" {
+				sender = "user@example.org"
+			}
+			e := New("example.com")
+			e.Resolver = &resolver
+			got := e.checkSPF(net.ParseIP(tt.ip), "mail.example.org", sender)
+			if got.Result != tt.want {
+				t.Errorf("result = %s (%s), want %s", got.Result, got.Reason, tt.want)
+			}
+			if got.Domain != "example.org" {
+				t.Errorf("domain = %s, want example.org", got.Domain)
+			}
+		})
+	}
+}
+
+func TestExpandSPF(t *testing.T) {
+	// Examples from RFC 7208 Section 7.4
+	tests := []struct {
+		spec        string
+		ip          string
+		sender      string
+		explanation bool
+		want        string
+		wantErr     bool
+	}{
+		{spec: "%{s}", want: "strong-bad@email.example.com"},
+		{spec: "%{o}", want: "email.example.com"},
+		{spec: "%{d}", want: "email.example.com"},
+		{spec: "%{d4}", want: "email.example.com"},
+		{spec: "%{d3}", want: "email.example.com"},
+		{spec: "%{d2}", want: "example.com"},
+		{spec: "%{d1}", want: "com"},
+		{spec: "%{dr}", want: "com.example.email"},
+		{spec: "%{d2r}", want: "example.email"},
+		{spec: "%{l}", want: "strong-bad"},
+		{spec: "%{l-}", want: "strong.bad"},
+		{spec: "%{lr}", want: "strong-bad"},
+		{spec: "%{lr-}", want: "bad.strong"},
+		{spec: "%{l1r-}", want: "strong"},
+		{spec: "%{S}", want: "strong-bad%40email.example.com"},
+		{spec: "%{L}", sender: `"strong bad+tag"@email.example.com`, want: "%22strong%20bad%2Btag%22"},
+		{spec: "%{l}", sender: `"strong bad"@email.example.com`, want: `"strong bad"`},
+		{spec: "%{ir}.%{v}._spf.%{d2}", want: "3.2.0.192.in-addr._spf.example.com"},
+		{spec: "%{lr-}.lp._spf.%{d2}", want: "bad.strong.lp._spf.example.com"},
+		{spec: "%{lr-}.lp.%{ir}.%{v}._spf.%{d2}", want: "bad.strong.lp.3.2.0.192.in-addr._spf.example.com"},
+		{spec: "%{ir}.%{v}.%{l1r-}.lp._spf.%{d2}", want: "3.2.0.192.in-addr.strong.lp._spf.example.com"},
+		{spec: "%{d2}.trusted-domains.example.net", want: "example.com.trusted-domains.example.net"},
+		{spec: "%{ir}.%{v}._spf.%{d2}", ip: "2001:db8::cb01", want: "1.0.b.c.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6._spf.example.com"},
+		{spec: "%{h}", want: "mail.example.com"},
+		{spec: "100%% %_%-", want: "100%  %20"},
+		{spec: "%{c}", explanation: true, want: "192.0.2.3"},
+		{spec: "%{c}", wantErr: true},
+		{spec: "%{x}", wantErr: true},
+		{spec: "%{d2!}", wantErr: true},
+		{spec: "%{}", wantErr: true},
+		{spec: "%", wantErr: true},
+		{spec: "%x", wantErr: true},
+	}
+	for _, tt := range tests {
+		ip := tt.ip
+		if ip == "" {
+			ip = "192.0.2.3"
+		}
+		sender := tt.sender
+		if sender == "" {
+			sender = "strong-bad@email.example.com"
+		}
+		c := &spfCheck{ip: net.ParseIP(ip), helo: "mail.example.com", sender: sender}
+		got, err := c.expand(tt.spec, "email.example.com", tt.explanation)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("expand(%q) error = %v, want error %t", tt.spec, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("expand(%q) = %q, want %q", tt.spec, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package email
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+	"github.com/jhillyerd/enmime"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// A user allowed to submit outbound emails over SMTP
+type SubmissionUser struct {
+	Username string   // Login name
+	From     []string // Addresses the user may send as, "@example.org" allows any address of a domain
+}
+
+// Returns true if the user may use an address in the 'From' header
+func (u *SubmissionUser) CanSendAs(address string) bool {
+	address = strings.ToLower(address)
+	_, domain, _ := strings.Cut(address, "@")
+	for _, allowed := range u.From {
+		allowed = strings.ToLower(allowed)
+		if allowed == address || (strings.HasPrefix(allowed, "@") && allowed[1:] == domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// Verifies the credentials of submission clients
+type CredentialStore interface {
+	Authenticate(username, password string) (*SubmissionUser, error) // Returns nil if the credentials are invalid
+}
+
+type memoryCredential struct {
+	hash []byte
+	user SubmissionUser
+}
+
+// In-memory Credential Store, passwords are kept as bcrypt hashes
+type MemoryCredentialStore struct {
+	mu    sync.RWMutex
+	users map[string]memoryCredential
+}
+
+// Create an empty in-memory Credential Store
+func NewMemoryCredentialStore() *MemoryCredentialStore {
+	return &MemoryCredentialStore{users: make(map[string]memoryCredential)}
+}
+
+// Add or replace a user which may send as the given addresses
+func (s *MemoryCredentialStore) AddUser(username, password string, from ...string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("cannot hash password: %s", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users[username] = memoryCredential{
+		hash: hash,
+		user: SubmissionUser{Username: username, From: from},
+	}
+	return nil
+}
+
+// Remove a user, open sessions stay authenticated until they disconnect
+func (s *MemoryCredentialStore) RemoveUser(username string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.users, username)
+}
+
+func (s *MemoryCredentialStore) Authenticate(username, password string) (*SubmissionUser, error) {
+	s.mu.RLock()
+	entry, ok := s.users[username]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, nil
+	}
+	if err := bcrypt.CompareHashAndPassword(entry.hash, []byte(password)); err != nil {
+		return nil, nil
+	}
+	return &entry.user, nil
+}
+
+// Verify the credentials of a submission session
+func (s *Session) login(username, password string) error {
+	if s.engine.Credentials == nil {
+		return smtp.ErrAuthFailed
+	}
+	user, err := s.engine.Credentials.Authenticate(username, password)
+	if err != nil {
+		s.engine.ErrorLogger(fmt.Errorf("cannot authenticate submission user: %s", err))
+		return &smtp.SMTPError{
+			Code:         454,
+			EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+			Message:      "Temporary authentication failure",
+		}
+	}
+	if user == nil {
+		s.engine.ErrorLogger(fmt.Errorf("submission login failed for '%s' from %s", username, s.RemoteIP()))
+		return smtp.ErrAuthFailed
+	}
+	s.user = user
+	return nil
+}
+
+// SASL LOGIN Mechanism, go-sasl only provides a client for it
+type loginServer struct {
+	step         int
+	username     string
+	authenticate func(username, password string) error
+}
+
+func (l *loginServer) Next(response []byte) (challenge []byte, done bool, err error) {
+	switch l.step {
+	case 0:
+		// Some clients send the username as an initial response
+		l.step++
+		if len(response) == 0 {
+			return []byte("Username:"), false, nil
+		}
+		fallthrough
+	case 1:
+		l.step = 2
+		l.username = string(response)
+		return []byte("Password:"), false, nil
+	case 2:
+		l.step++
+		return nil, true, l.authenticate(l.username, string(response))
+	}
+	return nil, true, errors.New("unexpected client response")
+}
+
+// Returns a SASL server for a mechanism offered to submission clients
+func (s *Session) saslServer(mech string) (sasl.Server, error) {
+	switch mech {
+	case sasl.Plain:
+		return sasl.NewPlainServer(func(identity, username, password string) error {
+			if identity != "" && identity != username {
+				return smtp.ErrAuthFailed
+			}
+			return s.login(username, password)
+		}), nil
+	case sasl.Login:
+		return &loginServer{authenticate: s.login}, nil
+	}
+	return nil, smtp.ErrAuthUnknownMechanism
+}
+
+// Queue an email submitted by an authenticated user for outbound delivery
+func (e *Engine) submissionHandler(s *Session, r io.Reader) error {
+
+	// Read Submitted Envelope
+	body, err := io.ReadAll(r)
+	if err != nil {
+		e.ErrorLogger(fmt.Errorf("submitted email cannot be read: %s", err))
+		return smtp.ErrDataReset
+	}
+	envelope, err := enmime.ReadEnvelope(bytes.NewReader(body))
+	if err != nil {
+		return &smtp.SMTPError{
+			Code:         554,
+			EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+			Message:      "Email is invalid or malformed",
+		}
+	}
+
+	// Validate Sender
+	// 	Recipients come from the envelope so Bcc'd addresses are included,
+	// 	display names are copied from the headers where available
+	emailFrom, err := mail.ParseAddress(envelope.GetHeader("From"))
+	if err != nil {
+		return &smtp.SMTPError{
+			Code:         554,
+			EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+			Message:      "Email contains an invalid 'From' header",
+		}
+	}
+	if !s.user.CanSendAs(emailFrom.Address) {
+		return &smtp.SMTPError{
+			Code:         553,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      fmt.Sprintf("Sender address rejected: not owned by user %s", s.user.Username),
+		}
+	}
+	names := map[string]string{}
+	headers := map[string][]Address{}
+	for _, header := range []string{"To", "Cc", "Reply-To"} {
+		list, _ := mail.ParseAddressList(envelope.GetHeader(header))
+		for _, a := range list {
+			names[strings.ToLower(a.Address)] = a.Name
+			headers[header] = append(headers[header], Address{Name: a.Name, Address: a.Address})
+		}
+	}
+	recipients := make([]Address, 0, len(s.to))
+	for _, address := range s.to {
+		recipients = append(recipients, Address{
+			Name:    names[strings.ToLower(address)],
+			Address: address,
+		})
+	}
+
+	// Queue Email
+	email := &Email{
+		From: Address{
+			Name:    emailFrom.Name,
+			Address: emailFrom.Address,
+		},
+		To:          recipients,
+		Cc:          headers["Cc"],
+		Subject:     envelope.GetHeader("Subject"),
+		Attachments: envelopeAttachments(envelope),
+		InReplyTo:   envelope.GetHeader("In-Reply-To"),
+		References:  envelope.GetHeader("References"),
+	}
+	if replyTo := headers["Reply-To"]; len(replyTo) > 0 {
+		email.ReplyTo = &replyTo[0]
+	}
+	email.Content, email.HTML, email.Text = envelopeContent(envelope)
+	if !e.QueueEmail(email) {
+		return &smtp.SMTPError{
+			Code:         452,
+			EnhancedCode: smtp.EnhancedCode{4, 3, 1},
+			Message:      "Outbound queue is full, please try again later",
+		}
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package email
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestCanSendAs(t *testing.T) {
+	user := &SubmissionUser{Username: "alice", From: []string{"Alice@Example.org", "@Example.net"}}
+	tests := []struct {
+		address string
+		want    bool
+	}{
+		{address: "alice@example.org", want: true},
+		{address: "ALICE@EXAMPLE.ORG", want: true},
+		{address: "bob@example.org", want: false},
+		{address: "anyone@example.net", want: true},
+		{address: "anyone@sub.example.net", want: false},
+		{address: "anyone@example.network", want: false},
+		{address: "example.net", want: false},
+		{address: "", want: false},
+	}
+	for _, tt := range tests {
+		if got := user.CanSendAs(tt.address); got != tt.want {
+			t.Errorf("CanSendAs(%q) = %t, want %t", tt.address, got, tt.want)
+		}
+	}
+}
+
+func TestMemoryCredentialStore(t *testing.T) {
+	s := NewMemoryCredentialStore()
+	if err := s.AddUser("alice", "hunter2", "alice@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if cost, err := bcrypt.Cost(s.users["alice"].hash); err != nil || cost != bcrypt.DefaultCost {
+		t.Errorf("stored password has cost %d, %v, want a bcrypt hash of cost %d", cost, err, bcrypt.DefaultCost)
+	}
+
+	user, err := s.Authenticate("alice", "hunter2")
+	if err != nil || user == nil || user.Username != "alice" || !user.CanSendAs("alice@example.org") {
+		t.Fatalf("Authenticate() = %v, %v, want alice", user, err)
+	}
+	for _, login := range [][2]string{{"alice", "hunter3"}, {"alice", ""}, {"bob", "hunter2"}} {
+		if user, err := s.Authenticate(login[0], login[1]); err != nil || user != nil {
+			t.Errorf("Authenticate(%q, %q) = %v, %v, want nil", login[0], login[1], user, err)
+		}
+	}
+	s.RemoveUser("alice")
+	if user, _ := s.Authenticate("alice", "hunter2"); user != nil {
+		t.Errorf("Authenticate() of a removed user = %v, want nil", user)
+	}
+}
+
+func TestLoginServer(t *testing.T) {
+	var got [2]string
+	authenticate := func(username, password string) error {
+		got = [2]string{username, password}
+		if password != "hunter2" {
+			return smtp.ErrAuthFailed
+		}
+		return nil
+	}
+	tests := []struct {
+		name      string
+		responses []string // Client responses, the first is the initial response
+		want      []string // Expected challenges
+		wantErr   bool
+	}{
+		{name: "prompted", responses: []string{"", "alice", "hunter2"}, want: []string{"Username:", "Password:", ""}},
+		{name: "initial response", responses: []string{"alice", "hunter2"}, want: []string{"Password:", ""}},
+		{name: "wrong password", responses: []string{"alice", "hunter3"}, want: []string{"Password:", ""}, wantErr: true},
+	}
+	for _, tt := range tests {
+		got = [2]string{}
+		server := &loginServer{authenticate: authenticate}
+		var err error
+		for i, response := range tt.responses {
+			var challenge []byte
+			var done bool
+			challenge, done, err = server.Next([]byte(response))
+			if string(challenge) != tt.want[i] || done != (i == len(tt.responses)-1) {
+				t.Fatalf("%s: Next(%q) = %q, %t, want %q", tt.name, response, challenge, done, tt.want[i])
+			}
+		}
+		if (err != nil) != tt.wantErr || got != [2]string{"alice", tt.responses[len(tt.responses)-1]} {
+			t.Errorf("%s: authenticated %q with error %v, want alice and error %t", tt.name, got, err, tt.wantErr)
+		}
+		if _, done, err := server.Next(nil); !done || err == nil {
+			t.Errorf("%s: Next() after completion = %t, %v, want an error", tt.name, done, err)
+		}
+	}
+}
+
+func TestSubmission(t *testing.T) {
+	e := New("example.org")
+	e.ErrorLogger = func(err error) {}
+	credentials := NewMemoryCredentialStore()
+	if err := credentials.AddUser("alice", "hunter2", "alice@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	e.Credentials = credentials
+	addr := testServe(t, &e, true, testTLSConfig(t))
+	message := strings.Join([]string{
+		"From: Alice <alice@example.org>",
+		"To: Bob <bob@example.net>",
+		"Cc: carol@example.net",
+		"Subject: Hello",
+		"",
+		"Hello World",
+		"",
+	}, "\r\n")
+
+	tests := []struct {
+		name     string
+		auth     sasl.Client
+		from     string
+		wantCode int // Expected reply code of the failing command, 0 if the email is queued
+	}{
+		{name: "plain", auth: sasl.NewPlainClient("", "alice", "hunter2"), from: "alice@example.org"},
+		{name: "login", auth: sasl.NewLoginClient("alice", "hunter2"), from: "alice@example.org"},
+		{name: "wrong password", auth: sasl.NewPlainClient("", "alice", "hunter3"), wantCode: 535},
+		{name: "other identity", auth: sasl.NewPlainClient("bob", "alice", "hunter2"), wantCode: 535},
+		{name: "unauthenticated", from: "alice@example.org", wantCode: 502},
+		{name: "foreign sender", auth: sasl.NewPlainClient("", "alice", "hunter2"), from: "bob@example.org", wantCode: 553},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testDial(t, addr, true)
+			err := func() error {
+				if tt.auth != nil {
+					if err := c.Auth(tt.auth); err != nil {
+						return err
+					}
+				}
+				return c.SendMail(tt.from, []string{"bob@example.net", "dave@example.net"}, strings.NewReader(message))
+			}()
+			if tt.wantCode != 0 {
+				var smtpErr *smtp.SMTPError
+				if !errors.As(err, &smtpErr) || smtpErr.Code != tt.wantCode {
+					t.Fatalf("submission error = %v, want a %d reply", err, tt.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			email := <-e.outgoingQueue
+			if email.From.Address != "alice@example.org" || email.Subject != "Hello" {
+				t.Errorf("queued email from %q with subject %q, want alice@example.org and Hello", email.From.Address, email.Subject)
+			}
+			if len(email.To) != 2 || email.To[0] != (Address{Name: "Bob", Address: "bob@example.net"}) || email.To[1].Address != "dave@example.net" {
+				t.Errorf("queued email to %v, want bob and the Bcc'd dave", email.To)
+			}
+			if len(email.Cc) != 1 || email.Cc[0].Address != "carol@example.net" {
+				t.Errorf("queued email Cc %v, want carol", email.Cc)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package email
+
+import (
+	"errors"
+	"fmt"
+	"net/textproto"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Persists the addresses outbound emails should never be delivered to.
+// Addresses are normalized to lowercase before being passed to the store.
+type SuppressionStore interface {
+	Get(address string) (*Suppression, error) // Returns nil if the address is not suppressed
+	Put(entry Suppression) error              // Creates or replaces the entry for an address
+	Delete(address string) error              // Removes the entry for an address, if any
+	List() ([]Suppression, error)             // Returns all entries sorted by address
+}
+
+// In-memory Suppression Store, entries are lost when the process exits
+type MemorySuppressionStore struct {
+	mu      sync.RWMutex
+	entries map[string]Suppression
+}
+
+// Create an empty in-memory Suppression Store
+func NewMemorySuppressionStore() *MemorySuppressionStore {
+	return &MemorySuppressionStore{entries: make(map[string]Suppression)}
+}
+
+func (s *MemorySuppressionStore) Get(address string) (*Suppression, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if entry, ok := s.entries[address]; ok {
+		return &entry, nil
+	}
+	return nil, nil
+}
+
+func (s *MemorySuppressionStore) Put(entry Suppression) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[entry.Address] = entry
+	return nil
+}
+
+func (s *MemorySuppressionStore) Delete(address string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, address)
+	return nil
+}
+
+func (s *MemorySuppressionStore) List() ([]Suppression, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]Suppression, 0, len(s.entries))
+	for _, entry := range s.entries {
+		list = append(list, entry)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Address < list[j].Address
+	})
+	return list, nil
+}
+
+// File-backed Suppression Store, the entire list is kept in memory and
+// rewritten to disk as JSON after every change
+type FileSuppressionStore struct {
+	MemorySuppressionStore
+	path string
+}
+
+// Open or create a file-backed Suppression Store at the given path
+func NewFileSuppressionStore(path string) (*FileSuppressionStore, error) {
+	s := &FileSuppressionStore{
+		MemorySuppressionStore: MemorySuppressionStore{entries: make(map[string]Suppression)},
+		path:                   path,
+	}
+	if err := readJSONFile(path, &s.entries); err != nil {
+		return nil, fmt.Errorf("cannot read suppression store: %s", err)
+	}
+	return s, nil
+}
+
+func (s *FileSuppressionStore) Put(entry Suppression) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[entry.Address] = entry
+	return writeJSONFile(s.path, s.entries)
+}
+
+func (s *FileSuppressionStore) Delete(address string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, address)
+	return writeJSONFile(s.path, s.entries)
+}
+
+// Add an address to the suppression list, outbound emails will no longer be delivered to it
+func (e *Engine) Suppress(address string, reason SuppressionReason) error {
+	return e.Suppressions.Put(Suppression{
+		Address: strings.ToLower(address),
+		Reason:  reason,
+		Created: time.Now().UTC(),
+	})
+}
+
+// Remove an address from the suppression list
+func (e *Engine) Unsuppress(address string) error {
+	return e.Suppressions.Delete(strings.ToLower(address))
+}
+
+// Returns the suppression list entry for an address or nil if it is not suppressed
+func (e *Engine) Suppressed(address string) (*Suppression, error) {
+	return e.Suppressions.Get(strings.ToLower(address))
+}
+
+// Register an Inbox which adds the sender of any email it receives to the
+// suppression list. Outbound emails will include a List-Unsubscribe header
+// pointing to this inbox. The 'From' header is easily forged, so only emails
+// which passed DMARC or carry a passing DKIM signature aligned with it are accepted.
+func (e *Engine) RegisterUnsubscribeInbox(username string) error {
+	err := e.RegisterInbox(username, func(em *Email) error {
+		if !em.Authentication.AuthenticatedFrom(em.From.Address) {
+			return Reject("Unsubscribe requests must be sent from an authenticated address")
+		}
+		return e.Suppress(em.From.Address, SuppressionUnsubscribe)
+	})
+	if err != nil {
+		return err
+	}
+	e.outgoingLock.Lock()
+	defer e.outgoingLock.Unlock()
+	e.outgoingUnsubscribe = fmt.Sprint(username, "@", e.Domain)
+	return nil
+}
+
+// Determines if a delivery error means the mailbox does not exist and
+// will never accept mail (e.g. "550 5.1.1 User unknown")
+func isHardBounce(err error) bool {
+	var reply *textproto.Error
+	if !errors.As(err, &reply) {
+		return false
+	}
+	switch reply.Code {
+	case 550, 551, 553:
+	default:
+		return false
+	}
+	// Policy rejections (e.g. 550 5.7.1) share reply codes with unknown mailboxes,
+	// so when an enhanced status code is present only trust addressing failures
+	enhanced, _, _ := strings.Cut(reply.Msg, " ")
+	if !strings.HasPrefix(enhanced, "5.") {
+		return true
+	}
+	return strings.HasPrefix(enhanced, "5.1.") || enhanced == "5.2.1"
+}
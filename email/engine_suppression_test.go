@@ -0,0 +1,253 @@
+package email
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestIsHardBounce(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "unknown user", err: &textproto.Error{Code: 550, Msg: "5.1.1 User unknown"}, want: true},
+		{name: "bad destination system", err: &textproto.Error{Code: 550, Msg: "5.1.2 Host unknown"}, want: true},
+		{name: "disabled mailbox", err: &textproto.Error{Code: 550, Msg: "5.2.1 Mailbox disabled"}, want: true},
+		{name: "user not local", err: &textproto.Error{Code: 551, Msg: "5.1.6 User has moved"}, want: true},
+		{name: "bad mailbox syntax", err: &textproto.Error{Code: 553, Msg: "5.1.3 Bad address syntax"}, want: true},
+		{name: "no enhanced code", err: &textproto.Error{Code: 550, Msg: "No such user here"}, want: true},
+		{name: "policy rejection", err: &textproto.Error{Code: 550, Msg: "5.7.1 Message rejected as spam"}, want: false},
+		{name: "mailbox full", err: &textproto.Error{Code: 552, Msg: "5.2.2 Mailbox full"}, want: false},
+		{name: "mailbox busy", err: &textproto.Error{Code: 450, Msg: "4.2.1 Mailbox busy"}, want: false},
+		{name: "temporary failure", err: &textproto.Error{Code: 451, Msg: "4.3.0 Try again later"}, want: false},
+		{name: "transaction failed", err: &textproto.Error{Code: 554, Msg: "5.0.0 Transaction failed"}, want: false},
+		{name: "wrapped", err: fmt.Errorf("cannot deliver: %w", &textproto.Error{Code: 550, Msg: "5.1.1 User unknown"}), want: true},
+		{name: "network error", err: errors.New("connection refused"), want: false},
+		{name: "nil", err: nil, want: false},
+	}
+	for _, tt := range tests {
+		if got := isHardBounce(tt.err); got != tt.want {
+			t.Errorf("%s: isHardBounce(%v) = %t, want %t", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestSuppressionStores(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "suppressions.json")
+	file, err := NewFileSuppressionStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stores := map[string]SuppressionStore{"memory": NewMemorySuppressionStore(), "file": file}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			for _, address := range []string{"b@example.net", "a@example.net", "c@example.net"} {
+				if err := store.Put(Suppression{Address: address, Reason: SuppressionManual}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := store.Put(Suppression{Address: "a@example.net", Reason: SuppressionHardBounce}); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.Delete("c@example.net"); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.Delete("unknown@example.net"); err != nil {
+				t.Errorf("Delete() of an unknown address = %s, want nil", err)
+			}
+			list, err := store.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(list) != 2 || list[0].Address != "a@example.net" || list[1].Address != "b@example.net" {
+				t.Fatalf("List() = %v, want a@example.net and b@example.net", list)
+			}
+			if entry, err := store.Get("a@example.net"); err != nil || entry == nil || entry.Reason != SuppressionHardBounce {
+				t.Errorf("Get(a@example.net) = %v, %v, want the replaced entry", entry, err)
+			}
+			if entry, err := store.Get("c@example.net"); err != nil || entry != nil {
+				t.Errorf("Get(c@example.net) = %v, %v, want nil", entry, err)
+			}
+		})
+	}
+
+	// Reopen File Store
+	reopened, err := NewFileSuppressionStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list, err := reopened.List(); err != nil || len(list) != 2 {
+		t.Errorf("List() after reopening = %v, %v, want the 2 stored entries", list, err)
+	}
+}
+
+func TestSuppressNormalizesCase(t *testing.T) {
+	e := New("example.org")
+	if err := e.Suppress("User@Example.NET", SuppressionManual); err != nil {
+		t.Fatal(err)
+	}
+	if entry, err := e.Suppressed("user@example.net"); err != nil || entry == nil {
+		t.Fatalf("Suppressed() = %v, %v, want the entry", entry, err)
+	}
+	if err := e.Unsuppress("USER@example.net"); err != nil {
+		t.Fatal(err)
+	}
+	if entry, _ := e.Suppressed("user@example.net"); entry != nil {
+		t.Errorf("Suppressed() after Unsuppress() = %v, want nil", entry)
+	}
+}
+
+func TestSendEmailSuppressed(t *testing.T) {
+	e := New("example.org")
+	receiver := testReceiver(t, &e, "example.net")
+	var received atomic.Int32
+	if err := receiver.RegisterInbox("kept", func(em *Email) error {
+		received.Add(1)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	var eventLock sync.Mutex
+	events := map[string]DeliveryStatus{}
+	e.OnDeliveryEvent(func(event DeliveryEvent) {
+		eventLock.Lock()
+		defer eventLock.Unlock()
+		events[event.Recipient] = event.Status
+	})
+	if err := e.Suppress("skipped@example.net", SuppressionUnsubscribe); err != nil {
+		t.Fatal(err)
+	}
+
+	err := e.SendEmail(&Email{
+		From:    Address{Address: "noreply@example.org"},
+		To:      []Address{{Address: "skipped@example.net"}, {Address: "kept@example.net"}},
+		Subject: "Hello",
+		Content: "Hello World",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := received.Load(); n != 1 {
+		t.Errorf("receiver got %d emails, want only the one of the kept recipient", n)
+	}
+	eventLock.Lock()
+	defer eventLock.Unlock()
+	if events["skipped@example.net"] != DeliverySuppressed {
+		t.Errorf("event for the suppressed recipient = %q, want %q", events["skipped@example.net"], DeliverySuppressed)
+	}
+	if events["kept@example.net"] != DeliveryDelivered {
+		t.Errorf("event for the kept recipient = %q, want %q", events["kept@example.net"], DeliveryDelivered)
+	}
+}
+
+func TestSendEmailHardBounce(t *testing.T) {
+	e := New("example.org")
+	testReceiver(t, &e, "example.net")
+	var statuses []DeliveryStatus
+	e.OnDeliveryEvent(func(event DeliveryEvent) {
+		statuses = append(statuses, event.Status)
+	})
+	email := &Email{
+		From:    Address{Address: "noreply@example.org"},
+		To:      []Address{{Address: "unknown@example.net"}},
+		Subject: "Hello",
+		Content: "Hello World",
+	}
+
+	if err := e.SendEmail(email); !isHardBounce(err) {
+		t.Fatalf("SendEmail() = %v, want a hard bounce", err)
+	}
+	entry, err := e.Suppressed("unknown@example.net")
+	if err != nil || entry == nil || entry.Reason != SuppressionHardBounce {
+		t.Fatalf("Suppressed() = %v, %v, want a hard bounce entry", entry, err)
+	}
+	if err := e.SendEmail(email); err != nil {
+		t.Fatalf("SendEmail() to a suppressed address = %s, want nil", err)
+	}
+	if !slices.Equal(statuses, []DeliveryStatus{DeliveryBounced, DeliverySuppressed}) {
+		t.Errorf("events = %q, want a bounce then a suppression", statuses)
+	}
+}
+
+func TestSuppressionsAPI(t *testing.T) {
+	e := New("example.org")
+	e.AuthHandler = func(r *http.Request) bool { return true }
+	handler := e.Handler()
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		if body != "" {
+			r.Header.Set("Content-Type", "application/json")
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := do(http.MethodPost, "/suppressions", `[{"address":"User@Example.net","reason":"manual"}]`); w.Code != http.StatusCreated {
+		t.Fatalf("POST /suppressions = %d, want %d", w.Code, http.StatusCreated)
+	}
+	if w := do(http.MethodPost, "/suppressions", `[{"address":"user@example.net","reason":"bored"}]`); w.Code != http.StatusBadRequest {
+		t.Errorf("POST /suppressions with an unknown reason = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	w := do(http.MethodGet, "/suppressions", "")
+	var list []Suppression
+	if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Address != "user@example.net" || list[0].Reason != SuppressionManual {
+		t.Fatalf("GET /suppressions = %v, want the lowercased entry", list)
+	}
+	if w := do(http.MethodDelete, "/suppressions/user@example.net", ""); w.Code != http.StatusNoContent {
+		t.Errorf("DELETE /suppressions/{address} = %d, want %d", w.Code, http.StatusNoContent)
+	}
+	if w := do(http.MethodDelete, "/suppressions/user@example.net", ""); w.Code != http.StatusNotFound {
+		t.Errorf("DELETE /suppressions/{address} twice = %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	e.AuthHandler = func(r *http.Request) bool { return false }
+	if w := do(http.MethodGet, "/suppressions", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("GET /suppressions without authorization = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestUnsubscribeInbox(t *testing.T) {
+	e := New("example.org")
+	if err := e.RegisterUnsubscribeInbox("unsubscribe"); err != nil {
+		t.Fatal(err)
+	}
+	handler, _ := e.lookupInbox("unsubscribe@example.org")
+	if handler == nil {
+		t.Fatal("lookupInbox() found no unsubscribe inbox")
+	}
+	from := Address{Address: "User@Example.net"}
+
+	err := handler(&Email{From: from})
+	var rejection *Rejection
+	if !errors.As(err, &rejection) {
+		t.Fatalf("unauthenticated request = %v, want a rejection", err)
+	}
+	if entry, _ := e.Suppressed(from.Address); entry != nil {
+		t.Fatalf("unauthenticated request suppressed %s", from.Address)
+	}
+
+	err = handler(&Email{From: from, Authentication: &Authentication{
+		DMARC: &AuthenticationDMARC{Result: DMARCPass, Domain: "example.net"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry, _ := e.Suppressed(from.Address); entry == nil || entry.Reason != SuppressionUnsubscribe {
+		t.Errorf("Suppressed() = %v, want an unsubscribe entry", entry)
+	}
+}
@@ -0,0 +1,597 @@
+package email
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+	"text/template/parse"
+)
+
+// A version of a template with its parts parsed. The parsed parts are never executed,
+// they are cloned for every locale so template functions know the locale they render for.
+type compiledTemplate struct {
+	source     Template
+	layout     string            // Source of the layout when the version was created
+	partials   map[string]string // Sources of the partials when the version was created
+	subject    *texttemplate.Template
+	text       *texttemplate.Template
+	html       *htmltemplate.Template
+	funcs      func(locale string) map[string]any
+	localeLock sync.Mutex
+	locales    map[string]*localizedTemplate
+}
+
+// The parts of a template version bound to a locale
+type localizedTemplate struct {
+	subject *texttemplate.Template
+	text    *texttemplate.Template
+	html    *htmltemplate.Template
+}
+
+// Templates are registered once for every locale they are translated to
+type templateKey struct {
+	name   string
+	locale string
+}
+
+// Every version of a template variant, versions are immutable once created
+type templateEntry struct {
+	versions  []*compiledTemplate // Version N is stored at index N-1
+	published int                 // Version which is sent, 0 if none
+	history   []int               // Previously published versions, most recent last
+}
+
+// Register a Template as a new version of its locale variant and publish it. All parts
+// are parsed immediately so syntax errors are returned here instead of when sending.
+func (e *Engine) RegisterTemplate(t Template) error {
+	_, err := e.addTemplateVersion(t, true, nil)
+	return err
+}
+
+// Register a Template as a new version without publishing it, returning its version
+func (e *Engine) DraftTemplate(t Template) (int, error) {
+	return e.addTemplateVersion(t, false, nil)
+}
+
+// Create a new version of a template, check is run against the parsed version
+// before anything is stored
+func (e *Engine) addTemplateVersion(t Template, publish bool, check func(c *compiledTemplate) error) (int, error) {
+	locale, err := e.canonicalLocale(t.Locale)
+	if err != nil {
+		return 0, err
+	}
+	t.Locale = locale
+	key := templateKey{t.Name, locale}
+	e.templateLock.Lock()
+	defer e.templateLock.Unlock()
+	entry := e.templates[key]
+	if entry == nil {
+		entry = &templateEntry{}
+	}
+	t.Version = len(entry.versions) + 1
+	t.Published = false
+	compiled, err := e.compileTemplate(t, e.templateLayouts, e.templatePartials)
+	if err != nil {
+		return 0, err
+	}
+	if check != nil {
+		if err := check(compiled); err != nil {
+			return 0, err
+		}
+	}
+	entry.versions = append(entry.versions, compiled)
+	e.templates[key] = entry
+	if publish {
+		entry.publish(t.Version)
+	}
+	return t.Version, nil
+}
+
+// Returns the variant of a template for a locale, the caller must hold templateLock
+func (e *Engine) templateVariant(name, locale string) (*templateEntry, error) {
+	locale, err := e.canonicalLocale(locale)
+	if err != nil {
+		return nil, err
+	}
+	entry := e.templates[templateKey{name, locale}]
+	if entry == nil {
+		return nil, fmt.Errorf("no template exists with that name and locale: %s (%s)", name, locale)
+	}
+	return entry, nil
+}
+
+// Publish a version of a template variant, emails rendered afterwards use it.
+// An empty locale refers to the variant of the template locale.
+func (e *Engine) PublishTemplate(name, locale string, version int) error {
+	e.templateLock.Lock()
+	defer e.templateLock.Unlock()
+	entry, err := e.templateVariant(name, locale)
+	if err != nil {
+		return err
+	}
+	if version < 1 || version > len(entry.versions) {
+		return fmt.Errorf("template '%s' has no version %d", name, version)
+	}
+	entry.publish(version)
+	return nil
+}
+
+// Publish the version of a template variant which was published before the
+// current one, returning the version which is now published
+func (e *Engine) RollbackTemplate(name, locale string) (int, error) {
+	e.templateLock.Lock()
+	defer e.templateLock.Unlock()
+	entry, err := e.templateVariant(name, locale)
+	if err != nil {
+		return 0, err
+	}
+	if len(entry.history) == 0 {
+		return 0, fmt.Errorf("template '%s' has no previously published version", name)
+	}
+	entry.published = entry.history[len(entry.history)-1]
+	entry.history = entry.history[:len(entry.history)-1]
+	return entry.published, nil
+}
+
+func (entry *templateEntry) publish(version int) {
+	if entry.published == version {
+		return
+	}
+	if entry.published != 0 {
+		entry.history = append(entry.history, entry.published)
+	}
+	entry.published = version
+}
+
+// Remove a Template registered with RegisterTemplate, including every version of all its variants
+func (e *Engine) UnregisterTemplate(name string) error {
+	e.templateLock.Lock()
+	defer e.templateLock.Unlock()
+	removed := false
+	for key := range e.templates {
+		if key.name == name {
+			delete(e.templates, key)
+			removed = true
+		}
+	}
+	if !removed {
+		return fmt.Errorf("no template exists with that name: %s", name)
+	}
+	return nil
+}
+
+// Returns a summary of every variant of the registered Templates, sorted by name and locale
+func (e *Engine) Templates() []TemplateSummary {
+	e.templateLock.RLock()
+	defer e.templateLock.RUnlock()
+	summaries := make([]TemplateSummary, 0, len(e.templates))
+	for key, entry := range e.templates {
+		summaries = append(summaries, TemplateSummary{
+			Name:      key.name,
+			Locale:    key.locale,
+			Published: entry.published,
+			Latest:    len(entry.versions),
+		})
+	}
+	slices.SortFunc(summaries, func(a, b TemplateSummary) int {
+		if c := strings.Compare(a.Name, b.Name); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Locale, b.Locale)
+	})
+	return summaries
+}
+
+// Returns every version of a Template variant, oldest first
+func (e *Engine) TemplateVersions(name, locale string) ([]Template, error) {
+	e.templateLock.RLock()
+	defer e.templateLock.RUnlock()
+	entry, err := e.templateVariant(name, locale)
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]Template, len(entry.versions))
+	for i, compiled := range entry.versions {
+		versions[i] = compiled.source
+		versions[i].Published = compiled.source.Version == entry.published
+	}
+	return versions, nil
+}
+
+// Returns a version of the template variant which best matches a locale, or the
+// published version if version is 0. Variants are tried along the fallback chain
+// of the locale (e.g. 'pt-BR', 'pt', then the template locale), skipping variants
+// without a published version when version is 0.
+func (e *Engine) lookupTemplate(name, locale string, version int) (*compiledTemplate, error) {
+	e.templateLock.RLock()
+	defer e.templateLock.RUnlock()
+	found := false
+	for _, candidate := range e.localeChain(locale) {
+		entry := e.templates[templateKey{name, candidate}]
+		if entry == nil {
+			continue
+		}
+		found = true
+		if version == 0 {
+			if entry.published == 0 {
+				continue
+			}
+			return entry.versions[entry.published-1], nil
+		}
+		if version < 1 || version > len(entry.versions) {
+			return nil, fmt.Errorf("template '%s' (%s) has no version %d", name, candidate, version)
+		}
+		return entry.versions[version-1], nil
+	}
+	if found {
+		return nil, fmt.Errorf("template '%s' has no published version for locale '%s'", name, locale)
+	}
+	return nil, fmt.Errorf("no template exists with that name: %s", name)
+}
+
+// Render the published version of a Template into an Email without recipients,
+// using the variant which best matches the locale (empty for the template locale).
+// Locals are available to every part of the template, missing map keys are treated as errors.
+func (e *Engine) RenderTemplate(name, locale string, locals any) (*Email, error) {
+	locale, err := e.canonicalLocale(locale)
+	if err != nil {
+		return nil, err
+	}
+	compiled, err := e.lookupTemplate(name, locale, 0)
+	if err != nil {
+		return nil, err
+	}
+	return compiled.render(locale, locals)
+}
+
+// Render the published version of a Template and queue it for the given recipients,
+// returning the IDs of the queued emails. Recipients are grouped by their locale
+// and every group is sent its own email, all emails are rendered before any are queued.
+// If the queue fills up partway through an error is returned along with the IDs of
+// the emails which were already queued, those emails are still sent.
+func (e *Engine) SendTemplate(name string, to []Address, locals any) ([]string, error) {
+	emails, err := e.renderTemplateFor(name, to, locals)
+	if err != nil {
+		return nil, err
+	}
+	queued := make([]string, 0, len(emails))
+	for _, email := range emails {
+		if !e.QueueEmail(email) {
+			return queued, fmt.Errorf("email queue is full")
+		}
+		queued = append(queued, email.ID)
+	}
+	return queued, nil
+}
+
+// Render a Template once for every locale of the recipients, in the order the
+// locales first appear
+func (e *Engine) renderTemplateFor(name string, to []Address, locals any) ([]*Email, error) {
+	if len(to) == 0 {
+		return nil, fmt.Errorf("outbound email contains no recipients")
+	}
+	var emails []*Email
+	groups := make(map[string]*Email)
+	for _, recipient := range to {
+		locale, err := e.canonicalLocale(recipient.Locale)
+		if err != nil {
+			return nil, err
+		}
+		email, exists := groups[locale]
+		if !exists {
+			if email, err = e.RenderTemplate(name, locale, locals); err != nil {
+				return nil, err
+			}
+			groups[locale] = email
+			emails = append(emails, email)
+		}
+		email.To = append(email.To, recipient)
+	}
+	return emails, nil
+}
+
+// Render a version of a Template, or the published version if version is 0,
+// without queueing it. The variant is selected by locale like it would be for a
+// recipient, stylesheets are inlined like they would be when sending and the MIME
+// is addressed to the template sender.
+func (e *Engine) PreviewTemplate(name, locale string, version int, locals any) (*TemplatePreview, error) {
+	locale, err := e.canonicalLocale(locale)
+	if err != nil {
+		return nil, err
+	}
+	compiled, err := e.lookupTemplate(name, locale, version)
+	if err != nil {
+		return nil, err
+	}
+	email, err := compiled.render(locale, locals)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.inlineOutgoingCSS(email); err != nil {
+		return nil, err
+	}
+	mime, err := e.buildEnvelope(email, email.From)
+	if err != nil {
+		return nil, err
+	}
+	preview := &TemplatePreview{Subject: email.Subject, MIME: string(mime)}
+	if email.HTML {
+		preview.HTML, preview.Text = email.Content, email.Text
+	} else {
+		preview.Text = email.Content
+	}
+	return preview, nil
+}
+
+// A registered Template which only accepts locals of type L
+type TypedTemplate[L any] struct {
+	engine *Engine
+	name   string
+}
+
+// Register a Template whose locals are of type L, returning a handle for rendering
+// and sending it. If L is a struct the template is rendered with its zero value
+// so references to fields or messages which do not exist are caught during registration.
+// Every variant of the template is registered using the same type.
+func RegisterTypedTemplate[L any](e *Engine, t Template) (TypedTemplate[L], error) {
+	var zero L
+	var check func(c *compiledTemplate) error
+	if reflect.TypeOf(zero) != nil && reflect.TypeOf(zero).Kind() == reflect.Struct {
+		check = func(c *compiledTemplate) error {
+			_, err := c.render(c.source.Locale, zero)
+			return err
+		}
+	}
+	if _, err := e.addTemplateVersion(t, true, check); err != nil {
+		return TypedTemplate[L]{}, err
+	}
+	return TypedTemplate[L]{engine: e, name: t.Name}, nil
+}
+
+// Render the template for a locale into an Email without recipients
+func (t TypedTemplate[L]) Render(locale string, locals L) (*Email, error) {
+	return t.engine.RenderTemplate(t.name, locale, locals)
+}
+
+// Render the template and queue it for the given recipients, returning the IDs of the queued emails
+func (t TypedTemplate[L]) Send(to []Address, locals L) ([]string, error) {
+	return t.engine.SendTemplate(t.name, to, locals)
+}
+
+// Register a shared Layout which templates wrap their HTML with by setting
+// Template.Layout, the HTML is rendered where the layout uses {{block "content" .}}{{end}}.
+// Replacing a layout only affects template versions created afterwards.
+func (e *Engine) RegisterLayout(name, html string) error {
+	return e.updateFragment(e.templateLayouts, name, &html)
+}
+
+// Register a shared Partial which the HTML and layout of any template may
+// render using {{template "name" .}}. Replacing a partial only affects template
+// versions created afterwards.
+func (e *Engine) RegisterPartial(name, html string) error {
+	if name == "content" || name == "layout" {
+		return fmt.Errorf("partial name is reserved: %s", name)
+	}
+	return e.updateFragment(e.templatePartials, name, &html)
+}
+
+// Remove a Layout registered with RegisterLayout, existing template versions keep rendering with it
+func (e *Engine) UnregisterLayout(name string) error {
+	return e.updateFragment(e.templateLayouts, name, nil)
+}
+
+// Remove a Partial registered with RegisterPartial, existing template versions keep rendering with it
+func (e *Engine) UnregisterPartial(name string) error {
+	return e.updateFragment(e.templatePartials, name, nil)
+}
+
+// Returns the registered Layouts, sorted by name
+func (e *Engine) Layouts() []TemplateFragment {
+	e.templateLock.RLock()
+	defer e.templateLock.RUnlock()
+	return listFragments(e.templateLayouts)
+}
+
+// Returns the registered Partials, sorted by name
+func (e *Engine) Partials() []TemplateFragment {
+	e.templateLock.RLock()
+	defer e.templateLock.RUnlock()
+	return listFragments(e.templatePartials)
+}
+
+func listFragments(fragments map[string]string) []TemplateFragment {
+	list := make([]TemplateFragment, 0, len(fragments))
+	for name, html := range fragments {
+		list = append(list, TemplateFragment{Name: name, HTML: html})
+	}
+	slices.SortFunc(list, func(a, b TemplateFragment) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return list
+}
+
+// Replace or remove (if html is nil) a layout or partial. Template versions are
+// compiled against the fragments at the time they were created, so none are rebuilt.
+func (e *Engine) updateFragment(fragments map[string]string, name string, html *string) error {
+	if name == "" {
+		return fmt.Errorf("fragment requires a name")
+	}
+	if html != nil {
+		if _, err := htmltemplate.New(name).Parse(*html); err != nil {
+			return fmt.Errorf("cannot parse fragment '%s': %s", name, err)
+		}
+	}
+	e.templateLock.Lock()
+	defer e.templateLock.Unlock()
+	if html == nil {
+		if _, exists := fragments[name]; !exists {
+			return fmt.Errorf("no fragment exists with that name: %s", name)
+		}
+		delete(fragments, name)
+		return nil
+	}
+	fragments[name] = *html
+	return nil
+}
+
+// Parse every part of a template using the given layouts and partials, keeping a
+// copy of the ones it uses. The HTML part is parsed as the 'content' template, so it
+// may either be a plain body or define blocks (e.g. {{define "content"}}) which the layout renders.
+func (e *Engine) compileTemplate(t Template, layouts, partials map[string]string) (*compiledTemplate, error) {
+	if t.Name == "" {
+		return nil, fmt.Errorf("template requires a name")
+	}
+	if t.HTML == "" && t.Text == "" {
+		return nil, fmt.Errorf("template '%s' requires html or text content", t.Name)
+	}
+	compiled := &compiledTemplate{
+		source:  t,
+		funcs:   e.templateFuncs,
+		locales: make(map[string]*localizedTemplate),
+	}
+	funcs := e.templateFuncs(t.Locale)
+	var err error
+	if compiled.subject, err = texttemplate.New("subject").Funcs(funcs).Option("missingkey=error").Parse(t.Subject); err != nil {
+		return nil, fmt.Errorf("cannot parse subject of template '%s': %s", t.Name, err)
+	}
+	if t.Text != "" {
+		if compiled.text, err = texttemplate.New("text").Funcs(funcs).Option("missingkey=error").Parse(t.Text); err != nil {
+			return nil, fmt.Errorf("cannot parse text of template '%s': %s", t.Name, err)
+		}
+	}
+	if t.HTML != "" {
+		root := htmltemplate.New("content").Funcs(funcs).Option("missingkey=error")
+		content := root
+		if t.Layout != "" {
+			layout, exists := layouts[t.Layout]
+			if !exists {
+				return nil, fmt.Errorf("no layout exists with that name: %s", t.Layout)
+			}
+			root = htmltemplate.New("layout").Funcs(funcs).Option("missingkey=error")
+			if _, err := root.Parse(layout); err != nil {
+				return nil, fmt.Errorf("cannot parse layout '%s': %s", t.Layout, err)
+			}
+			content = root.New("content")
+			compiled.layout = layout
+		}
+		compiled.partials = maps.Clone(partials)
+		for name, partial := range partials {
+			if _, err := root.New(name).Parse(partial); err != nil {
+				return nil, fmt.Errorf("cannot parse partial '%s': %s", name, err)
+			}
+		}
+		if _, err := content.Parse(t.HTML); err != nil {
+			return nil, fmt.Errorf("cannot parse html of template '%s': %s", t.Name, err)
+		}
+
+		// Check Template References
+		// 	Includes are only resolved when executed, so a missing partial would
+		// 	otherwise go unnoticed until the template is sent
+		for _, defined := range root.Templates() {
+			if defined.Tree == nil {
+				continue
+			}
+			for _, name := range templateReferences(defined.Tree.Root) {
+				if root.Lookup(name) == nil {
+					return nil, fmt.Errorf("template '%s' includes an unknown partial: %s", t.Name, name)
+				}
+			}
+		}
+		compiled.html = root
+	}
+	return compiled, nil
+}
+
+// Returns the names of the templates included by a parsed node using {{template}}
+func templateReferences(node parse.Node) []string {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return nil
+		}
+		var names []string
+		for _, child := range n.Nodes {
+			names = append(names, templateReferences(child)...)
+		}
+		return names
+	case *parse.IfNode:
+		return append(templateReferences(n.List), templateReferences(n.ElseList)...)
+	case *parse.RangeNode:
+		return append(templateReferences(n.List), templateReferences(n.ElseList)...)
+	case *parse.WithNode:
+		return append(templateReferences(n.List), templateReferences(n.ElseList)...)
+	case *parse.TemplateNode:
+		return []string{n.Name}
+	}
+	return nil
+}
+
+// Returns the parts of a template bound to a locale, cloned once per locale
+func (c *compiledTemplate) localize(locale string) (*localizedTemplate, error) {
+	c.localeLock.Lock()
+	defer c.localeLock.Unlock()
+	if l, exists := c.locales[locale]; exists {
+		return l, nil
+	}
+	funcs := c.funcs(locale)
+	l := &localizedTemplate{}
+	var err error
+	if l.subject, err = c.subject.Clone(); err != nil {
+		return nil, err
+	}
+	l.subject.Funcs(funcs)
+	if c.text != nil {
+		if l.text, err = c.text.Clone(); err != nil {
+			return nil, err
+		}
+		l.text.Funcs(funcs)
+	}
+	if c.html != nil {
+		if l.html, err = c.html.Clone(); err != nil {
+			return nil, err
+		}
+		l.html.Funcs(funcs)
+	}
+	c.locales[locale] = l
+	return l, nil
+}
+
+// Execute every part of a template for a locale
+func (c *compiledTemplate) render(locale string, locals any) (*Email, error) {
+	l, err := c.localize(locale)
+	if err != nil {
+		return nil, fmt.Errorf("cannot prepare template '%s' for locale '%s': %s", c.source.Name, locale, err)
+	}
+	email := &Email{
+		From:        c.source.From,
+		Attachments: slices.Clone(c.source.Attachments),
+	}
+	var output bytes.Buffer
+	if err := l.subject.Execute(&output, locals); err != nil {
+		return nil, fmt.Errorf("cannot render subject of template '%s': %s", c.source.Name, err)
+	}
+	email.Subject = output.String()
+	if l.text != nil {
+		output.Reset()
+		if err := l.text.Execute(&output, locals); err != nil {
+			return nil, fmt.Errorf("cannot render text of template '%s': %s", c.source.Name, err)
+		}
+		email.Content = output.String()
+	}
+	if l.html != nil {
+		output.Reset()
+		if err := l.html.Execute(&output, locals); err != nil {
+			return nil, fmt.Errorf("cannot render html of template '%s': %s", c.source.Name, err)
+		}
+		email.Text = email.Content
+		email.Content = output.String()
+		email.HTML = true
+	}
+	return email, nil
+}
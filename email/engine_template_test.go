@@ -0,0 +1,268 @@
+package email
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Returns a template sending the given subject
+func testTemplate(subject string) Template {
+	return Template{
+		Name:    "welcome",
+		From:    Address{Name: "Example", Address: "noreply@example.org"},
+		Subject: subject,
+		HTML:    "<p>Hello {{.Name}}</p>",
+		Text:    "Hello {{.Name}}",
+	}
+}
+
+// Returns the subject of the published version of the welcome template
+func testPublishedSubject(t *testing.T, e *Engine) string {
+	t.Helper()
+	email, err := e.RenderTemplate("welcome", "", map[string]string{"Name": "Alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return email.Subject
+}
+
+func TestTemplatePublishing(t *testing.T) {
+	e := New("example.org")
+	if err := e.RegisterTemplate(testTemplate("v1")); err != nil {
+		t.Fatal(err)
+	}
+	version, err := e.DraftTemplate(testTemplate("v2"))
+	if err != nil || version != 2 {
+		t.Fatalf("DraftTemplate() = %d, %v, want version 2", version, err)
+	}
+	if got := testPublishedSubject(t, &e); got != "v1" {
+		t.Errorf("draft was published, rendered %q, want v1", got)
+	}
+	if err := e.PublishTemplate("welcome", "", 2); err != nil {
+		t.Fatal(err)
+	}
+	if got := testPublishedSubject(t, &e); got != "v2" {
+		t.Errorf("rendered %q after publishing, want v2", got)
+	}
+	if err := e.PublishTemplate("welcome", "", 3); err == nil {
+		t.Error("PublishTemplate() of a missing version succeeded")
+	}
+	if err := e.PublishTemplate("welcome", "fr", 1); err == nil {
+		t.Error("PublishTemplate() of a missing variant succeeded")
+	}
+
+	// Check History
+	versions, err := e.TemplateVersions("welcome", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[0].Published || !versions[1].Published || versions[1].Version != 2 || versions[1].Subject != "v2" {
+		t.Errorf("TemplateVersions() = %+v, want versions 1 and 2 with 2 published", versions)
+	}
+	summaries := e.Templates()
+	if len(summaries) != 1 || summaries[0].Published != 2 || summaries[0].Latest != 2 {
+		t.Errorf("Templates() = %+v, want version 2 of 2 published", summaries)
+	}
+}
+
+func TestTemplateRollback(t *testing.T) {
+	e := New("example.org")
+	for _, subject := range []string{"v1", "v2", "v3"} {
+		if err := e.RegisterTemplate(testTemplate(subject)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := e.PublishTemplate("welcome", "", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.PublishTemplate("welcome", "", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Published: 1, 2, 3, then 1 again which is only recorded once
+	for _, want := range []int{3, 2, 1} {
+		version, err := e.RollbackTemplate("welcome", "")
+		if err != nil || version != want {
+			t.Fatalf("RollbackTemplate() = %d, %v, want %d", version, err, want)
+		}
+	}
+	if got := testPublishedSubject(t, &e); got != "v1" {
+		t.Errorf("rendered %q after rolling back, want v1", got)
+	}
+	if _, err := e.RollbackTemplate("welcome", ""); err == nil {
+		t.Error("RollbackTemplate() without history succeeded")
+	}
+}
+
+func TestTemplateFragmentSnapshot(t *testing.T) {
+	e := New("example.org")
+	if err := e.RegisterLayout("main", `<div class="a">{{block "content" .}}{{end}}</div>`); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.RegisterPartial("footer", "<p>Footer A</p>"); err != nil {
+		t.Fatal(err)
+	}
+	template := testTemplate("Hello")
+	template.Layout = "main"
+	template.HTML = `<p>Hello {{.Name}}</p>{{template "footer"}}`
+	if err := e.RegisterTemplate(template); err != nil {
+		t.Fatal(err)
+	}
+	render := func() string {
+		t.Helper()
+		email, err := e.RenderTemplate("welcome", "", map[string]string{"Name": "Alice"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return email.Content
+	}
+	first := `<div class="a"><p>Hello Alice</p><p>Footer A</p></div>`
+	if got := render(); got != first {
+		t.Fatalf("rendered %q, want %q", got, first)
+	}
+
+	// Replace Fragments
+	// 	The published version keeps the fragments it was created with
+	if err := e.RegisterLayout("main", `<div class="b">{{block "content" .}}{{end}}</div>`); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.RegisterPartial("footer", "<p>Footer B</p>"); err != nil {
+		t.Fatal(err)
+	}
+	if got := render(); got != first {
+		t.Errorf("rendered %q after replacing the fragments, want %q", got, first)
+	}
+	if err := e.RegisterTemplate(template); err != nil {
+		t.Fatal(err)
+	}
+	second := `<div class="b"><p>Hello Alice</p><p>Footer B</p></div>`
+	if got := render(); got != second {
+		t.Errorf("rendered %q for a new version, want %q", got, second)
+	}
+	if _, err := e.RollbackTemplate("welcome", ""); err != nil {
+		t.Fatal(err)
+	}
+	if got := render(); got != first {
+		t.Errorf("rendered %q after rolling back, want %q", got, first)
+	}
+
+	// Remove Fragments
+	if err := e.UnregisterPartial("footer"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.UnregisterLayout("main"); err != nil {
+		t.Fatal(err)
+	}
+	if got := render(); got != first {
+		t.Errorf("rendered %q after removing the fragments, want %q", got, first)
+	}
+	if err := e.RegisterTemplate(template); err == nil {
+		t.Error("RegisterTemplate() with a removed layout succeeded")
+	}
+	if err := e.UnregisterPartial("footer"); err == nil {
+		t.Error("UnregisterPartial() of a missing partial succeeded")
+	}
+}
+
+func TestPreviewTemplate(t *testing.T) {
+	e := New("example.org")
+	e.OutgoingInlineCSS = true
+	if err := e.RegisterTemplate(testTemplate("Welcome {{.Name}}")); err != nil {
+		t.Fatal(err)
+	}
+	draft := testTemplate("Draft for {{.Name}}")
+	draft.HTML = "<html><head><style>p { color: red; }</style></head><body><p>Hi {{.Name}}</p></body></html>"
+	if _, err := e.DraftTemplate(draft); err != nil {
+		t.Fatal(err)
+	}
+	locals := map[string]string{"Name": "Alice"}
+
+	preview, err := e.PreviewTemplate("welcome", "", 0, locals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if preview.Subject != "Welcome Alice" || preview.HTML != "<p>Hello Alice</p>" || preview.Text != "Hello Alice" {
+		t.Errorf("PreviewTemplate() of the published version = %+v", preview)
+	}
+	if !strings.Contains(preview.MIME, "Subject: Welcome Alice") || !strings.Contains(preview.MIME, "To: \"Example\" <noreply@example.org>") {
+		t.Errorf("preview MIME = %s, want it addressed to the sender", preview.MIME)
+	}
+
+	preview, err = e.PreviewTemplate("welcome", "", 2, locals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if preview.Subject != "Draft for Alice" || !strings.Contains(preview.HTML, `<p style="color: red;">Hi Alice</p>`) {
+		t.Errorf("PreviewTemplate() of the draft = %+v, want its stylesheet inlined", preview)
+	}
+	if got := testPublishedSubject(t, &e); got != "Welcome Alice" {
+		t.Errorf("previewing published the draft, rendered %q", got)
+	}
+
+	if _, err := e.PreviewTemplate("welcome", "", 3, locals); err == nil {
+		t.Error("PreviewTemplate() of a missing version succeeded")
+	}
+	if _, err := e.PreviewTemplate("welcome", "", 1, map[string]string{}); err == nil {
+		t.Error("PreviewTemplate() with a missing local succeeded")
+	}
+}
+
+func TestTemplatesAPI(t *testing.T) {
+	e := New("example.org")
+	e.AuthHandler = func(r *http.Request) bool { return true }
+	e.ErrorLogger = func(err error) {}
+	handler := e.Handler()
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	body := func(subject string) string {
+		b, _ := json.Marshal(testTemplate(subject))
+		return string(b)
+	}
+
+	if w := do(http.MethodPut, "/templates/welcome", body("v1")); w.Code != http.StatusCreated {
+		t.Fatalf("PUT /templates/{name} = %d %s, want %d", w.Code, w.Body, http.StatusCreated)
+	}
+	w := do(http.MethodPut, "/templates/welcome?publish=false", body("v2"))
+	if w.Code != http.StatusCreated || strings.TrimSpace(w.Body.String()) != `{"version":2}` {
+		t.Fatalf("PUT /templates/{name} draft = %d %s, want version 2", w.Code, w.Body)
+	}
+	if got := testPublishedSubject(t, &e); got != "v1" {
+		t.Errorf("draft was published, rendered %q", got)
+	}
+	if w := do(http.MethodPost, "/templates/welcome/publish", `{"version":2}`); w.Code != http.StatusNoContent {
+		t.Errorf("POST /templates/{name}/publish = %d, want %d", w.Code, http.StatusNoContent)
+	}
+	if w := do(http.MethodPost, "/templates/welcome/publish", `{"version":5}`); w.Code != http.StatusNotFound {
+		t.Errorf("POST /templates/{name}/publish of a missing version = %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	w = do(http.MethodGet, "/templates/welcome/versions", "")
+	var versions []Template
+	if err := json.NewDecoder(w.Body).Decode(&versions); err != nil || len(versions) != 2 || !versions[1].Published {
+		t.Errorf("GET /templates/{name}/versions = %v, %v, want 2 versions with the second published", versions, err)
+	}
+
+	w = do(http.MethodPost, "/templates/welcome/preview", `{"version":1,"locals":{"Name":"Alice"}}`)
+	var preview TemplatePreview
+	if err := json.NewDecoder(w.Body).Decode(&preview); err != nil || preview.Subject != "v1" || preview.HTML != "<p>Hello Alice</p>" {
+		t.Errorf("POST /templates/{name}/preview = %+v, %v, want version 1 rendered", preview, err)
+	}
+
+	if w := do(http.MethodPost, "/templates/welcome/rollback", ""); w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `{"version":1}` {
+		t.Errorf("POST /templates/{name}/rollback = %d %s, want version 1", w.Code, w.Body)
+	}
+	if w := do(http.MethodPost, "/templates/welcome/rollback", ""); w.Code != http.StatusConflict {
+		t.Errorf("POST /templates/{name}/rollback without history = %d, want %d", w.Code, http.StatusConflict)
+	}
+	if w := do(http.MethodPost, "/templates/missing/rollback", ""); w.Code != http.StatusNotFound {
+		t.Errorf("POST /templates/{name}/rollback of a missing template = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
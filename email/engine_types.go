@@ -1,8 +1,11 @@
 package email
 
+import "time"
+
 type Address struct {
 	Name    string `validate:"required,min=1,max=128" json:"name"`
 	Address string `validate:"required,email,max=128" json:"address"`
+	Locale  string `validate:"omitempty,bcp47_language_tag,max=35" json:"locale,omitempty"` // Language of the recipient, selects the variant of templates sent to it
 }
 
 type Attachment struct {
@@ -13,10 +16,214 @@ type Attachment struct {
 }
 
 type Email struct {
+	ID          string       `validate:"omitempty,max=128,printascii,excludesall=<>@ " json:"id,omitempty"`
 	To          []Address    `validate:"required,dive" json:"to"`
 	From        Address      `validate:"required" json:"from"`
 	Subject     string       `validate:"required" json:"subject"`
 	Content     string       `validate:"required" json:"content"`
 	HTML        bool         `validate:"required" json:"html"`
+	Text        string       `json:"text,omitempty"` // Plain text alternative of HTML content
 	Attachments []Attachment `validate:"dive" json:"attachments"`
+	Cc          []Address    `validate:"dive" json:"cc,omitempty"`                                  // Listed in the 'Cc' header only, emails are delivered to the To addresses
+	ReplyTo     *Address     `validate:"omitempty" json:"reply_to,omitempty"`                       // Address replies are sent to
+	InReplyTo   string       `validate:"omitempty,max=998,printascii" json:"in_reply_to,omitempty"` // Message-ID of the email being replied to, e.g. <id@example.org>
+	References  string       `validate:"omitempty,max=998,printascii" json:"references,omitempty"`  // Message-IDs of the thread being replied to
+
+	// Results of sender authentication checks, only set on incoming emails.
+	// Read-only, the REST API rejects outbound emails which set it.
+	Authentication *Authentication `validate:"isdefault" json:"authentication,omitempty"`
+
+	// Details of the SMTP session an incoming email was received in, read-only
+	Received *Received `validate:"isdefault" json:"received,omitempty"`
+
+	// Inbox an incoming email is being delivered to, set for each inbox handler call, read-only
+	Recipient *Recipient `validate:"isdefault" json:"recipient,omitempty"`
+
+	// Original message of an incoming email, prefixed with an Authentication-Results header
+	Raw []byte `json:"-"`
+
+	// Original message of a forwarded email, delivered instead of building a new one
+	forward *forwardedEmail
+}
+
+type Received struct {
+	RemoteIP   string    `json:"remote_ip"`             // IP address of the connected client
+	Hostname   string    `json:"hostname"`              // Name given by the client in HELO or EHLO
+	TLSVersion string    `json:"tls_version,omitempty"` // TLS version (e.g. "TLS 1.3"), empty if unencrypted
+	TLSCipher  string    `json:"tls_cipher,omitempty"`  // TLS cipher suite, empty if unencrypted
+	MailFrom   string    `json:"mail_from"`             // Envelope sender, empty for bounces
+	RcptTo     []string  `json:"rcpt_to"`               // Envelope recipients
+	Timestamp  time.Time `json:"timestamp"`             // Time the email body was received
+	MessageID  string    `json:"message_id,omitempty"`  // Value of the 'Message-ID' header
+
+	Blocklist *BlocklistResult `json:"blocklist,omitempty"` // Set if IncomingBlocklists are configured
+}
+
+type Template struct {
+	Name        string       `validate:"required,max=64,excludesall=/" json:"name"`
+	Locale      string       `validate:"omitempty,bcp47_language_tag,max=35" json:"locale"` // Language of this variant (Defaults to Engine.TemplateLocale)
+	Version     int          `validate:"isdefault" json:"version"`                          // Read-only, assigned when the version is created
+	Published   bool         `validate:"isdefault" json:"published"`                        // Read-only, the version which is sent
+	From        Address      `validate:"required" json:"from"`
+	Subject     string       `validate:"required,max=255" json:"subject"`             // Rendered using text/template
+	HTML        string       `validate:"required_without=Text" json:"html,omitempty"` // Rendered using html/template as the 'content' template
+	Text        string       `validate:"required_without=HTML" json:"text,omitempty"` // Rendered using text/template, the plain text alternative if HTML is set
+	Layout      string       `validate:"max=64" json:"layout,omitempty"`              // Name of a shared layout wrapping the HTML
+	Attachments []Attachment `validate:"dive" json:"attachments,omitempty"`           // Inline assets and attachments included in every email
+}
+
+type TemplateSummary struct {
+	Name      string `json:"name"`
+	Locale    string `json:"locale"`
+	Published int    `json:"published"` // Version which is sent, 0 if none was published
+	Latest    int    `json:"latest"`    // Most recently created version
+}
+
+type TemplateFragment struct {
+	Name string `validate:"required,max=64,excludesall=/" json:"name"`
+	HTML string `validate:"required" json:"html"`
+}
+
+type TemplateSend struct {
+	To     []Address      `validate:"required,min=1,dive" json:"to"`
+	Locals map[string]any `json:"locals"`
+}
+
+type TemplateSample struct {
+	Version int            `validate:"min=0" json:"version"`                              // Version to render, 0 for the published version
+	Locale  string         `validate:"omitempty,bcp47_language_tag,max=35" json:"locale"` // Locale to render for, selecting the variant like a recipient would
+	Locals  map[string]any `json:"locals"`
+}
+
+type MessageCatalog struct {
+	Locale   string             `validate:"required,bcp47_language_tag,max=35" json:"locale"`
+	Messages map[string]Message `validate:"required" json:"messages"`
+}
+
+type TemplatePreview struct {
+	Subject string `json:"subject"`
+	HTML    string `json:"html,omitempty"`
+	Text    string `json:"text,omitempty"`
+	MIME    string `json:"mime"` // Message as it would be delivered, addressed to the template sender
+}
+
+type Inbox struct {
+	Username string   `validate:"required,printascii,excludesall=@,max=64" json:"username"`
+	Webhook  string   `validate:"required,http_url,max=2048" json:"webhook,omitempty"`
+	Alias    string   `validate:"isdefault" json:"alias,omitempty"`   // Read-only, username the inbox is an alias of
+	Forward  []string `validate:"isdefault" json:"forward,omitempty"` // Read-only, addresses emails are forwarded to
+}
+
+type Recipient struct {
+	Address string `json:"address"`       // Envelope recipient, in lowercase
+	Inbox   string `json:"inbox"`         // Username the recipient was matched by, without its tag
+	Tag     string `json:"tag,omitempty"` // Sub-address tag in its original case (e.g. "Ticket123" for "support+Ticket123@")
+}
+
+type BlocklistResult struct {
+	Score  int      `json:"score"`  // Sum of the weights of all lists the client is listed in
+	Listed []string `json:"listed"` // Zones the client is listed in
+	Tagged bool     `json:"tagged"` // Score reached IncomingBlocklistTag or the Tag threshold of a list
+}
+
+type SuppressionReason string
+
+const (
+	SuppressionHardBounce  SuppressionReason = "hard_bounce" // Recipient mailbox does not exist
+	SuppressionComplaint   SuppressionReason = "complaint"   // Recipient marked an email as spam
+	SuppressionUnsubscribe SuppressionReason = "unsubscribe" // Recipient asked to stop receiving emails
+	SuppressionManual      SuppressionReason = "manual"      // Added by an operator
+)
+
+type Suppression struct {
+	Address string            `validate:"required,email,max=128" json:"address"`
+	Reason  SuppressionReason `validate:"required,oneof=hard_bounce complaint unsubscribe manual" json:"reason"`
+	Created time.Time         `json:"created"`
+}
+
+type DeliveryStatus string
+
+const (
+	DeliveryDelivered  DeliveryStatus = "delivered"  // Recipient server accepted the email
+	DeliveryDeferred   DeliveryStatus = "deferred"   // Delivery attempt failed temporarily, another server or attempt follows
+	DeliveryBounced    DeliveryStatus = "bounced"    // Recipient server rejected the email or every attempt failed
+	DeliverySuppressed DeliveryStatus = "suppressed" // Recipient is on the suppression list, no attempt was made
+)
+
+type DeliveryEvent struct {
+	ID        string         `json:"id"`                 // Unique ID of the event, for deduplicating retried webhooks
+	MessageID string         `json:"message_id"`         // ID of the outbound email
+	Recipient string         `json:"recipient"`          // Address the email was being delivered to
+	Status    DeliveryStatus `json:"status"`             // Outcome of the delivery
+	Response  string         `json:"response,omitempty"` // Reply of the recipient server or the error which occurred
+	Timestamp time.Time      `json:"timestamp"`          // Time the event occurred
+}
+
+type SPFResult string
+
+const (
+	SPFNone      SPFResult = "none"      // Domain has no SPF record or could not be determined
+	SPFNeutral   SPFResult = "neutral"   // Domain makes no assertion about the address
+	SPFPass      SPFResult = "pass"      // Address is authorized to send for the domain
+	SPFFail      SPFResult = "fail"      // Address is not authorized to send for the domain
+	SPFSoftFail  SPFResult = "softfail"  // Address is probably not authorized to send for the domain
+	SPFTempError SPFResult = "temperror" // A transient DNS error occurred
+	SPFPermError SPFResult = "permerror" // Domain's SPF record is invalid
+)
+
+type AuthenticationSPF struct {
+	Result SPFResult `json:"result"`
+	Domain string    `json:"domain"`           // Domain whose SPF record was evaluated
+	Reason string    `json:"reason,omitempty"` // Human readable explanation of the result
+}
+
+type DKIMResult string
+
+const (
+	DKIMPass      DKIMResult = "pass"      // Signature is valid
+	DKIMFail      DKIMResult = "fail"      // Signature or body hash did not verify
+	DKIMTempError DKIMResult = "temperror" // Public key could not be retrieved
+	DKIMPermError DKIMResult = "permerror" // Signature or public key is malformed
+)
+
+type AuthenticationDKIM struct {
+	Result     DKIMResult `json:"result"`
+	Domain     string     `json:"domain"`               // Signing domain (d=)
+	Selector   string     `json:"selector"`             // Key selector (s=)
+	Identifier string     `json:"identifier,omitempty"` // Agent or user identifier (i=)
+	Reason     string     `json:"reason,omitempty"`     // Human readable explanation of the result
+}
+
+type DMARCResult string
+
+const (
+	DMARCNone      DMARCResult = "none"      // Domain has no DMARC policy
+	DMARCPass      DMARCResult = "pass"      // An aligned SPF or DKIM identifier passed
+	DMARCFail      DMARCResult = "fail"      // No aligned SPF or DKIM identifier passed
+	DMARCTempError DMARCResult = "temperror" // A transient DNS error occurred
+	DMARCPermError DMARCResult = "permerror" // Domain's DMARC policy is invalid
+)
+
+type DMARCPolicy string
+
+const (
+	DMARCPolicyNone       DMARCPolicy = "none"       // Deliver as usual
+	DMARCPolicyQuarantine DMARCPolicy = "quarantine" // Treat as suspicious (e.g. deliver to spam)
+	DMARCPolicyReject     DMARCPolicy = "reject"     // Reject during SMTP transaction
+)
+
+type AuthenticationDMARC struct {
+	Result      DMARCResult `json:"result"`
+	Domain      string      `json:"domain"`           // Domain of the 'From' header
+	Policy      DMARCPolicy `json:"policy"`           // Policy published by the domain
+	Disposition DMARCPolicy `json:"disposition"`      // Policy applied to this email after 'pct' sampling
+	SPFAligned  bool        `json:"spf_aligned"`      // SPF passed for a domain aligned with the 'From' header
+	DKIMAligned bool        `json:"dkim_aligned"`     // DKIM passed for a domain aligned with the 'From' header
+	Reason      string      `json:"reason,omitempty"` // Human readable explanation of the result
+}
+
+type Authentication struct {
+	SPF   *AuthenticationSPF   `json:"spf,omitempty"`   // Set if IncomingValidateSPF is enabled
+	DKIM  []AuthenticationDKIM `json:"dkim,omitempty"`  // One result per signature, empty if the email is unsigned
+	DMARC *AuthenticationDMARC `json:"dmarc,omitempty"` // Set if IncomingValidateDMARC is enabled
 }
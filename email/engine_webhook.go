@@ -0,0 +1,188 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An external service incoming emails are posted to. The service decides the SMTP
+// reply with its response code, 2xx accepts the email, 408, 429 and 5xx are retried
+// and eventually tempfailed, any other code rejects the email using the first line
+// of the response body as the reason.
+type Webhook struct {
+	URL       string        // Endpoint emails are posted to
+	Secret    string        // Key for the X-Email-Signature header (Defaults to the engine WebhookSecret, signing is disabled if both are empty)
+	Multipart bool          // Send attachments as separate parts of a multipart/form-data body instead of base64 in the JSON body
+	Retries   int           // Additional attempts after a failed request, waiting 1s, 2s, 4s... in between (Defaults to 0)
+	Timeout   time.Duration // Timeout for a single attempt (Defaults to the engine IncomingTimeout)
+}
+
+// Register an Inbox which posts incoming emails to a webhook
+func (e *Engine) RegisterWebhookInbox(username string, hook Webhook) error {
+	return e.registerInbox(username, e.webhookInbox(hook))
+}
+
+func (e *Engine) webhookInbox(hook Webhook) inboxEntry {
+	return inboxEntry{handler: e.webhookHandler(hook), webhook: hook.URL}
+}
+
+// Append a middleware which posts every incoming email to a webhook before it
+// is delivered to any inbox, letting an external service filter emails
+func (e *Engine) UseWebhook(hook Webhook) {
+	handler := e.webhookHandler(hook)
+	e.UseIncoming(func(em *Email) (bool, error) {
+		if err := handler(em); err != nil {
+			return false, err
+		}
+		return true, nil
+	})
+}
+
+// Returns an Inbox Handler which posts emails to a webhook, returning a
+// *Rejection if the email should not be accepted
+func (e *Engine) webhookHandler(hook Webhook) HandlerEmail {
+	timeout := hook.Timeout
+	if timeout <= 0 {
+		timeout = e.IncomingTimeout
+	}
+	client := &http.Client{Timeout: timeout}
+	return func(em *Email) error {
+		contentType, body, err := encodeWebhook(em, hook.Multipart)
+		if err != nil {
+			return fmt.Errorf("cannot encode email for webhook: %s", err)
+		}
+
+		// Post Email
+		// 	The client is waiting on us, so retries stop once they would
+		// 	exceed the time we're given to process an email
+		deadline := time.Now().Add(e.IncomingTimeout)
+		delay := time.Second
+		var lastErr error
+		for attempt := 0; attempt <= hook.Retries; attempt++ {
+			if attempt > 0 {
+				if time.Now().Add(delay).After(deadline) {
+					break
+				}
+				time.Sleep(delay)
+				delay *= 2
+			}
+			status, reason, err := e.postWebhook(client, hook, contentType, body)
+			switch {
+			case err != nil:
+				lastErr = err
+			case status >= 200 && status <= 299:
+				return nil
+			case status == http.StatusRequestTimeout || status == http.StatusTooManyRequests || status >= 500:
+				lastErr = fmt.Errorf("responded with status %d", status)
+			default:
+				if reason == "" {
+					reason = "Email rejected"
+				}
+				return Reject(reason)
+			}
+		}
+		e.ErrorLogger(fmt.Errorf("webhook '%s' failed: %s", hook.URL, lastErr))
+		return TempFail("Email could not be processed, please try again later")
+	}
+}
+
+// Send a single webhook request, returning the status code and the first line of the response body
+func (e *Engine) postWebhook(client *http.Client, hook Webhook, contentType string, body []byte) (int, string, error) {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, "", err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", "tools-email")
+	secret := hook.Secret
+	if secret == "" {
+		secret = e.WebhookSecret
+	}
+	if secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-Email-Timestamp", timestamp)
+		req.Header.Set("X-Email-Signature", "sha256="+signWebhook(secret, timestamp, body))
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer res.Body.Close()
+	message, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+	reason, _, _ := strings.Cut(strings.TrimSpace(string(message)), "\n")
+	return res.StatusCode, strings.TrimSpace(reason), nil
+}
+
+// Returns the hex encoded HMAC-SHA256 of a webhook request, computed over the
+// timestamp and body joined by a period (e.g. "1700000000.{...}")
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Encode an email as the body of a webhook request. Multipart bodies contain the
+// email as JSON in the 'email' field, without attachment data, followed by each
+// attachment in order as an 'attachment' file.
+func encodeWebhook(em *Email, asMultipart bool) (string, []byte, error) {
+	if !asMultipart {
+		body, err := json.Marshal(em)
+		return "application/json", body, err
+	}
+	stripped := *em
+	stripped.Attachments = make([]Attachment, len(em.Attachments))
+	for i, a := range em.Attachments {
+		a.Data = nil
+		stripped.Attachments[i] = a
+	}
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	part, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Disposition": {`form-data; name="email"`},
+		"Content-Type":        {"application/json"},
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	if err := json.NewEncoder(part).Encode(stripped); err != nil {
+		return "", nil, err
+	}
+	for _, a := range em.Attachments {
+		part, err := w.CreatePart(textproto.MIMEHeader{
+			"Content-Disposition": {multipartDisposition(a.Filename)},
+			"Content-Type":        {a.ContentType},
+		})
+		if err != nil {
+			return "", nil, err
+		}
+		if _, err := part.Write(a.Data); err != nil {
+			return "", nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return "", nil, err
+	}
+	return w.FormDataContentType(), body.Bytes(), nil
+}
+
+// Returns the Content-Disposition of an attachment part, quoting the filename
+// like mime/multipart does for form files
+func multipartDisposition(filename string) string {
+	escaped := strings.NewReplacer("\\", "\\\\", `"`, "\\\"").Replace(filename)
+	return fmt.Sprintf(`form-data; name="attachment"; filename="%s"`, escaped)
+}
@@ -0,0 +1,235 @@
+package email
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestWebhookSignature(t *testing.T) {
+	tests := []struct {
+		name         string
+		engineSecret string
+		hookSecret   string
+		want         string // Secret the request is expected to be signed with, empty if unsigned
+	}{
+		{name: "engine secret", engineSecret: "engine", want: "engine"},
+		{name: "hook secret", engineSecret: "engine", hookSecret: "hook", want: "hook"},
+		{name: "unsigned"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var header http.Header
+			var body []byte
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				header = r.Header.Clone()
+				body, _ = io.ReadAll(r.Body)
+			}))
+			defer server.Close()
+			e := New("example.org")
+			e.WebhookSecret = tt.engineSecret
+			handler := e.webhookHandler(Webhook{URL: server.URL, Secret: tt.hookSecret})
+			if err := handler(&Email{Subject: "Hello"}); err != nil {
+				t.Fatal(err)
+			}
+
+			timestamp, signature := header.Get("X-Email-Timestamp"), header.Get("X-Email-Signature")
+			if tt.want == "" {
+				if timestamp != "" || signature != "" {
+					t.Errorf("unsigned request has timestamp %q and signature %q", timestamp, signature)
+				}
+				return
+			}
+			mac := hmac.New(sha256.New, []byte(tt.want))
+			mac.Write([]byte(timestamp + "." + string(body)))
+			if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); signature != want {
+				t.Errorf("signature = %s, want %s", signature, want)
+			}
+			if sent, err := strconv.ParseInt(timestamp, 10, 64); err != nil || time.Since(time.Unix(sent, 0)) > time.Minute {
+				t.Errorf("timestamp = %q, want the current unix time", timestamp)
+			}
+		})
+	}
+}
+
+func TestWebhookStatus(t *testing.T) {
+	tests := []struct {
+		status     int
+		body       string
+		want       *Rejection // nil if the email is accepted
+		wantErrors int        // Errors which are logged
+	}{
+		{status: http.StatusOK},
+		{status: http.StatusNoContent},
+		{status: http.StatusForbidden, body: " Sender is blocked \nmore details", want: Reject("Sender is blocked")},
+		{status: http.StatusNotFound, want: Reject("Email rejected")},
+		{status: http.StatusRequestTimeout, want: TempFail("Email could not be processed, please try again later"), wantErrors: 1},
+		{status: http.StatusTooManyRequests, want: TempFail("Email could not be processed, please try again later"), wantErrors: 1},
+		{status: http.StatusBadGateway, want: TempFail("Email could not be processed, please try again later"), wantErrors: 1},
+	}
+	for _, tt := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.status)
+			io.WriteString(w, tt.body)
+		}))
+		e := New("example.org")
+		errorCount := 0
+		e.ErrorLogger = func(err error) { errorCount++ }
+		err := e.webhookHandler(Webhook{URL: server.URL})(&Email{})
+		server.Close()
+
+		var got *Rejection
+		if err != nil && !errors.As(err, &got) {
+			t.Errorf("status %d: handler = %v, want a *Rejection", tt.status, err)
+			continue
+		}
+		if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+			t.Errorf("status %d: handler = %v, want %v", tt.status, got, tt.want)
+		}
+		if errorCount != tt.wantErrors {
+			t.Errorf("status %d: logged %d errors, want %d", tt.status, errorCount, tt.wantErrors)
+		}
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		retries      int
+		failures     int32 // Requests answered with 503 before the webhook succeeds
+		wantAttempts int32
+		wantErr      bool
+	}{
+		{name: "retried until success", retries: 3, failures: 1, wantAttempts: 2},
+		{name: "no retries", retries: 0, failures: 1, wantAttempts: 1, wantErr: true},
+		{name: "bounded by incoming timeout", retries: 5, failures: 10, wantAttempts: 2, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if attempts.Add(1) <= tt.failures {
+					w.WriteHeader(http.StatusServiceUnavailable)
+				}
+			}))
+			defer server.Close()
+			e := New("example.org")
+			e.ErrorLogger = func(err error) {}
+			e.IncomingTimeout = 1500 * time.Millisecond // Leaves time for a single retry after 1s
+			err := e.webhookHandler(Webhook{URL: server.URL, Retries: tt.retries})(&Email{})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("handler = %v, want error %t", err, tt.wantErr)
+			}
+			if n := attempts.Load(); n != tt.wantAttempts {
+				t.Errorf("webhook was posted %d times, want %d", n, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestWebhookInboxReply(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/reject":
+			http.Error(w, "No thanks", http.StatusForbidden)
+		case "/fail":
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+	e := New("example.org")
+	e.ErrorLogger = func(err error) {}
+	e.IncomingValidateSPF = false
+	e.IncomingValidateDKIM = false
+	e.IncomingValidateDMARC = false
+	for _, username := range []string{"accept", "reject", "fail"} {
+		if err := e.RegisterWebhookInbox(username, Webhook{URL: server.URL + "/" + username}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	addr := testServe(t, &e, false, nil)
+
+	tests := []struct {
+		username string
+		wantCode int // 0 if the email is accepted
+		wantText string
+	}{
+		{username: "accept"},
+		{username: "reject", wantCode: 550, wantText: "No thanks"},
+		{username: "fail", wantCode: 451, wantText: "Email could not be processed, please try again later"},
+	}
+	for _, tt := range tests {
+		c := testDial(t, addr, false)
+		to := tt.username + "@example.org"
+		message := "From: <alice@example.net>\r\nTo: <" + to + ">\r\nSubject: Hello\r\n\r\nHello World\r\n"
+		err := c.SendMail("alice@example.net", []string{to}, strings.NewReader(message))
+		if tt.wantCode == 0 {
+			if err != nil {
+				t.Errorf("%s: SendMail() = %s, want the email accepted", tt.username, err)
+			}
+			continue
+		}
+		var smtpErr *smtp.SMTPError
+		if !errors.As(err, &smtpErr) || smtpErr.Code != tt.wantCode || smtpErr.Message != tt.wantText {
+			t.Errorf("%s: SendMail() = %v, want %d %s", tt.username, err, tt.wantCode, tt.wantText)
+		}
+	}
+}
+
+func TestEncodeWebhookMultipart(t *testing.T) {
+	em := &Email{
+		Subject: "Hello",
+		Attachments: []Attachment{
+			{Filename: `a "quoted".txt`, ContentType: "text/plain", Data: []byte("first")},
+			{Filename: "b.bin", ContentType: "application/octet-stream", Data: []byte("second")},
+		},
+	}
+	contentType, body, err := encodeWebhook(em, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	form, err := multipart.NewReader(strings.NewReader(string(body)), params["boundary"]).ReadForm(1 << 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Email
+	if err := json.Unmarshal([]byte(form.Value["email"][0]), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Subject != "Hello" || len(decoded.Attachments) != 2 || decoded.Attachments[0].Data != nil {
+		t.Errorf("email field = %+v, want the email without attachment data", decoded)
+	}
+	files := form.File["attachment"]
+	if len(files) != 2 || files[0].Filename != `a "quoted".txt` || files[1].Filename != "b.bin" {
+		t.Fatalf("attachment files = %v, want both attachments in order", files)
+	}
+	f, err := files[1].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if data, _ := io.ReadAll(f); string(data) != "second" {
+		t.Errorf("attachment data = %q, want %q", data, "second")
+	}
+	if em.Attachments[0].Data == nil {
+		t.Error("encodeWebhook() removed the data of the original attachments")
+	}
+}
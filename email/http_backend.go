@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"slices"
 
 	"github.com/go-playground/validator/v10"
 )
@@ -41,20 +42,615 @@ func newHttpHandler(e *Engine) *http.ServeMux {
 		}
 
 		// Queue Incoming Emails
+		failed := false
+		queued := make([]string, 0, len(incoming))
 		for i := range incoming {
 			if err := v.Struct(incoming[i]); err != nil {
 				e.ErrorLogger(fmt.Errorf("validation failed for email at index %d: %s", i, err))
 				http.Error(w, fmt.Sprintf("Validation Failed for Email at Index %d: %s\n", i, err), http.StatusBadRequest)
+				failed = true
 				continue
 			}
 			if ok := e.QueueEmail(&incoming[i]); !ok {
 				http.Error(w, fmt.Sprintf("Email queue is full at index: %d\n", i), http.StatusInsufficientStorage)
+				failed = true
 				continue
 			}
+			queued = append(queued, incoming[i].ID)
+		}
+		if failed {
+			return
+		}
+
+		// Success!
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(queued)
+	})
+	r.HandleFunc("/suppressions", func(w http.ResponseWriter, r *http.Request) {
+		// Sanity Checks
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Method == http.MethodPost && r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		if !e.AuthHandler(r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		// List Suppressed Addresses
+		if r.Method == http.MethodGet {
+			list, err := e.Suppressions.List()
+			if err != nil {
+				e.ErrorLogger(fmt.Errorf("cannot list suppressions: %s", err))
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(list)
+			return
+		}
+
+		// Parse Request Body
+		var incoming []Suppression
+		decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, e.IncomingMaxBytes))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&incoming); err != nil {
+			e.ErrorLogger(fmt.Errorf("error parsing body: %s", err))
+			http.Error(w, "Invalid Form Body", http.StatusUnprocessableEntity)
+			return
+		}
+
+		// Suppress Incoming Addresses
+		for i := range incoming {
+			if err := v.Struct(incoming[i]); err != nil {
+				http.Error(w, fmt.Sprintf("Validation Failed for Suppression at Index %d: %s\n", i, err), http.StatusBadRequest)
+				return
+			}
+		}
+		for i := range incoming {
+			if err := e.Suppress(incoming[i].Address, incoming[i].Reason); err != nil {
+				e.ErrorLogger(fmt.Errorf("cannot add suppression: %s", err))
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+
+		// Success!
+		w.WriteHeader(http.StatusCreated)
+	})
+	r.HandleFunc("/suppressions/{address}", func(w http.ResponseWriter, r *http.Request) {
+		// Sanity Checks
+		if r.Method != http.MethodDelete {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !e.AuthHandler(r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		// Remove Suppressed Address
+		address := r.PathValue("address")
+		if entry, err := e.Suppressed(address); err != nil {
+			e.ErrorLogger(fmt.Errorf("cannot lookup suppression: %s", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		} else if entry == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err := e.Unsuppress(address); err != nil {
+			e.ErrorLogger(fmt.Errorf("cannot remove suppression: %s", err))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		// Success!
+		w.WriteHeader(http.StatusNoContent)
+	})
+	r.HandleFunc("/inboxes", func(w http.ResponseWriter, r *http.Request) {
+		// Sanity Checks
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Method == http.MethodPost && r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		if !e.AuthHandler(r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		// List Registered Inboxes
+		if r.Method == http.MethodGet {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(e.Inboxes())
+			return
+		}
+
+		// Parse Request Body
+		var incoming []Inbox
+		decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, e.IncomingMaxBytes))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&incoming); err != nil {
+			e.ErrorLogger(fmt.Errorf("error parsing body: %s", err))
+			http.Error(w, "Invalid Form Body", http.StatusUnprocessableEntity)
+			return
+		}
+
+		// Register Incoming Inboxes
+		// 	The batch is registered as a whole, so a conflict leaves no inbox behind
+		usernames := make([]string, len(incoming))
+		entries := make([]inboxEntry, len(incoming))
+		for i := range incoming {
+			if err := v.Struct(incoming[i]); err != nil {
+				http.Error(w, fmt.Sprintf("Validation Failed for Inbox at Index %d: %s\n", i, err), http.StatusBadRequest)
+				return
+			}
+			usernames[i] = incoming[i].Username
+			entries[i] = e.webhookInbox(Webhook{URL: incoming[i].Webhook, Retries: 2})
+		}
+		if i, err := e.registerInboxes(usernames, entries); err != nil {
+			http.Error(w, fmt.Sprintf("Inbox already exists at Index %d\n", i), http.StatusConflict)
+			return
+		}
+
+		// Success!
+		w.WriteHeader(http.StatusCreated)
+	})
+	r.HandleFunc("/inboxes/{username}", func(w http.ResponseWriter, r *http.Request) {
+		// Sanity Checks
+		if r.Method != http.MethodDelete {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !e.AuthHandler(r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		// Remove Webhook Inbox
+		// 	Inboxes registered in Go are left alone as their handler cannot be restored
+		username := r.PathValue("username")
+		if inbox := e.lookupRegisteredInbox(username); inbox == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if inbox.Webhook == "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if err := e.UnregisterInbox(username); err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		// Success!
+		w.WriteHeader(http.StatusNoContent)
+	})
+	r.HandleFunc("/templates", func(w http.ResponseWriter, r *http.Request) {
+		// Sanity Checks
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !e.AuthHandler(r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		// List Registered Templates
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(e.Templates())
+	})
+	r.HandleFunc("/templates/{name}", func(w http.ResponseWriter, r *http.Request) {
+		// Sanity Checks
+		if r.Method != http.MethodPut && r.Method != http.MethodDelete {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Method == http.MethodPut && r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		if !e.AuthHandler(r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		// Remove Template
+		name := r.PathValue("name")
+		if r.Method == http.MethodDelete {
+			if err := e.UnregisterTemplate(name); err != nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		// Parse Request Body
+		var incoming Template
+		decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, e.IncomingMaxBytes))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&incoming); err != nil {
+			e.ErrorLogger(fmt.Errorf("error parsing body: %s", err))
+			http.Error(w, "Invalid Form Body", http.StatusUnprocessableEntity)
+			return
+		}
+
+		// Create Template Version
+		// 	Parse errors are reported to the client as they are caused by its input
+		incoming.Name = name
+		if err := v.Struct(incoming); err != nil {
+			http.Error(w, fmt.Sprintf("Validation Failed for Template: %s\n", err), http.StatusBadRequest)
+			return
+		}
+		version, err := e.addTemplateVersion(incoming, r.URL.Query().Get("publish") != "false", nil)
+		if err != nil {
+			http.Error(w, fmt.Sprintln(err), http.StatusBadRequest)
+			return
+		}
+
+		// Success!
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]int{"version": version})
+	})
+	r.HandleFunc("/templates/{name}/versions", func(w http.ResponseWriter, r *http.Request) {
+		// Sanity Checks
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !e.AuthHandler(r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		// List Template Versions
+		versions, err := e.TemplateVersions(r.PathValue("name"), r.URL.Query().Get("locale"))
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(versions)
+	})
+	r.HandleFunc("/templates/{name}/publish", func(w http.ResponseWriter, r *http.Request) {
+		// Sanity Checks
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		if !e.AuthHandler(r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		// Parse Request Body
+		var incoming struct {
+			Version int `json:"version"`
+		}
+		decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, e.IncomingMaxBytes))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&incoming); err != nil {
+			e.ErrorLogger(fmt.Errorf("error parsing body: %s", err))
+			http.Error(w, "Invalid Form Body", http.StatusUnprocessableEntity)
+			return
+		}
+
+		// Publish Template Version
+		if err := e.PublishTemplate(r.PathValue("name"), r.URL.Query().Get("locale"), incoming.Version); err != nil {
+			http.Error(w, fmt.Sprintln(err), http.StatusNotFound)
+			return
+		}
+
+		// Success!
+		w.WriteHeader(http.StatusNoContent)
+	})
+	r.HandleFunc("/templates/{name}/rollback", func(w http.ResponseWriter, r *http.Request) {
+		// Sanity Checks
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !e.AuthHandler(r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		name, locale := r.PathValue("name"), r.URL.Query().Get("locale")
+		if _, err := e.TemplateVersions(name, locale); err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		// Publish Previous Version
+		version, err := e.RollbackTemplate(name, locale)
+		if err != nil {
+			http.Error(w, fmt.Sprintln(err), http.StatusConflict)
+			return
+		}
+
+		// Success!
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"version": version})
+	})
+	r.HandleFunc("/templates/{name}/preview", func(w http.ResponseWriter, r *http.Request) {
+		// Sanity Checks
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		if !e.AuthHandler(r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		// Parse Request Body
+		var incoming TemplateSample
+		decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, e.IncomingMaxBytes))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&incoming); err != nil {
+			e.ErrorLogger(fmt.Errorf("error parsing body: %s", err))
+			http.Error(w, "Invalid Form Body", http.StatusUnprocessableEntity)
+			return
+		}
+		if err := v.Struct(incoming); err != nil {
+			http.Error(w, fmt.Sprintf("Validation Failed for Sample: %s\n", err), http.StatusBadRequest)
+			return
+		}
+
+		// Render Template Version
+		name := r.PathValue("name")
+		if _, err := e.lookupTemplate(name, incoming.Locale, incoming.Version); err != nil {
+			http.Error(w, fmt.Sprintln(err), http.StatusNotFound)
+			return
+		}
+		preview, err := e.PreviewTemplate(name, incoming.Locale, incoming.Version, incoming.Locals)
+		if err != nil {
+			http.Error(w, fmt.Sprintln(err), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(preview)
+	})
+	r.HandleFunc("/templates/{name}/send", func(w http.ResponseWriter, r *http.Request) {
+		// Sanity Checks
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		if !e.AuthHandler(r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		name := r.PathValue("name")
+		exists := slices.ContainsFunc(e.Templates(), func(t TemplateSummary) bool { return t.Name == name })
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		// Parse Request Body
+		var incoming []TemplateSend
+		decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, e.IncomingMaxBytes))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&incoming); err != nil {
+			e.ErrorLogger(fmt.Errorf("error parsing body: %s", err))
+			http.Error(w, "Invalid Form Body", http.StatusUnprocessableEntity)
+			return
+		}
+
+		// Render Emails
+		// 	Everything is rendered before queueing so a bad entry sends nothing,
+		// 	recipients of an entry are sent one email per locale
+		rendered := make([]*Email, 0, len(incoming))
+		for i := range incoming {
+			if err := v.Struct(incoming[i]); err != nil {
+				http.Error(w, fmt.Sprintf("Validation Failed for Send at Index %d: %s\n", i, err), http.StatusBadRequest)
+				return
+			}
+			emails, err := e.renderTemplateFor(name, incoming[i].To, incoming[i].Locals)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Render Failed for Send at Index %d: %s\n", i, err), http.StatusBadRequest)
+				return
+			}
+			rendered = append(rendered, emails...)
+		}
+
+		// Queue Rendered Emails
+		queued := make([]string, 0, len(rendered))
+		for i, email := range rendered {
+			if ok := e.QueueEmail(email); !ok {
+				http.Error(w, fmt.Sprintf("Email queue is full at index: %d\n", i), http.StatusInsufficientStorage)
+				return
+			}
+			queued = append(queued, email.ID)
 		}
 
 		// Success!
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(queued)
+	})
+	for _, kind := range []struct {
+		path       string
+		list       func() []TemplateFragment
+		register   func(name, html string) error
+		unregister func(name string) error
+	}{
+		{"/layouts", e.Layouts, e.RegisterLayout, e.UnregisterLayout},
+		{"/partials", e.Partials, e.RegisterPartial, e.UnregisterPartial},
+	} {
+		r.HandleFunc(kind.path, func(w http.ResponseWriter, r *http.Request) {
+			// Sanity Checks
+			if r.Method != http.MethodGet {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			if !e.AuthHandler(r) {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			// List Registered Fragments
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(kind.list())
+		})
+		r.HandleFunc(kind.path+"/{name}", func(w http.ResponseWriter, r *http.Request) {
+			// Sanity Checks
+			if r.Method != http.MethodPut && r.Method != http.MethodDelete {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			if r.Method == http.MethodPut && r.Header.Get("Content-Type") != "application/json" {
+				w.WriteHeader(http.StatusUnsupportedMediaType)
+				return
+			}
+			if !e.AuthHandler(r) {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			// Remove Fragment
+			name := r.PathValue("name")
+			if r.Method == http.MethodDelete {
+				exists := slices.ContainsFunc(kind.list(), func(f TemplateFragment) bool { return f.Name == name })
+				if !exists {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				if err := kind.unregister(name); err != nil {
+					http.Error(w, fmt.Sprintln(err), http.StatusNotFound)
+					return
+				}
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			// Parse Request Body
+			var incoming TemplateFragment
+			decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, e.IncomingMaxBytes))
+			decoder.DisallowUnknownFields()
+			if err := decoder.Decode(&incoming); err != nil {
+				e.ErrorLogger(fmt.Errorf("error parsing body: %s", err))
+				http.Error(w, "Invalid Form Body", http.StatusUnprocessableEntity)
+				return
+			}
+
+			// Register Fragment
+			incoming.Name = name
+			if err := v.Struct(incoming); err != nil {
+				http.Error(w, fmt.Sprintf("Validation Failed for Fragment: %s\n", err), http.StatusBadRequest)
+				return
+			}
+			if err := kind.register(incoming.Name, incoming.HTML); err != nil {
+				http.Error(w, fmt.Sprintln(err), http.StatusBadRequest)
+				return
+			}
+
+			// Success!
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+	r.HandleFunc("/messages", func(w http.ResponseWriter, r *http.Request) {
+		// Sanity Checks
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !e.AuthHandler(r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		// List Message Catalogs
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(e.Messages())
+	})
+	r.HandleFunc("/messages/{locale}", func(w http.ResponseWriter, r *http.Request) {
+		// Sanity Checks
+		if r.Method != http.MethodPut && r.Method != http.MethodDelete {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Method == http.MethodPut && r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		if !e.AuthHandler(r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		// Remove Messages
+		locale := r.PathValue("locale")
+		if r.Method == http.MethodDelete {
+			if err := e.UnregisterMessages(locale); err != nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		// Parse Request Body
+		var incoming MessageCatalog
+		decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, e.IncomingMaxBytes))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&incoming.Messages); err != nil {
+			e.ErrorLogger(fmt.Errorf("error parsing body: %s", err))
+			http.Error(w, "Invalid Form Body", http.StatusUnprocessableEntity)
+			return
+		}
+
+		// Register Messages
+		incoming.Locale = locale
+		if err := v.Struct(incoming); err != nil {
+			http.Error(w, fmt.Sprintf("Validation Failed for Messages: %s\n", err), http.StatusBadRequest)
+			return
+		}
+		if err := e.RegisterMessages(incoming.Locale, incoming.Messages); err != nil {
+			http.Error(w, fmt.Sprintln(err), http.StatusBadRequest)
+			return
+		}
+
+		// Success!
+		w.WriteHeader(http.StatusNoContent)
+	})
+	r.HandleFunc("/ratelimits", func(w http.ResponseWriter, r *http.Request) {
+		// Sanity Checks
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !e.AuthHandler(r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		// Report Rate Limiter
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(e.RateLimitStats())
 	})
 	return r
 }
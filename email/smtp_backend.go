@@ -1,40 +1,219 @@
 package email
 
 import (
+	"crypto/tls"
+	"fmt"
 	"io"
+	"net"
+	"slices"
+	"strings"
 
 	"github.com/emersion/go-sasl"
 	"github.com/emersion/go-smtp"
 )
 
-// todo: comment
-
+// SMTP Backend, creates a Session for every incoming connection
 type Backend struct {
-	engine *Engine
+	engine     *Engine
+	submission bool // Clients must authenticate and their emails are queued for outbound delivery
 }
+
+// SMTP Session, tracks the envelope of the email currently being received
 type Session struct {
-	engine *Engine
+	engine     *Engine
+	conn       *smtp.Conn
+	submission bool               // Session belongs to a submission server
+	from       string             // MAIL FROM address
+	to         []string           // RCPT TO addresses without duplicates, unknown recipients are only included if a NoInboxHandler was provided
+	spf        *AuthenticationSPF // SPF result for the MAIL FROM address
+	listed     *BlocklistResult   // Blocklist result for the client address
+	user       *SubmissionUser    // Authenticated user, only set for submission sessions
 }
 
 func (b *Backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
-	return &Session{engine: b.engine}, nil
+	s := &Session{engine: b.engine, conn: c, submission: b.submission}
+	if b.submission {
+		// Submission clients are our own, they are vetted by authentication instead
+		return s, nil
+	}
+
+	// Run Connect Checks
+	// 	Sessions are created again after STARTTLS, so the result is kept on the
+	// 	connection and the checks only run for the first session
+	if conn := acceptedConn(c); conn != nil {
+		if !conn.checked {
+			conn.checked = true
+			conn.rejected = b.connectChecks(s)
+			conn.listed = s.listed
+		}
+		if conn.rejected != nil {
+			return nil, conn.rejected
+		}
+		s.listed = conn.listed
+	} else if err := b.connectChecks(s); err != nil {
+		return nil, err
+	}
+	if err := b.engine.runSessionHooks("helo", b.engine.heloHooks, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Look up the client address on the blocklists and run the connect hooks
+func (b *Backend) connectChecks(s *Session) error {
+	if len(b.engine.IncomingBlocklists) > 0 {
+		s.listed = b.engine.checkBlocklists(s.RemoteIP())
+		if err := b.engine.rejectBlocklisted(s.listed); err != nil {
+			return err
+		}
+	}
+	return b.engine.runSessionHooks("connect", b.engine.connectHooks, s)
+}
+
+// Returns the connection accepted by the engine listener beneath any TLS layer,
+// nil if the server was given a connection some other way
+func acceptedConn(c *smtp.Conn) *limitedConn {
+	conn := c.Conn()
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	accepted, _ := conn.(*limitedConn)
+	return accepted
+}
+
+// Returns the IP address of the connected client
+func (s *Session) RemoteIP() net.IP {
+	if addr, ok := s.conn.Conn().RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
+
+// Returns the TLS connection state, ok is false if the connection is not using TLS
+func (s *Session) TLS() (state tls.ConnectionState, ok bool) {
+	return s.conn.TLSConnectionState()
+}
+
+// Returns the name the client introduced itself with in HELO or EHLO
+func (s *Session) Hostname() string {
+	return s.conn.Hostname()
 }
+
+// Returns the blocklist result for the client address, nil if no blocklists are configured
+func (s *Session) Blocklist() *BlocklistResult {
+	return s.listed
+}
+
+// Returns the MAIL FROM address of the current email, empty for bounces
+func (s *Session) From() string {
+	return s.from
+}
+
+// Returns the accepted RCPT TO addresses of the current email
+func (s *Session) To() []string {
+	return slices.Clone(s.to)
+}
+
+// Returns the authenticated user of a submission session, nil if not logged in
+func (s *Session) User() *SubmissionUser {
+	return s.user
+}
+
 func (s *Session) AuthMechanisms() []string {
+	if s.submission {
+		return []string{sasl.Plain, sasl.Login}
+	}
 	return []string{}
 }
 func (s *Session) Auth(mech string) (sasl.Server, error) {
+	if s.submission {
+		return s.saslServer(mech)
+	}
 	return nil, smtp.ErrAuthUnsupported
 }
-func (s *Session) Reset() {}
+func (s *Session) Reset() {
+	s.from = ""
+	s.to = nil
+	s.spf = nil
+}
 func (s *Session) Logout() error {
 	return nil
 }
 func (s *Session) Mail(fromAddress string, opts *smtp.MailOptions) error {
+	if s.submission {
+		if s.user == nil {
+			return smtp.ErrAuthRequired
+		}
+		if !s.user.CanSendAs(fromAddress) {
+			return &smtp.SMTPError{
+				Code:         553,
+				EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+				Message:      fmt.Sprintf("Sender address rejected: not owned by user %s", s.user.Username),
+			}
+		}
+		s.from = fromAddress
+		return nil
+	}
+
+	// Limit Emails per Sender
+	if err := s.engine.checkSenderRate(s, fromAddress); err != nil {
+		return err
+	}
+
+	// Validate Sender Address
+	if s.engine.IncomingValidateSPF {
+		if ip := s.RemoteIP(); ip != nil {
+			s.spf = s.engine.checkSPF(ip, s.conn.Hostname(), fromAddress)
+			if s.spf.Result == SPFFail && s.engine.IncomingRejectSPFFail {
+				return &smtp.SMTPError{
+					Code:         550,
+					EnhancedCode: smtp.EnhancedCode{5, 7, 23},
+					Message:      fmt.Sprint("SPF validation failed: ", s.spf.Reason),
+				}
+			}
+		}
+	}
+	if err := s.engine.runEnvelopeHooks("mail from", s.engine.mailHooks, s, fromAddress); err != nil {
+		return err
+	}
+	s.from = fromAddress
 	return nil
 }
 func (s *Session) Rcpt(toAddress string, opts *smtp.RcptOptions) error {
+	// Accept Repeated Recipients
+	// 	They are only stored once, so their inbox does not receive the email twice
+	if slices.ContainsFunc(s.to, func(to string) bool { return strings.EqualFold(to, toAddress) }) {
+		return nil
+	}
+	if s.submission {
+		s.to = append(s.to, toAddress)
+		return nil
+	}
+
+	// Reject Unknown Recipients before the client uploads the body
+	if handler, _ := s.engine.lookupInbox(toAddress); handler == nil && s.engine.NoInboxHandler == nil {
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message:      "Unknown Recipient",
+		}
+	}
+	if err := s.engine.checkGreylist(s, toAddress); err != nil {
+		return err
+	}
+	if err := s.engine.runEnvelopeHooks("rcpt to", s.engine.rcptHooks, s, toAddress); err != nil {
+		return err
+	}
+	s.to = append(s.to, toAddress)
 	return nil
 }
 func (s *Session) Data(r io.Reader) error {
-	return s.engine.incomingHandler(r)
+	if s.submission {
+		return s.engine.submissionHandler(s, r)
+	}
+	if err := s.engine.incomingHandler(s, r); err != nil {
+		return err
+	}
+	s.engine.whitelistGreylist(s)
+	return nil
 }
@@ -0,0 +1,160 @@
+package email
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"net/textproto"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Returns a TLS config with a self-signed certificate for localhost
+func testTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+// Serve an SMTP or submission server of the engine on a local address until the test ends,
+// a nil tlsConfig serves SMTP without STARTTLS
+func testServe(t *testing.T, e *Engine, submission bool, tlsConfig *tls.Config) string {
+	t.Helper()
+	e.OutgoingWorkerCount = 0
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		if submission {
+			done <- e.ServeSubmission(ctx, listener, nil, tlsConfig)
+		} else {
+			done <- e.ServeSMTP(ctx, listener, nil, tlsConfig)
+		}
+	}()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("serve: %s", err)
+		}
+	})
+	return listener.Addr().String()
+}
+
+// Connect to a server started with testServe and introduce the client
+func testDial(t *testing.T, addr string, startTLS bool) *smtp.Client {
+	t.Helper()
+	var c *smtp.Client
+	var err error
+	if startTLS {
+		c, err = smtp.DialStartTLS(addr, &tls.Config{InsecureSkipVerify: true})
+	} else {
+		c, err = smtp.Dial(addr)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	if err := c.Hello("client.example.net"); err != nil {
+		t.Fatalf("EHLO: %s", err)
+	}
+	return c
+}
+
+func TestConnectHooksOncePerConnection(t *testing.T) {
+	e := New("example.org")
+	var connects, helos atomic.Int32
+	e.UseConnect(func(s *Session) error {
+		connects.Add(1)
+		return nil
+	})
+	e.UseHelo(func(s *Session) error {
+		helos.Add(1)
+		return nil
+	})
+	addr := testServe(t, &e, false, testTLSConfig(t))
+
+	c := testDial(t, addr, true)
+	if err := c.Noop(); err != nil {
+		t.Fatal(err)
+	}
+	if n := connects.Load(); n != 1 {
+		t.Errorf("connect hooks ran %d times, want once", n)
+	}
+	if n := helos.Load(); n != 2 {
+		t.Errorf("helo hooks ran %d times, want for the greetings before and after STARTTLS", n)
+	}
+}
+
+func TestConnectRejectionKept(t *testing.T) {
+	e := New("example.org")
+	var connects atomic.Int32
+	e.UseConnect(func(s *Session) error {
+		connects.Add(1)
+		return Reject("Go away")
+	})
+	addr := testServe(t, &e, false, nil)
+
+	c, err := textproto.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, _, err := c.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		if err := c.PrintfLine("EHLO client.example.net"); err != nil {
+			t.Fatal(err)
+		}
+		if code, _, _ := c.ReadResponse(250); code != 550 {
+			t.Fatalf("EHLO reply = %d, want 550", code)
+		}
+	}
+	if n := connects.Load(); n != 1 {
+		t.Errorf("connect hooks ran %d times, want once", n)
+	}
+}
+
+// Serve an engine for a domain on a local address without checking senders, and
+// deliver the outbound emails of sender to it
+func testReceiver(t *testing.T, sender *Engine, domain string) *Engine {
+	t.Helper()
+	receiver := New(domain)
+	receiver.IncomingValidateDKIM = false
+	receiver.IncomingValidateSPF = false
+	receiver.IncomingValidateDMARC = false
+	receiver.ErrorLogger = func(err error) {}
+	host, port, err := net.SplitHostPort(testServe(t, &receiver, false, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender.outgoingPort = port
+	sender.ErrorLogger = func(err error) {}
+	sender.Resolver = &testResolver{mx: map[string][]*net.MX{domain: {{Host: host, Pref: 10}}}}
+	return &receiver
+}
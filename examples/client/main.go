@@ -10,7 +10,7 @@ import (
 	"log"
 	"net/http"
 	"os"
-	"text/template"
+	"strings"
 	"time"
 )
 
@@ -19,6 +19,7 @@ var (
 	SMTP_DOMAIN      = envString("SMTP_DOMAIN", "example.org")
 	HTTP_ADDRESS     = envString("HTTP_ADDRESS", "http://localhost:80/queue")
 	SMTP_DESTINATION = envString("SMTP_DESTINATION", "user@example.org")
+	HTTP_BASE        = strings.TrimSuffix(HTTP_ADDRESS, "/queue") // Other endpoints are relative to the queue
 )
 
 var (
@@ -29,6 +30,18 @@ var (
 )
 
 func main() {
+	// Prepare Layout
+	// 	Layouts are shared between templates, replacing one only affects templates registered afterwards
+	layout, err := templateFS.ReadFile("templates/TEMPLATE.html")
+	if err != nil {
+		log.Fatalln("Cannot Read Layout:", err)
+	}
+	if err := request(http.MethodPut, "/layouts/main", http.StatusNoContent, map[string]any{
+		"html": string(layout),
+	}); err != nil {
+		log.Fatalln("Cannot Upload Layout:", err)
+	}
+
 	// Prepare Template
 	// 	Preferably you'd have a lot of these sitting at the top of a file somwhere
 	type LocalsForgotPassword struct {
@@ -37,8 +50,8 @@ func main() {
 	}
 	template := loadTemplate[LocalsForgotPassword]("FORGOT_PASSWORD", "Password Reset Request")
 
-	// You application would then query some data and execute a template
-	// sending the rendered output to the engines REST API
+	// You application would then query some data and ask the engine to render
+	// the template and queue the result
 	outboundAddress := SMTP_DESTINATION
 	outboundLocals := LocalsForgotPassword{
 		Displayname: "Example User",
@@ -49,65 +62,40 @@ func main() {
 	}
 }
 
-// Prepare a template returning a helper function which can called in the future
-// to execute and queue the function in the future.
+// Upload a new version of a template to the engine returning a helper function
+// which can be called in the future to render and queue it.
 func loadTemplate[L any](filename, subjectLine string) func(emailAddress string, locals L) error {
-	template, err := template.ParseFS(
-		templateFS,
-		"templates/TEMPLATE.html",
-		"templates/"+filename+".html",
-	)
+	content, err := templateFS.ReadFile("templates/" + filename + ".html")
 	if err != nil {
-		log.Fatalln("Cannot Parse Template:", err)
+		log.Fatalln("Cannot Read Template:", err)
+	}
+	if err := request(http.MethodPut, "/templates/"+filename, http.StatusCreated, map[string]any{
+		"from": map[string]any{
+			"name":    "Example Inc.",
+			"address": "noreply@" + SMTP_DOMAIN,
+		},
+		"subject": subjectLine,
+		"layout":  "main",
+		"html":    string(content),
+		"attachments": []map[string]any{{
+			"content_type": "image/png",
+			"filename":     "logo.png",
+			"data":         templateLogo,
+			"inline":       true,
+		}},
+	}); err != nil {
+		log.Fatalln("Cannot Upload Template:", err)
 	}
 	return func(emailAddress string, locals L) error {
-		// Generate Payload
-		output := bytes.Buffer{}
-		if err := template.Execute(&output, locals); err != nil {
-			return err
-		}
-		payload, err := json.Marshal([]map[string]any{{
+		if err := request(http.MethodPost, "/templates/"+filename+"/send", http.StatusCreated, []map[string]any{{
 			"to": []map[string]any{{
 				"name":    emailAddress,
 				"address": emailAddress,
 			}},
-			"from": map[string]any{
-				"name":    "Example Inc.",
-				"address": "noreply@" + SMTP_DOMAIN,
-			},
-			"subject": subjectLine,
-			"content": output.String(),
-			"html":    true,
-			"attachments": []map[string]any{{
-				"content_type": "image/png",
-				"filename":     "logo.png",
-				"data":         templateLogo,
-				"inline":       true,
-			}},
-		}})
-		if err != nil {
-			return err
-		}
-
-		// Generate Request
-		ctx, cancel := context.WithTimeout(context.Background(), CONTEXT_TIMEOUT)
-		defer cancel()
-		request, err := http.NewRequestWithContext(ctx, "POST", HTTP_ADDRESS, bytes.NewReader(payload))
-		if err != nil {
-			return err
-		}
-		request.Header.Set("Content-Type", "application/json")
-
-		// Validate Response
-		response, err := http.DefaultClient.Do(request)
-		if err != nil {
+			"locals": locals,
+		}}); err != nil {
 			return err
 		}
-		defer response.Body.Close()
-		if response.StatusCode != http.StatusCreated {
-			body, _ := io.ReadAll(response.Body)
-			return fmt.Errorf("server responded with status %d: %s", response.StatusCode, string(body))
-		}
 
 		// Log Outbound Email
 		log.Printf("Outgoing Email: %s => %s\n", filename, emailAddress)
@@ -115,6 +103,35 @@ func loadTemplate[L any](filename, subjectLine string) func(emailAddress string,
 	}
 }
 
+// Send a JSON request to the engines REST API, expecting the given status code
+func request(method, path string, expectedStatus int, body any) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	// Generate Request
+	ctx, cancel := context.WithTimeout(context.Background(), CONTEXT_TIMEOUT)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, method, HTTP_BASE+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	// Validate Response
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != expectedStatus {
+		body, _ := io.ReadAll(response.Body)
+		return fmt.Errorf("server responded with status %d: %s", response.StatusCode, string(body))
+	}
+	return nil
+}
+
 func envString(field, initial string) string {
 	var Value = os.Getenv(field)
 	if Value == "" {
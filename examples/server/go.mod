@@ -7,6 +7,7 @@ replace github.com/bakonpancakz/tools-email/email => ../../email
 require github.com/bakonpancakz/tools-email/email v0.0.0-00010101000000-000000000000
 
 require (
+	github.com/andybalholm/cascadia v1.3.3 // indirect
 	github.com/cention-sany/utf7 v0.0.0-20170124080048-26cad61bd60a // indirect
 	github.com/emersion/go-msgauth v0.7.0 // indirect
 	github.com/emersion/go-sasl v0.0.0-20241020182733-b788ff22d5a6 // indirect
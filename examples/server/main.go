@@ -30,13 +30,10 @@ var (
 	SMTP_DOMAIN  = envString("SMTP_DOMAIN", "example.org")
 	SMTP_ADDRESS = envString("SMTP_ADDRESS", "0.0.0.0:25")
 	HTTP_ADDRESS = envString("HTTP_ADDRESS", "0.0.0.0:80")
+	SUBM_ADDRESS = envString("SUBM_ADDRESS", "0.0.0.0:587")
+	SUBM_SECRET  = envString("SUBM_SECRET", "")
 )
 
-func init() {
-	// Preprocess Template
-	noReplyIndex = strings.ReplaceAll(noReplyIndex, "{{DOMAIN}}", SMTP_DOMAIN)
-}
-
 func main() {
 	// Create a new engine instance for our domain
 	e := email.New(SMTP_DOMAIN)
@@ -52,7 +49,7 @@ func main() {
 	e.AuthHandler = func(r *http.Request) bool {
 		// Example 1: Passphrase
 		// 	Compare Authorization Header against a string (preferable from environment variables)
-		// return r.Header.Get("Authorization") == "KasaneTeto0401"
+		// return r.Header.Get("Authorization") == os.Getenv("HTTP_SECRET")
 
 		// Example 2: Address Allowlist
 		// 	Allow requests from specific IP ranges, this one allow loopback requests
@@ -66,46 +63,107 @@ func main() {
 	}
 
 	// In the case an email comes in with no valid recipient we can write a function to log the email.
-	// 	Please note that the SMTP Server will still respond with a '550 Invalid Recipient'
-	// 	error and this behaviour cannot be modified.
+	// 	Please note that providing this handler makes the SMTP Server accept emails for unknown
+	// 	recipients, without it they are rejected with '550 Unknown Recipient' before the body is sent.
 	e.NoInboxHandler = func(e *email.Email) error {
 		log.Printf("No Inbox for To=%v, Subject=%q, From=%q\n", e.To, e.Subject, e.From)
 		return nil
 	}
 
+	// Registering Templates
+	// 	Templates are rendered using html/template, so locals are escaped for us. A typed template
+	// 	only accepts locals of the given type and is test rendered so typos are caught at startup.
+	type LocalsNoReply struct {
+		Domain string
+	}
+	noReply, err := email.RegisterTypedTemplate[LocalsNoReply](&e, email.Template{
+		Name:    "noreply",
+		From:    email.Address{Name: "Example Inc.", Address: "noreply@" + e.Domain},
+		Subject: "beep boop (Need Help?)",
+		HTML:    noReplyIndex,
+		Attachments: []email.Attachment{{
+			ContentType: "image/png",
+			Filename:    "robot.png",
+			Data:        noReplyImage,
+			Inline:      true,
+		}},
+	})
+	if err != nil {
+		log.Fatalln("Cannot Register Template:", err)
+	}
+
+	// Inlining Stylesheets
+	// 	Many email clients strip <style> blocks, so templates can use classes and have their rules moved
+	// 	into style attributes before sending. Media queries are kept and made !important so they still apply.
+	e.OutgoingInlineCSS = true
+
+	// Localizing Templates
+	// 	A template can be registered once per locale, recipients are sent the variant which best matches
+	// 	their locale so 'pt-BR' falls back to 'pt' and then e.TemplateLocale. Alternatively a single variant
+	// 	can translate its text using messages, e.g. {{t "expires" .Hours}} picks the right plural form.
+	if err := e.RegisterMessages("pt", map[string]email.Message{
+		"expires": {"one": "O link expira em %d hora", "other": "O link expira em %d horas"},
+	}); err != nil {
+		log.Fatalln("Cannot Register Messages:", err)
+	}
+
 	// Registering Inboxes
 	// 	Our application sends out emails as 'noreply@{{DOMAIN}}' in the case our user
 	// 	accidentally send an email to our noreply inbox we can reply with a friendly message!
 	e.RegisterInbox("noreply", func(em *email.Email) error {
-		e.QueueEmail(&email.Email{
-			To:      []email.Address{{Name: em.From.Name, Address: em.From.Address}},
-			From:    email.Address{Name: "Example Inc.", Address: "noreply@" + e.Domain},
-			Subject: "beep boop (Need Help?)",
-			Content: noReplyIndex,
-			HTML:    true,
-			Attachments: []email.Attachment{{
-				ContentType: "image/png",
-				Filename:    "robot.png",
-				Data:        noReplyImage,
-				Inline:      true,
-			}},
-		})
+		to := []email.Address{{Name: em.From.Name, Address: em.From.Address}}
+		_, err := noReply.Send(to, LocalsNoReply{Domain: e.Domain})
+		return err
+	})
+
+	// Routing Inboxes
+	// 	Sub-addresses are routed to their inbox with the tag exposed, so 'support+1234@{{DOMAIN}}' reaches
+	// 	the 'support' inbox. Patterns and a catch-all take care of everything else for our domain.
+	e.RegisterInbox("support", func(em *email.Email) error {
+		log.Printf("Support Request for Ticket %q from %q\n", em.Recipient.Tag, em.From.Address)
+		return nil
+	})
+	e.RegisterInboxPattern("*-alerts", func(em *email.Email) error {
+		log.Printf("Alert for %q: %s\n", em.Recipient.Inbox, em.Subject)
 		return nil
 	})
 
+	// Aliases deliver to another inbox, while forwards send the original email on to external
+	// 	mailboxes. Set e.SRSSecret to a persistent value so bounces still find their way back after a restart.
+	e.RegisterAlias("help", "support")
+	e.RegisterForward("ceo", "ceo@gmail.com")
+
+	// Webhooks post incoming emails to an external service which decides if they are accepted,
+	// 	requests are signed using the secret so the service can verify they came from us.
+	e.RegisterWebhookInbox("billing", email.Webhook{
+		URL:     "https://billing.example.org/hooks/email",
+		Secret:  "correct-horse-battery-staple",
+		Retries: 2,
+	})
+
 	// Using Middleware
 	// 	We can use middleware to filter inbound emails or cancel outbound emails.
-	// 	Additionally we can provide an error which will be passed to our engine error logger.
+	// 	Inbound middleware can return an email.Rejection to choose the SMTP reply sent to the client,
+	// 	any other error is passed to our engine error logger and the client is asked to retry later.
 	e.UseIncoming(func(em *email.Email) (bool, error) {
 		// Example: Basic Spam Filter
 		if em.From.Address == "hatsunemiku@crypton.co.jp" {
+			return false, email.Reject("Sender is not welcome here")
+		}
+		return true, nil
+	})
+	// Example: Soft DKIM Validation
+	// 	Signatures are always verified and recorded, but unsigned emails are accepted unless
+	// 	IncomingRejectDKIMFail is set, so we can require signatures only from senders we know sign their mail.
+	e.UseIncoming(func(em *email.Email) (bool, error) {
+		if strings.HasSuffix(em.From.Address, "@gmail.com") && !em.Authentication.PassedDKIM() {
 			return false, nil
 		}
 		return true, nil
 	})
 	// Example: Basic Inbound Email Logger
 	e.UseIncoming(func(em *email.Email) (bool, error) {
-		log.Println("Incoming Email from", em.From.Address)
+		log.Println("Incoming Email from", em.From.Address, "via", em.Received.RemoteIP)
 		return true, nil
 	})
 	// Example: Basic Outbound Email Logger
@@ -114,9 +172,47 @@ func main() {
 		return true, nil
 	})
 
+	// Tracking Deliveries
+	// 	Every outbound email is given an ID which delivery events refer to. Events are posted to
+	// 	webhooks until they are accepted, a file-backed store keeps them safe across restarts.
+	events, err := email.NewFileEventStore("events.json")
+	if err != nil {
+		log.Fatalln("Cannot Open Event Store:", err)
+	}
+	e.Events = events
+	e.RegisterEventWebhook(email.Webhook{URL: "https://app.example.org/hooks/delivery"})
+	e.OnDeliveryEvent(func(ev email.DeliveryEvent) {
+		log.Printf("Email %s to %q was %s: %s\n", ev.MessageID, ev.Recipient, ev.Status, ev.Response)
+	})
+
+	// Using Connection Hooks
+	// 	Hooks run before the email body is uploaded, letting us turn away unwanted clients early.
+	e.UseHelo(func(s *email.Session) error {
+		if s.Hostname() == "localhost" {
+			return email.Reject("Please introduce yourself properly")
+		}
+		return nil
+	})
+
+	// Accepting Submissions
+	// 	Applications and devices which can only send via SMTP may log in to the submission server,
+	// 	their emails are queued just like ones sent via the REST API. Each user is limited to the
+	// 	'From' addresses we give them, a leading '@' allows any address of a domain.
+	// 	The submission server is only started if SUBM_SECRET is set, so no default password exists.
+	if SUBM_SECRET != "" {
+		credentials := email.NewMemoryCredentialStore()
+		if err := credentials.AddUser("printer", SUBM_SECRET, "printer@"+e.Domain); err != nil {
+			log.Fatalln("Cannot Add Submission User:", err)
+		}
+		e.Credentials = credentials
+	}
+
 	// Startup Servers
 	// 	We use the provided Load functions to quickly parse and initialize a TLS Configuration and DKIM Signer.
 	// 	For this example TLS on the REST API is disabled by passing nil, but you should enable this in production.
+	// 	Any amount of SMTP servers can be started, e.g. e.StartSMTPTLS(...) for implicit TLS, they all
+	// 	share the same inboxes, middleware and outbound workers.
+	// 	A send-only deployment can skip them and run go e.StartWorkers(ctx, dkimSigner) instead.
 	dkimSigner, err := email.LoadDKIMSigner(PATH_RSA)
 	if err != nil {
 		log.Fatalln("Cannot Load DKIM Key: ", err)
@@ -126,6 +222,9 @@ func main() {
 		log.Fatalln("Cannot Setup TLS:", err)
 	}
 	go e.StartSMTP(SMTP_ADDRESS, dkimSigner, tlsConfig)
+	if SUBM_SECRET != "" {
+		go e.StartSubmission(SUBM_ADDRESS, dkimSigner, tlsConfig)
+	}
 	go e.StartHTTP(HTTP_ADDRESS, nil)
 
 	// Shutdown Server